@@ -86,6 +86,16 @@ type AuthHandler interface {
 	GenSecret(uid types.Uid, authLvl int, lifetime time.Duration) ([]byte, time.Time, AuthErr)
 }
 
+// Challenger is an optional interface of auth providers which need a challenge round trip
+// before authentication, such as SMS OTP.
+type Challenger interface {
+	// Check if the user-provided secret is incomplete and, if so, issue a challenge to send to
+	// the client, such as a token to include into the follow-up secret. A nil challenge means
+	// the secret is complete and should be passed to Authenticate.
+	// Returns: challenge, AuthErr.
+	Challenge(secret []byte) (interface{}, AuthErr)
+}
+
 // AuthLevelName gets human-readable name for a numeric authentication level.
 func AuthLevelName(authLvl int) string {
 	switch authLvl {
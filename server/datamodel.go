@@ -9,9 +9,22 @@ package main
  *****************************************************************************/
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/tinode/chat/server/store/types"
 )
 
 // MsgBrowseOpts defines parameters for queries by massage IDs.
@@ -22,12 +35,72 @@ type MsgBrowseOpts struct {
 	BeforeId int `json:"before,omitempty"`
 	// Limit the number of messages loaded
 	Limit int `json:"limit,omitempty"`
+	// Delete ID to continue from as reported in {meta cursor}, del queries only
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// CursorDelId returns the delete ID the Cursor points to, 0 if the Cursor is not set.
+func (o *MsgBrowseOpts) CursorDelId() (int, error) {
+	if o == nil {
+		return 0, nil
+	}
+	return parseCursor(o.Cursor)
+}
+
+// MsgSince is a lower bound of a query expressed either as a message ID or as a timestamp.
+type MsgSince struct {
+	// Server-issued sequential ID
+	SeqId int `json:"seq,omitempty"`
+	// Timestamp
+	Time *time.Time `json:"ts,omitempty"`
 }
 
 // MsgGetOpts defines parameters for queries by last modified time.
 type MsgGetOpts struct {
 	IfModifiedSince *time.Time `json:"ims,omitempty"`
-	Limit           int        `json:"limit,omitempty"`
+	// Alternative to IfModifiedSince
+	Since *MsgSince `json:"since,omitempty"`
+	Limit int       `json:"limit,omitempty"`
+	// Etag of the cached copy: the reply is "not modified" if it's still current, desc queries only
+	IfNoneMatch string `json:"inm,omitempty"`
+	// Report the peer's last-seen in the description of a P2P topic, desc queries only
+	IncludeSeen bool `json:"seen,omitempty"`
+	// Key of the subscription to continue after as reported in {meta cursor}, sub queries only
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// parseCursor parses the cursor reported in {meta} as a non-negative number.
+func parseCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(cursor)
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return offset, nil
+}
+
+// NoneMatch checks if the etag is different from the one in IfNoneMatch, i.e. the client's cached
+// copy is stale or missing.
+func (o *MsgGetOpts) NoneMatch(etag string) bool {
+	return o == nil || o.IfNoneMatch == "" || o.IfNoneMatch != etag
+}
+
+// ModifiedSince returns the effective "if modified since" timestamp of the query or nil.
+// The explicit IfModifiedSince takes precedence over Since.Time. The queries are time-based,
+// so Since.SeqId is ignored.
+func (o *MsgGetOpts) ModifiedSince() *time.Time {
+	if o == nil {
+		return nil
+	}
+	if o.IfModifiedSince != nil {
+		return o.IfModifiedSince
+	}
+	if o.Since != nil {
+		return o.Since.Time
+	}
+	return nil
 }
 
 // MsgGetQuery is a topic metadata or data query.
@@ -44,6 +117,55 @@ type MsgGetQuery struct {
 	Del *MsgBrowseOpts `json:"del,omitempty"`
 }
 
+// DelLimit returns the number of deletion records requested by the "del" query constrained to a sane
+// range: default if the limit is missing or not positive, max if it's excessive.
+func (q MsgGetQuery) DelLimit(def, max int) int {
+	var limit int
+	if q.Del != nil {
+		limit = q.Del.Limit
+	}
+	return clampLimit(limit, def, max)
+}
+
+// IsEmpty checks if the query requests nothing: What is empty or has no known parts.
+func (q MsgGetQuery) IsEmpty() bool {
+	return parseMsgClientMeta(q.What) == 0
+}
+
+// metaOrder is the order in which parts of a {get} request are served: the topic description
+// always precedes subscriptions, tags, messages, and deletions.
+var metaOrder = []int{constMsgMetaDesc, constMsgMetaSub, constMsgMetaTags, constMsgMetaData, constMsgMetaDel}
+
+// OrderedParts returns the parts requested in What as constMsgMeta* bits in the canonical delivery order.
+func (q MsgGetQuery) OrderedParts() []int {
+	what := parseMsgClientMeta(q.What)
+
+	var parts []int
+	for _, part := range metaOrder {
+		if what&part != 0 {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// metaPartName returns the name of a constMsgMeta* bit as used in {get what}.
+func metaPartName(part int) string {
+	switch part {
+	case constMsgMetaDesc:
+		return "desc"
+	case constMsgMetaSub:
+		return "sub"
+	case constMsgMetaTags:
+		return "tags"
+	case constMsgMetaData:
+		return "data"
+	case constMsgMetaDel:
+		return "del"
+	}
+	return ""
+}
+
 // MsgSetSub is a payload in set.sub request to update current subscription or invite another user, {sub.what} == "sub"
 type MsgSetSub struct {
 	// User affected by this request. Default (empty): current user
@@ -51,13 +173,74 @@ type MsgSetSub struct {
 
 	// Access mode change, either Given or Want depending on context
 	Mode string `json:"mode,omitempty"`
+
+	// Mute or unmute push notifications from the topic, own subscription only. Nil: leave unchanged
+	Muted *bool `json:"muted,omitempty"`
+}
+
+// validateBatchSize checks that a batch sent by the client has no more than max entries.
+func validateBatchSize(size, max int) error {
+	if size > max {
+		return errors.New("batch too large: " + strconv.Itoa(size))
+	}
+	return nil
+}
+
+// validateSetSubs checks a batch of subscription changes: each must have a valid ID of a user,
+// every user mentioned once.
+func validateSetSubs(subs []MsgSetSub) error {
+	seen := make(map[types.Uid]bool, len(subs))
+	for i := range subs {
+		uid := types.ParseUserId(subs[i].User)
+		if uid.IsZero() {
+			return errors.New("invalid or missing user id in a batch: '" + subs[i].User + "'")
+		}
+		if seen[uid] {
+			return errors.New("duplicate user in a batch: " + subs[i].User)
+		}
+		seen[uid] = true
+	}
+	return nil
+}
+
+// MsgSetSubResult is the result of one change in a batch of subscription changes, reported in the params
+// of the {ctrl} response.
+type MsgSetSubResult struct {
+	// User affected by the change
+	User string `json:"user"`
+	// Code and text of the outcome, same as in {ctrl}
+	Code int    `json:"code"`
+	Text string `json:"text"`
+	// Resulting access mode if the change succeeded
+	Acs *MsgAccessMode `json:"acs,omitempty"`
 }
 
 // MsgSetDesc is a C2S in set.what == "desc" and sub.init message
 type MsgSetDesc struct {
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"` // default access mode
 	Public     interface{}        `json:"public,omitempty"`
-	Private    interface{}        `json:"private,omitempty"` // Per-subscription private data
+	Private    interface{}        `json:"private,omitempty"`    // Per-subscription private data
+	PrivateVer int                `json:"privatever,omitempty"` // Client-defined version of the private data schema
+	Pinned     []int              `json:"pinned,omitempty"`     // IDs of pinned messages, group topics only
+	// Merge the update into the current desc: missing Public or Private are left unchanged. By default
+	// Public and Private are replaced together, i.e. the missing one is cleared.
+	Merge bool `json:"merge,omitempty"`
+}
+
+// contentUpdate returns the values of Public and Private to apply. A nil value means the field is
+// left unchanged, nullValue means the field is cleared.
+func (d *MsgSetDesc) contentUpdate() (public, private interface{}) {
+	public, private = d.Public, d.Private
+	if d.Merge || (public == nil && private == nil) {
+		return
+	}
+	if public == nil {
+		public = nullValue
+	}
+	if private == nil {
+		private = nullValue
+	}
+	return
 }
 
 // MsgSetQuery is an update to topic metadata: Desc, subscriptions, or tags.
@@ -66,23 +249,98 @@ type MsgSetQuery struct {
 	Desc *MsgSetDesc `json:"desc,omitempty"`
 	// Subscription parameters
 	Sub *MsgSetSub `json:"sub,omitempty"`
+	// Batch of changes to subscriptions of other users, such as invites of several users at once
+	Users []MsgSetSub `json:"subs,omitempty"`
 	// Indexable tags for user discovery
-	Tags []string `json:"tags"`
+	Tags []string `json:"tags,omitempty"`
+	// Apply the update (all parts of it) only if the description still has this etag
+	IfMatch string `json:"ifmatch,omitempty"`
+}
+
+// ChangesDefaultAcs checks if the {set} requests a change of the default access mode of the topic.
+func (q MsgSetQuery) ChangesDefaultAcs() bool {
+	return q.Desc != nil && q.Desc.DefaultAcs != nil
 }
 
 // MsgFindQuery is a format of fndXXX.private.
 type MsgFindQuery struct {
 	// List of tags to query for. Tags of the form "email:jdoe@example.com" or "tel:18005551212"
 	Tags []string `json:"tags"`
+	// Results matching any of these tags are excluded
+	Exclude []string `json:"excl,omitempty"`
 }
 
-// MsgDelRange is aither an individual ID (HiId=0) or a randge of deleted IDs, low end inclusive (closed),
-// high-end exclusive (open): [LowId .. HiId), e.g. 1..5 -> 1, 2, 3, 4
+// Validate checks the shape of the query and exclusion tags.
+func (q *MsgFindQuery) Validate() error {
+	for _, tag := range append(q.Tags, q.Exclude...) {
+		if !validTagShape(tag) {
+			return errors.New("invalid tag '" + truncateRunes(tag, maxLoggedTagLength) + "'")
+		}
+	}
+	return nil
+}
+
+// MsgDelRange is either an individual ID (HiId=0) or a range of deleted IDs, both ends inclusive (closed):
+// [LowId .. HiId], e.g. 1..5 -> 1, 2, 3, 4, 5
 type MsgDelRange struct {
 	LowId int `json:"low,omitempty"`
 	HiId  int `json:"hi,omitempty"`
 }
 
+// Validate checks if the range is well-formed.
+func (dr MsgDelRange) Validate() error {
+	if dr.LowId <= 0 || dr.HiId < 0 || (dr.HiId > 0 && dr.LowId > dr.HiId) {
+		return errors.New("invalid range")
+	}
+	return nil
+}
+
+// span returns the number of IDs in the range.
+func (dr MsgDelRange) span() int {
+	if dr.HiId == 0 {
+		return 1
+	}
+	return dr.HiId - dr.LowId + 1
+}
+
+// FindSeqGaps returns ranges of message IDs in 1..maxSeq (inclusive) which are missing from have.
+// IDs in have may be unsorted or duplicated; IDs outside of 1..maxSeq are ignored. The ranges are inclusive
+// like any other MsgDelRange, a single missing ID has HiId=0.
+func FindSeqGaps(have []int, maxSeq int) []MsgDelRange {
+	if maxSeq <= 0 {
+		return nil
+	}
+
+	sorted := make([]int, len(have))
+	copy(sorted, have)
+	sort.Ints(sorted)
+
+	var gaps []MsgDelRange
+	addGap := func(low, hi int) {
+		if low == hi {
+			gaps = append(gaps, MsgDelRange{LowId: low})
+		} else if low < hi {
+			gaps = append(gaps, MsgDelRange{LowId: low, HiId: hi})
+		}
+	}
+
+	// The lowest ID which is not known to be present yet.
+	next := 1
+	for _, seq := range sorted {
+		if seq < next {
+			continue
+		}
+		if seq > maxSeq {
+			break
+		}
+		addGap(next, seq-1)
+		next = seq + 1
+	}
+	addGap(next, maxSeq)
+
+	return gaps
+}
+
 // Client to Server (C2S) messages
 
 // MsgClientHi is a handshake {hi} message.
@@ -97,6 +355,42 @@ type MsgClientHi struct {
 	DeviceID string `json:"dev,omitempty"`
 	// ISO 639-1 human language of the connected device
 	Lang string `json:"lang,omitempty"`
+	// Authentication token of an earlier session to resume without a {login}
+	SessionToken string `json:"stok,omitempty"`
+	// Time zone of the device as the offset from UTC in minutes, i.e. -420 for UTC-07:00
+	Tz int `json:"tz,omitempty"`
+	// The client accepts stored messages as {databatch} instead of individual {data}
+	DataBatch bool `json:"databatch,omitempty"`
+}
+
+// Range of valid time zone offsets in minutes: UTC-12:00 to UTC+14:00.
+const (
+	minTzOffset = -12 * 60
+	maxTzOffset = 14 * 60
+)
+
+// ValidTz checks if the time zone offset is within the range of real time zones.
+func (h *MsgClientHi) ValidTz() bool {
+	return h.Tz >= minTzOffset && h.Tz <= maxTzOffset
+}
+
+// Location returns the client's time zone as a fixed offset from UTC, named like "UTC+05:30".
+// The offset is expected to be valid.
+func (h *MsgClientHi) Location() *time.Location {
+	if h.Tz == 0 {
+		return time.UTC
+	}
+	sign, offset := '+', h.Tz
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	name := fmt.Sprintf("UTC%c%02d:%02d", sign, offset/60, offset%60)
+	return time.FixedZone(name, h.Tz*60)
+}
+
+// WantsResume checks if the client asked to resume an earlier authenticated session.
+func (h *MsgClientHi) WantsResume() bool {
+	return h.SessionToken != ""
 }
 
 // MsgClientAcc is a user creation message {acc}.
@@ -113,10 +407,63 @@ type MsgClientAcc struct {
 	Login bool `json:"login"`
 	// Indexable tags for user discovery
 	Tags []string `json:"tags"`
+	// Verified credentials to create the account with, such as email or phone number
+	Cred []MsgCredClient `json:"cred,omitempty"`
 	// User initialization data when creating a new user, otherwise ignored
 	Desc *MsgSetDesc `json:"desc,omitempty"`
 }
 
+// authSchemeCred is the scheme of accounts created from verified credentials only, without a secret.
+const authSchemeCred = "cred"
+
+// IsCredentialOnly checks if the {acc} creates an account from credentials alone, without a secret.
+func (a *MsgClientAcc) IsCredentialOnly() bool {
+	return a.Scheme == authSchemeCred && len(a.Secret) == 0 && len(a.Cred) > 0
+}
+
+// errAccInconsistent is returned by MsgClientAcc.ValidateConsistency when the tags contradict the credentials.
+var errAccInconsistent = errors.New("acc: tags do not match credentials")
+
+// Credential methods which have matching tags of the form "method:value".
+var credTagMethods = map[string]bool{"email": true, "tel": true}
+
+// ValidateConsistency checks that every "email:" and "tel:" tag of the new account corresponds to one
+// of the credentials provided in the {acc}. Methods and values are compared case-insensitively and
+// ignoring surrounding whitespace.
+func (a *MsgClientAcc) ValidateConsistency() error {
+	for _, tag := range a.Tags {
+		parts := strings.SplitN(strings.TrimSpace(tag), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		method, val := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		if !credTagMethods[method] {
+			continue
+		}
+
+		found := false
+		for _, cred := range a.Cred {
+			if strings.ToLower(strings.TrimSpace(cred.Method)) == method &&
+				strings.EqualFold(strings.TrimSpace(cred.Value), val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errAccInconsistent
+		}
+	}
+	return nil
+}
+
+// MsgCredClient is an account credential such as email or phone number as sent by the client.
+type MsgCredClient struct {
+	// Credential type, i.e. `email` or `tel`.
+	Method string `json:"meth,omitempty"`
+	// Credential value, i.e. `jdoe@example.com` or `+17025550001`
+	Value string `json:"val,omitempty"`
+}
+
 // MsgClientLogin is a login {login} message.
 type MsgClientLogin struct {
 	// Message Id
@@ -139,6 +486,37 @@ type MsgClientSub struct {
 	Get *MsgGetQuery `json:"get,omitempty"`
 }
 
+// InitialDataLimit returns the number of messages to send to the client right after subscribing.
+// The default value is returned if the request does not specify the limit.
+func (s *MsgClientSub) InitialDataLimit() int {
+	var limit int
+	if s.Get != nil && s.Get.Data != nil {
+		limit = s.Get.Data.Limit
+	}
+	return clampLimit(limit, maxQueryLimit, maxQueryLimit)
+}
+
+// EnsureDefaultGet requests the topic description, subscribers and up to limit latest messages
+// if the {sub} has no embedded {get}. An existing Get is left unchanged.
+func (s *MsgClientSub) EnsureDefaultGet(limit int) {
+	if s.Get != nil {
+		return
+	}
+	s.Get = &MsgGetQuery{
+		What: "desc sub data",
+		Data: &MsgBrowseOpts{Limit: limit},
+	}
+}
+
+// WantMode returns the access mode requested in {sub set.sub.mode} or an empty string if none
+// is requested.
+func (s *MsgClientSub) WantMode() string {
+	if s == nil || s.Set == nil || s.Set.Sub == nil {
+		return ""
+	}
+	return s.Set.Sub.Mode
+}
+
 const (
 	constMsgMetaDesc = 1 << iota
 	constMsgMetaSub
@@ -152,8 +530,7 @@ const (
 
 func parseMsgClientMeta(params string) int {
 	var bits int
-	parts := strings.SplitN(params, " ", 8)
-	for _, p := range parts {
+	for _, p := range strings.Fields(params) {
 		switch p {
 		case "desc":
 			bits |= constMsgMetaDesc
@@ -194,6 +571,28 @@ type MsgDefaultAcsMode struct {
 	Anon string `json:"anon,omitempty"`
 }
 
+// defaultAcsError is returned by MsgDefaultAcsMode.Validate. The field is either "auth" or "anon".
+type defaultAcsError struct {
+	field string
+	err   error
+}
+
+func (e *defaultAcsError) Error() string {
+	return "invalid default " + e.field + " access mode: " + e.err.Error()
+}
+
+// Validate checks if both access modes are either empty or valid access mode strings.
+func (m *MsgDefaultAcsMode) Validate() error {
+	var mode types.AccessMode
+	if err := mode.UnmarshalText([]byte(m.Auth)); err != nil {
+		return &defaultAcsError{field: "auth", err: err}
+	}
+	if err := mode.UnmarshalText([]byte(m.Anon)); err != nil {
+		return &defaultAcsError{field: "anon", err: err}
+	}
+	return nil
+}
+
 // MsgClientLeave is an unsubscribe {leave} request message.
 type MsgClientLeave struct {
 	Id    string `json:"id,omitempty"`
@@ -201,13 +600,290 @@ type MsgClientLeave struct {
 	Unsub bool   `json:"unsub,omitempty"`
 }
 
+// shouldEcho checks if the {data} created from the {pub} should be delivered to the target session:
+// the {pub noecho} suppresses delivery to the originating session only.
+func shouldEcho(pub *MsgClientPub, originSid, targetSid string) bool {
+	return pub == nil || !pub.NoEcho || originSid != targetSid
+}
+
 // MsgClientPub is client's request to publish data to topic subscribers {pub}
 type MsgClientPub struct {
-	Id      string            `json:"id,omitempty"`
-	Topic   string            `json:"topic"`
-	NoEcho  bool              `json:"noecho,omitempty"`
-	Head    map[string]string `json:"head,omitempty"`
-	Content interface{}       `json:"content"`
+	Id           string            `json:"id,omitempty"`
+	Topic        string            `json:"topic"`
+	NoEcho       bool              `json:"noecho,omitempty"`
+	Silent       bool              `json:"silent,omitempty"`
+	ExpireOnRead bool              `json:"eor,omitempty"`
+	Head         map[string]string `json:"head,omitempty"`
+	Content      interface{}       `json:"content"`
+	// Deliver the message at this time instead of immediately
+	SendAt *time.Time `json:"sendat,omitempty"`
+	// The message is an unsent draft to sync between user's sessions rather than to publish
+	Draft bool `json:"draft,omitempty"`
+}
+
+// IsDraft checks if the {pub} is a draft which is delivered to the user's own sessions only.
+func (p *MsgClientPub) IsDraft() bool {
+	return p != nil && p.Draft
+}
+
+// draftVisibleTo checks if the {data} created from the {pub} by the user 'from' may be delivered
+// to the user uid: drafts are not delivered to anyone but the author.
+func draftVisibleTo(pub *MsgClientPub, from string, uid types.Uid) bool {
+	return !pub.IsDraft() || types.ParseUserId(from) == uid
+}
+
+// InferredMime guesses the MIME type of the content when the head["mime"] is missing: "text/plain" for
+// a string, "application/json" for an object or any other JSON value, an empty string if the content
+// is missing.
+func (p *MsgClientPub) InferredMime() string {
+	switch p.Content.(type) {
+	case nil:
+		return ""
+	case string:
+		return mimeTextPlain
+	}
+	return mimeJSON
+}
+
+// Values of {pub head["mime"]} known to the server.
+const (
+	mimeTextPlain = "text/plain"
+	mimeJSON      = "application/json"
+	// Rich text format of Tinode clients.
+	mimeDrafty = "text/x-drafty"
+	mimeJPEG   = "image/jpeg"
+	mimePNG    = "image/png"
+)
+
+// allowedMimes is the set of {pub head["mime"]} values clients are permitted to publish.
+var allowedMimes = map[string]bool{
+	mimeTextPlain: true,
+	mimeJSON:      true,
+	mimeDrafty:    true,
+	mimeJPEG:      true,
+	mimePNG:       true,
+}
+
+// mimeRestricted is true if only the allowedMimes may be published. Otherwise any well-formed
+// type is accepted.
+var mimeRestricted = true
+
+// restrictMimes permits the given MIME types in {pub head["mime"]} in addition to the default ones.
+// If allowAny is true, any well-formed type is permitted.
+func restrictMimes(mimes []string, allowAny bool) {
+	for _, mime := range mimes {
+		RegisterAllowedMime(mime)
+	}
+	mimeRestricted = !allowAny
+}
+
+// RegisterAllowedMime adds the MIME type to the set of types accepted in {pub head["mime"]}.
+// It's not safe for concurrent use and must be called before the server starts accepting connections.
+func RegisterAllowedMime(mime string) {
+	if mime == "" {
+		panic("RegisterAllowedMime: empty mime type")
+	}
+	allowedMimes[strings.ToLower(mime)] = true
+}
+
+// IsAllowedMime checks if the MIME type is well-formed and, unless any type is allowed, has been
+// registered. The type is case-insensitive and may have parameters, e.g. "text/plain; charset=utf-8".
+func IsAllowedMime(mimeType string) bool {
+	media, _, err := mime.ParseMediaType(mimeType)
+	return err == nil && (!mimeRestricted || allowedMimes[media])
+}
+
+// MsgLocationContent is the {pub content} sharing the sender's coordinates.
+type MsgLocationContent struct {
+	// Latitude and longitude in degrees
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// Optional human-readable name of the place
+	Label string `json:"label,omitempty"`
+	// The location is updated live until the Until time
+	Live  bool       `json:"live,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// DecodeLocationContent converts the {pub content} into the location by re-encoding it as JSON.
+// The ok is false if the content is not a location: lat or lon are missing or out of range.
+func DecodeLocationContent(content interface{}) (*MsgLocationContent, bool) {
+	obj, ok := content.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if _, ok = obj["lat"].(float64); !ok {
+		return nil, false
+	}
+	if _, ok = obj["lon"].(float64); !ok {
+		return nil, false
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, false
+	}
+	var loc MsgLocationContent
+	if err = json.Unmarshal(data, &loc); err != nil {
+		return nil, false
+	}
+	if !validCoordinates(loc.Lat, loc.Lon) {
+		return nil, false
+	}
+	return &loc, true
+}
+
+// validCoordinates checks that the latitude is within [-90, 90] and the longitude within [-180, 180] degrees.
+func validCoordinates(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// ScheduledAt returns the time the delivery of the {pub} is scheduled for, nil if not scheduled.
+func (p *MsgClientPub) ScheduledAt() *time.Time {
+	if p == nil {
+		return nil
+	}
+	return p.SendAt
+}
+
+// shouldDefer checks if the delivery of a {pub} scheduled for sendAt should be deferred: sendAt is
+// in the future but no further than maxAhead from now. A missing or past time means immediate delivery.
+func shouldDefer(sendAt *time.Time, now time.Time, maxAhead time.Duration) bool {
+	return sendAt != nil && sendAt.After(now) && !sendAt.After(now.Add(maxAhead))
+}
+
+// validateHeadLimits checks that the {pub head} has at most maxKeys keys and no value is longer
+// than maxValBytes bytes.
+func validateHeadLimits(head map[string]string, maxKeys int, maxValBytes int) error {
+	if len(head) > maxKeys {
+		return errors.New("too many head keys")
+	}
+	for key, val := range head {
+		if len(val) > maxValBytes {
+			return errors.New("head value too long: " + key)
+		}
+	}
+	return nil
+}
+
+// validateContentDepth checks that objects and arrays in the {pub content} are nested no deeper
+// than max levels. A scalar has depth 0, a flat object or array has depth 1.
+func validateContentDepth(content interface{}, max int) error {
+	if contentDepthExceeds(content, max) {
+		return errors.New("content nested too deep")
+	}
+	return nil
+}
+
+// contentDepthExceeds checks if the content is nested deeper than the remaining allowance. It stops
+// descending as soon as the allowance is exhausted.
+func contentDepthExceeds(content interface{}, remaining int) bool {
+	switch val := content.(type) {
+	case map[string]interface{}:
+		if remaining <= 0 {
+			return true
+		}
+		for _, item := range val {
+			if contentDepthExceeds(item, remaining-1) {
+				return true
+			}
+		}
+	case []interface{}:
+		if remaining <= 0 {
+			return true
+		}
+		for _, item := range val {
+			if contentDepthExceeds(item, remaining-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reservedHeadKeys are {pub head} keys with meaning defined by the server or the clients.
+// They are case-insensitive.
+var reservedHeadKeys = map[string]bool{
+	"mime":                true,
+	headerContentEncoding: true,
+	headerReplace:         true,
+	headerReply:           true,
+	"forwarded":           true,
+	"thread":              true,
+	headerThumb:           true,
+	headerThumbWidth:      true,
+	headerThumbHeight:     true,
+}
+
+// headKeyAliases maps alternative spellings of reserved {pub head} keys used by various clients
+// to the canonical key.
+var headKeyAliases = map[string]string{
+	"replyto":  headerReply,
+	"reply-to": headerReply,
+}
+
+// normalizeHead lowercases reserved keys of the {pub head} and replaces aliases with canonical keys.
+// Custom keys are kept verbatim. If several keys resolve to the same canonical key, the canonical
+// spelling wins, then the lowercase one.
+func normalizeHead(head map[string]string) map[string]string {
+	if len(head) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(head))
+	// Canonical key -> the original key the value was taken from.
+	src := make(map[string]string)
+	for key, val := range head {
+		canon := strings.ToLower(key)
+		if alias, ok := headKeyAliases[canon]; ok {
+			canon = alias
+		}
+		if !reservedHeadKeys[canon] {
+			out[key] = val
+			continue
+		}
+		if prev, ok := src[canon]; ok && !headKeyPrecedes(key, prev, canon) {
+			continue
+		}
+		src[canon] = key
+		out[canon] = val
+	}
+	return out
+}
+
+// headKeyPrecedes checks if the value of the key 'a' should be used instead of the value of 'b'
+// when both resolve to the same canonical key.
+func headKeyPrecedes(a, b, canon string) bool {
+	if a == canon || b == canon {
+		return a == canon
+	}
+	aLower, bLower := a == strings.ToLower(a), b == strings.ToLower(b)
+	if aLower != bLower {
+		return aLower
+	}
+	// Make the choice deterministic.
+	return a < b
+}
+
+// customHeadPrefix is the prefix of application-defined {pub head} keys delivered to subscribers.
+const customHeadPrefix = "x-"
+
+// filterHeadForDelivery keeps the {pub head} keys which are delivered to subscribers: the reserved
+// keys and the custom keys prefixed with "x-". Other keys are client-private hints and are dropped.
+// The keys are expected to be normalized already.
+func filterHeadForDelivery(head map[string]string) map[string]string {
+	var out map[string]string
+	for key, val := range head {
+		lower := strings.ToLower(key)
+		if !reservedHeadKeys[lower] && !strings.HasPrefix(lower, customHeadPrefix) {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string, len(head))
+		}
+		out[key] = val
+	}
+	return out
 }
 
 // MsgClientGet is a query of topic state {get}.
@@ -233,20 +909,173 @@ type MsgClientDel struct {
 	What string `json:"what"`
 	// Delete messages with these IDs (either one by one or a set of ranges)
 	DelSeq []MsgDelRange `json:"delseq,omitempty"`
+	// Delete all messages older than this time. Mutually exclusive with DelSeq.
+	Before *time.Time `json:"before,omitempty"`
 	// User ID of the subscription to delete
 	User string `json:"user,omitempty"`
 	// Request to hard-delete messages for all users, if such option is available.
 	Hard bool `json:"hard,omitempty"`
 }
 
+var (
+	// errDelMalformed is returned by MsgClientDel.Validate when the request is malformed.
+	errDelMalformed = errors.New("del: malformed request")
+	// errDelTooBig is returned by MsgClientDel.Validate when the request exceeds the limits.
+	errDelTooBig = errors.New("del: request exceeds limits")
+)
+
+// Validate checks that the {del} request is well-formed and within the limits: the number of ranges
+// does not exceed maxRanges and no single range spans more than maxSpan IDs. Deleting messages
+// requires either DelSeq or Before but not both.
+// Returns errDelMalformed or errDelTooBig.
+func (d *MsgClientDel) Validate(maxRanges, maxSpan int) error {
+	what := parseMsgClientDel(d.What)
+	if what == 0 {
+		return errDelMalformed
+	}
+
+	if what != constMsgDelMsg {
+		return nil
+	}
+
+	if d.Before != nil {
+		if len(d.DelSeq) > 0 || d.Before.IsZero() {
+			return errDelMalformed
+		}
+		return nil
+	}
+
+	if len(d.DelSeq) == 0 {
+		return errDelMalformed
+	}
+	if len(d.DelSeq) > maxRanges {
+		return errDelTooBig
+	}
+
+	for _, dr := range d.DelSeq {
+		if dr.Validate() != nil {
+			return errDelMalformed
+		}
+		if dr.span() > maxSpan {
+			return errDelTooBig
+		}
+	}
+
+	return nil
+}
+
+// RequiresOwner checks if the {del} affects other users and thus needs more than the R permission:
+// hard-deleting messages, deleting the topic, or deleting someone's subscription. Soft-deleting
+// messages only hides them from the requester.
+func (d *MsgClientDel) RequiresOwner() bool {
+	switch parseMsgClientDel(d.What) {
+	case constMsgDelMsg:
+		return d.Hard
+	case constMsgDelTopic, constMsgDelSub:
+		return true
+	}
+	return false
+}
+
 // MsgClientNote is a client-generated notification for topic subscribers {note}.
 type MsgClientNote struct {
 	// There is no Id -- server will not akn {ping} packets, they are "fire and forget"
 	Topic string `json:"topic"`
-	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification
+	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification,
+	// "read_all" - all messages read, "call_end" - call teardown, "video_paused", "video_playing" - media playback state,
+	// "react" - reaction to a message
 	What string `json:"what"`
 	// Server-issued message ID being reported
 	SeqId int `json:"seq,omitempty"`
+	// IDs of several messages being reported as received at once
+	SeqIds []int `json:"seqs,omitempty"`
+	// Optional what-dependent value, such as the playback position in seconds
+	Value string `json:"value,omitempty"`
+	// Optional what-dependent payload
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// MaxSeqId returns the highest message ID reported in either SeqId or SeqIds.
+func (n *MsgClientNote) MaxSeqId() int {
+	max := n.SeqId
+	for _, seq := range n.SeqIds {
+		if seq > max {
+			max = seq
+		}
+	}
+	return max
+}
+
+// Values of {note what} in addition to "kp", "read", "recv".
+const (
+	// All messages in the topic are read. The server resolves it into "read" up to the latest message.
+	noteReadAll = "read_all"
+	// Teardown of a call.
+	noteCallEnd = "call_end"
+	// The callee accepted the call.
+	noteCallAccept = "call_accept"
+	// The callee declined the call, optionally with a reason in payload.
+	noteCallReject = "call_reject"
+	// Playback of the media message is paused, optionally at the position in Value.
+	noteVideoPaused = "video_paused"
+	// Playback of the media message is started or resumed, optionally at the position in Value.
+	noteVideoPlaying = "video_playing"
+	// Reaction to the message, such as an emoji in Value.
+	noteReact = "react"
+	// Update of the live location shared in the message, the coordinates are in Payload.
+	noteLocation = "loc"
+)
+
+// isCallNote checks if the {note} is a part of call signaling.
+func isCallNote(what string) bool {
+	return what == noteCallEnd || what == noteCallAccept || what == noteCallReject
+}
+
+// validNoteWhat checks if the {note} is of a known kind and carries valid parameters for that kind.
+func validNoteWhat(note *MsgClientNote) bool {
+	if len(note.SeqIds) > 0 {
+		// Multiple IDs can be reported as received only.
+		if note.What != "recv" || note.SeqId < 0 {
+			return false
+		}
+		for _, seq := range note.SeqIds {
+			if seq <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch note.What {
+	case "kp":
+		return note.SeqId == 0
+	case "read", "recv":
+		return note.SeqId > 0
+	case noteReadAll:
+		return note.SeqId == 0
+	case noteCallEnd, noteCallAccept:
+		return note.Payload == nil
+	case noteCallReject:
+		return true
+	case noteReact:
+		return note.SeqId > 0 && note.Value != ""
+	case noteLocation:
+		if note.SeqId <= 0 {
+			return false
+		}
+		_, ok := DecodeLocationContent(note.Payload)
+		return ok
+	case noteVideoPaused, noteVideoPlaying:
+		if note.SeqId <= 0 {
+			return false
+		}
+		if note.Value == "" {
+			return true
+		}
+		pos, err := strconv.ParseFloat(note.Value, 64)
+		return err == nil && pos >= 0 && !math.IsInf(pos, 0)
+	}
+	return false
 }
 
 // ClientComMessage is a wrapper for client messages.
@@ -307,6 +1136,18 @@ type MsgTopicDesc struct {
 	Public interface{} `json:"public,omitempty"`
 	// Per-subscription private data
 	Private interface{} `json:"private,omitempty"`
+	// Client-defined version of the schema of private data, stored and reported as is
+	PrivateVer int `json:"privatever,omitempty"`
+	// Number of subscribers currently online, group topics only
+	OnlineCount int `json:"onlinecount,omitempty"`
+	// IDs of pinned messages, group topics only
+	Pinned []int `json:"pinned,omitempty"`
+	// User's latest unsent draft
+	Draft *MsgServerData `json:"draft,omitempty"`
+	// Opaque validity tag of the description; it changes when any of the reported values changes
+	Etag string `json:"etag,omitempty"`
+	// Peer's last appearance online, P2P topics only, if requested
+	LastSeen *MsgLastSeenInfo `json:"seen,omitempty"`
 }
 
 // MsgTopicSub is topic subscription details, sent in Meta message.
@@ -332,6 +1173,8 @@ type MsgTopicSub struct {
 	Public interface{} `json:"public,omitempty"`
 	// User's own private data per topic
 	Private interface{} `json:"private,omitempty"`
+	// User has muted push notifications from the topic, reported to the user only
+	Muted bool `json:"muted,omitempty"`
 
 	// Response to non-'me' topic
 
@@ -347,6 +1190,8 @@ type MsgTopicSub struct {
 	SeqId int `json:"seq,omitempty"`
 	// Id of the latest Delete operation
 	DelId int `json:"clear,omitempty"`
+	// Timestamp of the latest change to the subscription or to the topic it describes
+	TouchedAt *time.Time `json:"touched,omitempty"`
 
 	// P2P topics only:
 
@@ -354,6 +1199,72 @@ type MsgTopicSub struct {
 	LastSeen *MsgLastSeenInfo `json:"seen,omitempty"`
 }
 
+// ContactKind reports the kind of the contact described by the 'me' subscription: "self" for the 'me'
+// topic, "p2p" for a conversation with another user, "grp" for a group topic. It returns an empty
+// string if the topic name is not recognized.
+func (s MsgTopicSub) ContactKind() string {
+	switch {
+	case s.Topic == "me":
+		return "self"
+	case strings.HasPrefix(s.Topic, "usr") || strings.HasPrefix(s.Topic, "p2p"):
+		return "p2p"
+	case strings.HasPrefix(s.Topic, "grp"):
+		return "grp"
+	}
+	return ""
+}
+
+// PrivateComment returns the user's comment on the subscription, such as a local nickname of the peer
+// in a P2P topic. By convention the comment is either the Private itself if it's a string or the
+// "comment" string of the Private object. The ok is false if there is no comment.
+func (s MsgTopicSub) PrivateComment() (string, bool) {
+	switch private := s.Private.(type) {
+	case string:
+		return private, private != ""
+	case map[string]interface{}:
+		comment, ok := private["comment"].(string)
+		return comment, ok && comment != ""
+	}
+	return "", false
+}
+
+// DiffSubs compares two lists of subscribers keyed by User. It returns subscribers present in new only,
+// subscribers present in old only, and subscribers present in both lists but with different access
+// mode or timestamps. Added and changed subscribers are taken from new in the order of new, removed
+// subscribers are listed in the order of old.
+func DiffSubs(old, new []MsgTopicSub) (added, removed, changed []MsgTopicSub) {
+	prev := make(map[string]*MsgTopicSub, len(old))
+	for i := range old {
+		prev[old[i].User] = &old[i]
+	}
+
+	seen := make(map[string]bool, len(new))
+	for _, sub := range new {
+		seen[sub.User] = true
+		if was, ok := prev[sub.User]; !ok {
+			added = append(added, sub)
+		} else if was.Acs != sub.Acs || !sameTime(was.UpdatedAt, sub.UpdatedAt) ||
+			!sameTime(was.DeletedAt, sub.DeletedAt) {
+			changed = append(changed, sub)
+		}
+	}
+
+	for _, sub := range old {
+		if !seen[sub.User] {
+			removed = append(removed, sub)
+		}
+	}
+	return
+}
+
+// sameTime checks if two optional timestamps are both missing or denote the same instant.
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
 // MsgDelValues describes request to delete messages.
 type MsgDelValues struct {
 	DelId  int           `json:"clear,omitempty"`
@@ -371,6 +1282,52 @@ type MsgServerCtrl struct {
 	Timestamp time.Time `json:"ts"`
 }
 
+// ctrlCodeText maps {ctrl} codes used by the server to canonical reason phrases.
+var ctrlCodeText = map[int]string{
+	http.StatusOK:                      "ok",
+	http.StatusCreated:                 "created",
+	http.StatusAccepted:                "accepted",
+	http.StatusResetContent:            "reset content",
+	http.StatusMultipleChoices:         "challenge",
+	http.StatusNotModified:             "not modified",
+	http.StatusBadRequest:              "bad request",
+	http.StatusUnauthorized:            "unauthorized",
+	http.StatusForbidden:               "forbidden",
+	http.StatusNotFound:                "not found",
+	http.StatusMethodNotAllowed:        "method not allowed",
+	http.StatusRequestTimeout:          "request timeout",
+	http.StatusConflict:                "conflict",
+	http.StatusGone:                    "gone",
+	http.StatusPreconditionFailed:      "precondition failed",
+	http.StatusUnsupportedMediaType:    "unsupported media type",
+	http.StatusUnprocessableEntity:     "unprocessable entity",
+	http.StatusLocked:                  "locked",
+	http.StatusUpgradeRequired:         "upgrade required",
+	http.StatusInternalServerError:     "internal error",
+	http.StatusNotImplemented:          "not implemented",
+	http.StatusBadGateway:              "bad gateway",
+	http.StatusHTTPVersionNotSupported: "version not supported",
+}
+
+// CodeText returns a canonical reason phrase for the numeric code or an empty string if the code
+// is unknown.
+func (c *MsgServerCtrl) CodeText() string {
+	return ctrlCodeText[c.Code]
+}
+
+// ParamsInto converts Params into a typed value v by re-encoding them as JSON. It returns an error
+// if the params cannot be represented as v. Missing params leave v unchanged.
+func (c *MsgServerCtrl) ParamsInto(v interface{}) error {
+	if c.Params == nil {
+		return nil
+	}
+	data, err := json.Marshal(c.Params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
 // MsgServerData is a server {data} message.
 type MsgServerData struct {
 	Topic string `json:"topic"`
@@ -381,13 +1338,279 @@ type MsgServerData struct {
 	SeqId     int               `json:"seq"`
 	Head      map[string]string `json:"head,omitempty"`
 	Content   interface{}       `json:"content"`
+	// The message should not trigger push notifications
+	Silent bool `json:"silent,omitempty"`
+	// The message has been edited after it was originally published
+	Modified bool `json:"modified,omitempty"`
+	// Timestamp of the latest edit
+	UpdatedAt *time.Time `json:"updated,omitempty"`
+	// The message is deleted for the recipient once the recipient reports it as read
+	ExpireOnRead bool `json:"eor,omitempty"`
+	// Public data of the sender, optionally provided in group topics to save a lookup
+	FromPublic interface{} `json:"frompub,omitempty"`
+	// The message is user's unsent draft, not a published message; it has no seq ID
+	Draft bool `json:"draft,omitempty"`
 }
 
+// SetFromPublic attaches the sender's public data to the message. It's a no-op in P2P topics
+// where the sender's public is already known to the recipient as the topic's public.
+func (d *MsgServerData) SetFromPublic(cat types.TopicCat, public interface{}) {
+	if cat == types.TopicCatP2P {
+		return
+	}
+	d.FromPublic = public
+}
+
+// ShouldNotify checks if the push layer should be notified of the message.
+func (d *MsgServerData) ShouldNotify() bool {
+	return !d.Silent
+}
+
+// Compress gzips byte-slice content if it's larger than contentCompressThreshold and marks it
+// with the "content-encoding" header. Content of other types is left unchanged.
+func (d *MsgServerData) Compress() error {
+	raw, ok := d.Content.([]byte)
+	if !ok || len(raw) <= contentCompressThreshold || d.Head[headerContentEncoding] != "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if d.Head == nil {
+		d.Head = make(map[string]string)
+	}
+	d.Head[headerContentEncoding] = contentEncodingGzip
+	d.Content = buf.Bytes()
+	return nil
+}
+
+// Decompress reverses Compress. Content decoded from JSON is a base64-encoded string, it's accepted too.
+func (d *MsgServerData) Decompress() error {
+	if d.Head[headerContentEncoding] != contentEncodingGzip {
+		return nil
+	}
+
+	var raw []byte
+	switch content := d.Content.(type) {
+	case []byte:
+		raw = content
+	case string:
+		var err error
+		if raw, err = base64.StdEncoding.DecodeString(content); err != nil {
+			return err
+		}
+	default:
+		return errors.New("compressed content must be a byte slice")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	out, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	delete(d.Head, headerContentEncoding)
+	if len(d.Head) == 0 {
+		d.Head = nil
+	}
+	d.Content = out
+	return nil
+}
+
+// IsViewOnce checks if the message expires after being read.
+func (d *MsgServerData) IsViewOnce() bool {
+	return d.ExpireOnRead || d.Head[headerExpireOnRead] != ""
+}
+
+// Header which describes encoding of {data} content, and its values.
+const (
+	headerContentEncoding = "content-encoding"
+	contentEncodingGzip   = "gzip"
+)
+
+// Headers with the seq ID of the message being replied to and of the message being replaced by an edit.
+const (
+	headerReply   = "reply"
+	headerReplace = "replace"
+)
+
+// Header which marks a view-once message. It's set by the server and stored with the message so
+// the message can be expired after the topic is reloaded. A value sent by the client is dropped.
+const headerExpireOnRead = "eor"
+
+// parseHeadSeq parses a reference to a message in the topic given either as "123" or as ":123".
+func parseHeadSeq(val string) (int, bool) {
+	seq, err := strconv.Atoi(strings.TrimPrefix(val, ":"))
+	if err != nil || seq <= 0 {
+		return 0, false
+	}
+	return seq, true
+}
+
+// ReplyToSeq returns the seq ID of the message this message is a reply to. The ok is false if the
+// message is not a reply or the reference is invalid.
+func (d *MsgServerData) ReplyToSeq() (int, bool) {
+	return parseHeadSeq(d.Head[headerReply])
+}
+
+// SortKey returns a key for ordering messages such that edits are placed right after the originals:
+// the original message has the key (seq, 0), the edit of it has the key (original seq, seq of the edit).
+// Compare the first values, then the second ones.
+func (d *MsgServerData) SortKey() (int, int) {
+	if orig, ok := parseHeadSeq(d.Head[headerReplace]); ok && orig < d.SeqId {
+		return orig, d.SeqId
+	}
+	return d.SeqId, 0
+}
+
+// markIfEdited marks the message as edited if it replaces an earlier message or if it was updated after
+// being published. The updated is the time of the latest change of the stored message.
+func (d *MsgServerData) markIfEdited(updated time.Time) {
+	if orig, ok := parseHeadSeq(d.Head[headerReplace]); (ok && orig < d.SeqId) || updated.After(d.Timestamp) {
+		d.Modified = true
+		d.UpdatedAt = &updated
+	}
+}
+
+// editTime returns the time of the latest edit of the message or the time of publishing if it was not edited.
+func (d *MsgServerData) editTime() time.Time {
+	if d.UpdatedAt != nil {
+		return *d.UpdatedAt
+	}
+	return d.Timestamp
+}
+
+// resolveEdit picks the winner of two racing edits of the same message: the one edited later wins,
+// edits made at the same time are ordered by From (greater wins). The choice does not depend on the
+// order of arguments, so all replicas arrive at the same result. Either argument may be nil.
+func resolveEdit(existing, incoming *MsgServerData) *MsgServerData {
+	if existing == nil {
+		return incoming
+	}
+	if incoming == nil {
+		return existing
+	}
+
+	et, it := existing.editTime(), incoming.editTime()
+	if it.After(et) || (it.Equal(et) && incoming.From > existing.From) {
+		return incoming
+	}
+	return existing
+}
+
+// Headers with a reference to the thumbnail of an attachment and its dimensions in pixels.
+const (
+	headerThumb       = "thumb"
+	headerThumbWidth  = "thumbw"
+	headerThumbHeight = "thumbh"
+)
+
+// Thumbnail returns the reference to the attachment's thumbnail and its dimensions. The dimensions
+// are zero if missing or invalid. The ok is false if the message has no thumbnail reference.
+func (d *MsgServerData) Thumbnail() (ref string, w, h int, ok bool) {
+	ref = d.Head[headerThumb]
+	if ref == "" {
+		return "", 0, 0, false
+	}
+	if w, _ = strconv.Atoi(d.Head[headerThumbWidth]); w < 0 {
+		w = 0
+	}
+	if h, _ = strconv.Atoi(d.Head[headerThumbHeight]); h < 0 {
+		h = 0
+	}
+	return ref, w, h, true
+}
+
+// Header which marks messages originated by the server.
+const headerSystem = "system"
+
+// NewSystemData creates a {data} message originated by the server rather than by a user, such as
+// a notification of a user joining the topic.
+func NewSystemData(topic string, seq int, content interface{}, ts time.Time) *MsgServerData {
+	return &MsgServerData{
+		Topic:     topic,
+		From:      "",
+		Timestamp: ts,
+		SeqId:     seq,
+		Head:      map[string]string{headerSystem: "true"},
+		Content:   content,
+	}
+}
+
+// sysTopic is the reserved topic of out-of-band server notices such as maintenance announcements.
+// Clients cannot subscribe to it: the notices are delivered to all sessions.
+const sysTopic = "sys"
+
+// NewBroadcastNotice creates a server notice for all sessions regardless of their subscriptions.
+// The notice is not stored and has no seq ID.
+func NewBroadcastNotice(content interface{}, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Data: NewSystemData(sysTopic, 0, content, ts), rcptto: sysTopic, timestamp: ts}
+}
+
+// IsSystem checks if the message was originated by the server. The "system" head alone is not
+// sufficient: messages published by users always have a sender.
+func (d *MsgServerData) IsSystem() bool {
+	return d.From == ""
+}
+
+// IsFrom checks if the message was published by the given user. System messages are from nobody.
+func (d *MsgServerData) IsFrom(uid string) bool {
+	return !d.IsSystem() && d.From == uid
+}
+
+// MsgServerDataBatch is a collection of {data} messages from the same topic sent as one packet.
+// It's used for stored messages if the client asked for it in {hi}.
+type MsgServerDataBatch struct {
+	Topic    string          `json:"topic"`
+	Messages []MsgServerData `json:"messages"`
+}
+
+// PresWhat is the kind of the presence notification, the 'what' of the {pres}.
+type PresWhat string
+
+// Kinds of presence notifications.
+const (
+	// Contact or topic came online
+	PresOn PresWhat = "on"
+	// Contact or topic went offline
+	PresOff PresWhat = "off"
+	// User agent of the contact has changed
+	PresUA PresWhat = "ua"
+	// Description of the topic or of the contact has changed
+	PresUpd PresWhat = "upd"
+	// Access mode has changed
+	PresAcs PresWhat = "acs"
+	// Topic deleted or the user lost access to it
+	PresGone PresWhat = "gone"
+	// Topic terminated the subscription
+	PresTerm PresWhat = "term"
+	// New message in the topic
+	PresMsg PresWhat = "msg"
+	// Messages were read
+	PresRead PresWhat = "read"
+	// Messages were received
+	PresRecv PresWhat = "recv"
+	// Messages were deleted
+	PresDel PresWhat = "del"
+)
+
 // MsgServerPres is presence notification {pres} (authoritative update).
 type MsgServerPres struct {
 	Topic     string         `json:"topic"`
 	Src       string         `json:"src"`
-	What      string         `json:"what"`
+	What      PresWhat       `json:"what"`
 	UserAgent string         `json:"ua,omitempty"`
 	SeqId     int            `json:"seq,omitempty"`
 	DelId     int            `json:"clear,omitempty"`
@@ -395,6 +1618,10 @@ type MsgServerPres struct {
 	AcsTarget string         `json:"tgt,omitempty"`
 	AcsActor  string         `json:"act,omitempty"`
 	Acs       *MsgAccessMode `json:"acs,omitempty"`
+	// Public data of the AcsActor, if the server could obtain it cheaply
+	ActorPublic interface{} `json:"actpub,omitempty"`
+	// Fields of the description changed by the "upd", such as "public" or "defacs"
+	Changed []string `json:"changed,omitempty"`
 
 	// UNroutable params
 
@@ -409,6 +1636,31 @@ type MsgServerPres struct {
 
 	// Send to sessions of a single user only
 	singleUser string
+
+	// When the notification was generated, set by its constructor; used to debounce "on"/"off" storms
+	ts time.Time
+}
+
+// SendToUser restricts delivery of the notification to sessions of the given user only.
+// An empty uid removes the restriction.
+func (p *MsgServerPres) SendToUser(uid string) {
+	p.singleUser = uid
+}
+
+// SingleUser returns the ID of the user the notification is restricted to, if any.
+func (p *MsgServerPres) SingleUser() string {
+	return p.singleUser
+}
+
+// SkipTopic prevents delivery of the notification to sessions attached to the given topic:
+// such sessions have been notified by the topic already. An empty topic removes the restriction.
+func (p *MsgServerPres) SkipTopic(topic string) {
+	p.skipTopic = topic
+}
+
+// SkippedTopic returns the name of the topic whose sessions should not receive the notification.
+func (p *MsgServerPres) SkippedTopic() string {
+	return p.skipTopic
 }
 
 // MsgServerMeta is a topic metadata {meta} update.
@@ -424,6 +1676,88 @@ type MsgServerMeta struct {
 	Sub []MsgTopicSub `json:"sub,omitempty"`
 	// Delete ID and the ranges of IDs of deleted messages
 	Del *MsgDelValues `json:"del,omitempty"`
+	// User's or topic's tags
+	Tags []string `json:"tags,omitempty"`
+	// User's credentials
+	Cred []*MsgCredServer `json:"cred,omitempty"`
+	// Validity tag of the topic description, same as Desc.Etag
+	Etag string `json:"etag,omitempty"`
+	// Position of the next window of subscriptions or deleted ranges when the list is too long for
+	// one {meta}: the client passes it in the next {get} to fetch the window; empty in the last window
+	Cursor string `json:"cursor,omitempty"`
+	// Aggregated reactions to messages
+	Reactions []MsgReactionSummary `json:"reactions,omitempty"`
+}
+
+// MsgReactionSummary is the number of reactions of each kind to a single message.
+type MsgReactionSummary struct {
+	SeqId int `json:"seq"`
+	// Reaction -> number of users who reacted so
+	Counts map[string]int `json:"counts"`
+}
+
+// aggregateReactions counts "react" notes by message ID and reaction. Repeated reactions of
+// the same kind by the same user are counted once; notes other than "react" are ignored.
+// The result is sorted by message ID.
+func aggregateReactions(notes []MsgServerInfo) []MsgReactionSummary {
+	type reaction struct {
+		seq   int
+		from  string
+		value string
+	}
+	seen := make(map[reaction]bool)
+	bySeq := make(map[int]map[string]int)
+	for i := range notes {
+		n := &notes[i]
+		if n.What != noteReact || n.SeqId <= 0 || n.Value == "" {
+			continue
+		}
+		key := reaction{n.SeqId, n.From, n.Value}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if bySeq[n.SeqId] == nil {
+			bySeq[n.SeqId] = make(map[string]int)
+		}
+		bySeq[n.SeqId][n.Value]++
+	}
+
+	if len(bySeq) == 0 {
+		return nil
+	}
+	summary := make([]MsgReactionSummary, 0, len(bySeq))
+	for seq, counts := range bySeq {
+		summary = append(summary, MsgReactionSummary{SeqId: seq, Counts: counts})
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].SeqId < summary[j].SeqId })
+	return summary
+}
+
+// IsEmpty checks if the {meta} message carries no payload.
+func (m *MsgServerMeta) IsEmpty() bool {
+	return m.Desc == nil && len(m.Sub) == 0 && m.Del == nil && len(m.Tags) == 0 && len(m.Cred) == 0 &&
+		len(m.Reactions) == 0
+}
+
+// HasMoreSubs checks if more subscriptions can be fetched using the Cursor.
+func (m *MsgServerMeta) HasMoreSubs() bool {
+	return m.Del == nil && m.Cursor != ""
+}
+
+// HasMoreDel checks if more delete transactions can be fetched using the Cursor.
+func (m *MsgServerMeta) HasMoreDel() bool {
+	return m.Del != nil && m.Cursor != ""
+}
+
+// MsgCredServer is an account credential such as email or phone number as reported to the client.
+type MsgCredServer struct {
+	// Credential type, i.e. `email` or `tel`.
+	Method string `json:"meth,omitempty"`
+	// Credential value, i.e. `jdoe@example.com` or `+17025550001`
+	Value string `json:"val,omitempty"`
+	// Indicator that the credential is validated
+	Done bool `json:"done,omitempty"`
 }
 
 // MsgServerInfo is the server-side copy of MsgClientNote with From added (non-authoritative).
@@ -431,10 +1765,40 @@ type MsgServerInfo struct {
 	Topic string `json:"topic"`
 	// ID of the user who originated the message
 	From string `json:"from"`
-	// what is being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification
+	// what is being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification,
+	// "call_end" - call teardown, "loc" - live location update
 	What string `json:"what"`
 	// Server-issued message ID being reported
 	SeqId int `json:"seq,omitempty"`
+	// Value copied from the {note}
+	Value string `json:"value,omitempty"`
+	// Payload copied from the {note}
+	Payload interface{} `json:"payload,omitempty"`
+
+	// Deliver to sessions which are actively viewing the topic only.
+	activeOnly bool
+}
+
+// NewLocationUpdate creates an update of the live location shared by the user 'from' in the message seq.
+func NewLocationUpdate(topic, from string, seq int, lat, lon float64) *MsgServerInfo {
+	return &MsgServerInfo{
+		Topic:   topic,
+		From:    from,
+		What:    noteLocation,
+		SeqId:   seq,
+		Payload: &MsgLocationContent{Lat: lat, Lon: lon},
+	}
+}
+
+// LimitToActive restricts delivery of the notification to sessions which are actively viewing
+// the topic, i.e. sessions with recent client activity. Used to reduce "kp" noise in large groups.
+func (i *MsgServerInfo) LimitToActive() {
+	i.activeOnly = true
+}
+
+// ActiveOnly reports if the notification should be delivered to active sessions only.
+func (i *MsgServerInfo) ActiveOnly() bool {
+	return i.activeOnly
 }
 
 // ServerComMessage is a wrapper for server-side messages.
@@ -444,6 +1808,8 @@ type ServerComMessage struct {
 	Meta *MsgServerMeta `json:"meta,omitempty"`
 	Pres *MsgServerPres `json:"pres,omitempty"`
 	Info *MsgServerInfo `json:"info,omitempty"`
+	// Batch of {data} messages for clients which opted in to batched history replay. JSON only.
+	DataBatch *MsgServerDataBatch `json:"databatch,omitempty"`
 
 	// to: topic
 	rcptto string
@@ -455,9 +1821,79 @@ type ServerComMessage struct {
 	timestamp time.Time
 	// Should the packet be sent to the original sessions? SessionIDs to skip.
 	skipSid string
+	// The {pub} the {data} message was created from. Could be nil.
+	pub *MsgClientPub
 }
 
-// Generators of server-side error messages {ctrl}.
+// sessionScopedTopic is a placeholder topic name for {ctrl} messages which concern the session
+// rather than any topic. Such messages are sent without a topic.
+const sessionScopedTopic = "*"
+
+// ClearTopicIfEmpty drops the topic of a session-scoped {ctrl} message, i.e. if the topic is equal
+// to sessionScopedTopic. An empty topic is omitted from the output anyway. Topic-scoped messages
+// are not changed.
+func (m *ServerComMessage) ClearTopicIfEmpty() {
+	if m.Ctrl != nil && m.Ctrl.Topic == sessionScopedTopic {
+		m.Ctrl.Topic = ""
+	}
+}
+
+// Validate checks that the message has exactly one payload and the payload has the required fields.
+// It's meant for catching routing bugs before the message is sent.
+func (m *ServerComMessage) Validate() error {
+	count := 0
+	var err error
+	if m.Ctrl != nil {
+		count++
+		if m.Ctrl.Code == 0 {
+			err = errors.New("ctrl: missing code")
+		}
+	}
+	if m.Data != nil {
+		count++
+		if m.Data.Topic == "" {
+			err = errors.New("data: missing topic")
+		}
+	}
+	if m.Meta != nil {
+		count++
+		if m.Meta.Topic == "" {
+			err = errors.New("meta: missing topic")
+		}
+	}
+	if m.Pres != nil {
+		count++
+		if m.Pres.Topic == "" {
+			err = errors.New("pres: missing topic")
+		} else if m.Pres.What == "" {
+			err = errors.New("pres: missing what")
+		}
+	}
+	if m.Info != nil {
+		count++
+		if m.Info.Topic == "" {
+			err = errors.New("info: missing topic")
+		}
+	}
+	if m.DataBatch != nil {
+		count++
+		if m.DataBatch.Topic == "" {
+			err = errors.New("databatch: missing topic")
+		}
+	}
+
+	if count == 0 {
+		return errors.New("empty message")
+	}
+	if count > 1 {
+		return errors.New("more than one payload in message")
+	}
+	return err
+}
+
+// Generators of server-side error messages {ctrl}. Session-scoped messages, such as ErrCommandOutOfSequence,
+// carry no topic: callers pass either an empty topic or, when the request has a topic which is irrelevant
+// to the error (e.g. ErrAuthRequired for an unauthenticated session), sessionScopedTopic.
 
 // NoErr indicates successful completion.
 func NoErr(id, topic string, ts time.Time) *ServerComMessage {
@@ -469,6 +1905,14 @@ func NoErr(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// NoErrWithWarning indicates successful completion with a caveat, such as a partial delivery or
+// a truncated result. The warning is reported in params.
+func NoErrWithWarning(id, topic, warning string, ts time.Time) *ServerComMessage {
+	msg := NoErr(id, topic, ts)
+	msg.Ctrl.Params = map[string]string{"warning": warning}
+	return msg
+}
+
 // NoErrCreated indicated successful creation of an object.
 func NoErrCreated(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -489,6 +1933,61 @@ func NoErrAccepted(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// MsgServerHiParams is the payload of the {ctrl} sent in response to a {hi}. It lets the client
+// learn server limits at handshake.
+type MsgServerHiParams struct {
+	// Server API version
+	Ver string `json:"ver"`
+	// Server build stamp
+	Build string `json:"build,omitempty"`
+	// Maximum size of a client message in bytes
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"`
+	// Maximum number of subscribers in a group topic
+	MaxSubscriberCount int `json:"maxSubscriberCount,omitempty"`
+	// Maximum number of entries in a batch sent by the client
+	MaxBatchSize int `json:"maxBatchSize,omitempty"`
+	// ID of the user of the resumed session
+	User string `json:"user,omitempty"`
+	// Authentication level of the resumed session
+	AuthLevel string `json:"authlvl,omitempty"`
+	// Stored messages will be sent as {databatch}
+	DataBatch bool `json:"databatch,omitempty"`
+}
+
+// NoErrHi responds to a {hi} message. The code is either 200 or 201, params may be nil.
+func NoErrHi(id string, code int, params *MsgServerHiParams, ts time.Time) *ServerComMessage {
+	ctrl := &MsgServerCtrl{Id: id, Code: code, Text: ctrlCodeText[code], Timestamp: ts}
+	// Avoid null params on the wire
+	if params != nil {
+		ctrl.Params = params
+	}
+	return &ServerComMessage{Ctrl: ctrl}
+}
+
+// MsgPubAck is the payload of the {ctrl} acknowledging a {pub}.
+type MsgPubAck struct {
+	// Server-issued ID of the published message
+	SeqId int `json:"seq"`
+	// Optional client-side ID of the message
+	ClientMsgId string `json:"cmid,omitempty"`
+}
+
+// NoErrAcceptedPub indicates that the {pub} was accepted and reports the ID assigned to the message.
+func NoErrAcceptedPub(id, topic string, ack MsgPubAck, ts time.Time) *ServerComMessage {
+	msg := NoErrAccepted(id, topic, ts)
+	msg.Ctrl.Params = ack
+	return msg
+}
+
+// NoErrDeleted indicates that messages were deleted. The params report the number of deleted
+// messages and the ID of the delete transaction as "clear". The ID is also reported as "del" for
+// compatibility with older clients.
+func NoErrDeleted(id, topic string, count, delID int, ts time.Time) *ServerComMessage {
+	msg := NoErr(id, topic, ts)
+	msg.Ctrl.Params = map[string]int{"count": count, "clear": delID, "del": delID}
+	return msg
+}
+
 // NoErrEvicted indicates that the user was disconnected from topic for no fault of the user.
 func NoErrEvicted(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -509,6 +2008,17 @@ func NoErrShutdown(ts time.Time) *ServerComMessage {
 
 // 3xx
 
+// InfoChallenge the authentication requires another round trip: the client must respond to the
+// challenge with a follow-up {login}.
+func InfoChallenge(id string, challenge interface{}, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusMultipleChoices, // 300
+		Text:      "challenge",
+		Params:    map[string]interface{}{"challenge": challenge},
+		Timestamp: ts}}
+}
+
 // InfoAlreadySubscribed request to subscribe was ignored because user is already subscribed.
 func InfoAlreadySubscribed(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -549,6 +2059,18 @@ func InfoNotModified(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// InfoThrottled {note} messages from the session are coming too fast and some were dropped.
+// Notes have no ID, so the response has none either. The sub-code "throttled" is reported as
+// the reason in params.
+func InfoThrottled(topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusNotModified, // 304
+		Text:      "throttled",
+		Topic:     topic,
+		Params:    map[string]string{"reason": "throttled"},
+		Timestamp: ts}}
+}
+
 // 4xx Errors
 
 // ErrMalformed request malformed.
@@ -601,6 +2123,14 @@ func ErrPermissionDenied(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrPermissionDeniedReason same as ErrPermissionDenied but with the reason in Params, i.e. "not_owner",
+// "insufficient_acs", "banned".
+func ErrPermissionDeniedReason(id, topic, reason string, ts time.Time) *ServerComMessage {
+	msg := ErrPermissionDenied(id, topic, ts)
+	msg.Ctrl.Params = map[string]string{"reason": reason}
+	return msg
+}
+
 // ErrTopicNotFound topic is not found.
 func ErrTopicNotFound(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -631,6 +2161,16 @@ func ErrOperationNotAllowed(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrRequestTimeout the operation took too long to complete.
+func ErrRequestTimeout(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusRequestTimeout, // 408
+		Text:      "request timed out",
+		Topic:     topic,
+		Timestamp: ts}}
+}
+
 // ErrAlreadyAuthenticated invalid attempt to authenticate an already authenticated session
 // Switching users is not supported.
 func ErrAlreadyAuthenticated(id, topic string, ts time.Time) *ServerComMessage {
@@ -681,6 +2221,18 @@ func ErrCommandOutOfSequence(id, unused string, ts time.Time) *ServerComMessage
 		Timestamp: ts}}
 }
 
+// ErrTopicArchived topic is archived: it can be read but not modified. The sub-code "archived" is
+// reported as the reason in params.
+func ErrTopicArchived(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusConflict, // 409
+		Text:      "topic archived",
+		Topic:     topic,
+		Params:    map[string]string{"reason": "archived"},
+		Timestamp: ts}}
+}
+
 // ErrGone topic deleted or user banned.
 func ErrGone(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -691,6 +2243,26 @@ func ErrGone(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrPreconditionFailed the object has changed since the client has last seen it.
+func ErrPreconditionFailed(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusPreconditionFailed, // 412
+		Text:      "precondition failed",
+		Topic:     topic,
+		Timestamp: ts}}
+}
+
+// ErrUnsupportedMediaType the content type of the message is not accepted.
+func ErrUnsupportedMediaType(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusUnsupportedMediaType, // 415
+		Text:      "unsupported media type",
+		Topic:     topic,
+		Timestamp: ts}}
+}
+
 // ErrPolicy request violates a policy (e.g. password is too weak or too many subscribers).
 func ErrPolicy(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -711,6 +2283,17 @@ func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// ErrUpgradeRequired protocol version is deprecated, the client must upgrade to at least minVer.
+func ErrUpgradeRequired(id, topic, minVer string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusUpgradeRequired, // 426
+		Text:      "upgrade required",
+		Topic:     topic,
+		Params:    map[string]string{"minver": minVer},
+		Timestamp: ts}}
+}
+
 // ErrUnknown database error
 func ErrUnknown(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
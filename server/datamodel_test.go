@@ -0,0 +1,1962 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestSetQueryTags(t *testing.T) {
+	var msg ClientComMessage
+	if err := json.Unmarshal([]byte(`{"set":{"id":"1","topic":"me","tags":["email:alice@example.com","tel:17025550001"]}}`),
+		&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Set == nil {
+		t.Fatal("set not parsed")
+	}
+	if len(msg.Set.Tags) != 2 || msg.Set.Tags[0] != "email:alice@example.com" || msg.Set.Tags[1] != "tel:17025550001" {
+		t.Errorf("unexpected tags %v", msg.Set.Tags)
+	}
+
+	// Tags must be omitted when not set.
+	out, _ := json.Marshal(&MsgSetQuery{})
+	if string(out) != `{}` {
+		t.Errorf("expecting empty set query, got '%s'", out)
+	}
+}
+
+func TestPresActorPublic(t *testing.T) {
+	pres := &MsgServerPres{Topic: "me", Src: "usrAlice", What: "acs", AcsActor: "usrAlice", AcsTarget: "usrBob"}
+
+	out, _ := json.Marshal(pres)
+	expected := `{"topic":"me","src":"usrAlice","what":"acs","tgt":"usrBob","act":"usrAlice"}`
+	if string(out) != expected {
+		t.Errorf("Expecting '%s', got '%s'", expected, out)
+	}
+
+	pres.ActorPublic = map[string]string{"fn": "Alice"}
+	out, _ = json.Marshal(pres)
+	expected = `{"topic":"me","src":"usrAlice","what":"acs","tgt":"usrBob","act":"usrAlice","actpub":{"fn":"Alice"}}`
+	if string(out) != expected {
+		t.Errorf("Expecting '%s', got '%s'", expected, out)
+	}
+}
+
+func TestParseMsgClientMeta(t *testing.T) {
+	testQueries := map[string]int{
+		"":          0,
+		"desc":      constMsgMetaDesc,
+		"sub  data": constMsgMetaSub | constMsgMetaData,
+		"desc sub data del cred tags a b c": constMsgMetaDesc | constMsgMetaSub | constMsgMetaData |
+			constMsgMetaDel | constMsgMetaTags,
+		"a b c d e f g h tags": constMsgMetaTags,
+	}
+
+	for query, expected := range testQueries {
+		if bits := parseMsgClientMeta(query); bits != expected {
+			t.Errorf("Query '%s', expecting %x, got %x", query, expected, bits)
+		}
+	}
+}
+
+func TestGetQueryIsEmpty(t *testing.T) {
+	for _, what := range []string{"", "  ", "bogus", "cred a b"} {
+		if !(MsgGetQuery{What: what}).IsEmpty() {
+			t.Errorf("Query '%s' must be empty", what)
+		}
+	}
+	for _, what := range []string{"desc", "sub  data", "bogus del"} {
+		if (MsgGetQuery{What: what}).IsEmpty() {
+			t.Errorf("Query '%s' must not be empty", what)
+		}
+	}
+}
+
+func TestHiLocation(t *testing.T) {
+	testCases := []struct {
+		tz    int
+		valid bool
+		name  string
+	}{
+		{0, true, "UTC"},
+		{330, true, "UTC+05:30"},
+		{-420, true, "UTC-07:00"},
+		{-720, true, "UTC-12:00"},
+		{840, true, "UTC+14:00"},
+		{-721, false, ""},
+		{841, false, ""},
+	}
+
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range testCases {
+		hi := &MsgClientHi{Tz: tc.tz}
+		if valid := hi.ValidTz(); valid != tc.valid {
+			t.Errorf("%d: expecting valid %v, got %v", tc.tz, tc.valid, valid)
+		}
+		if !tc.valid {
+			continue
+		}
+		loc := hi.Location()
+		name, offset := ts.In(loc).Zone()
+		if name != tc.name || offset != tc.tz*60 {
+			t.Errorf("%d: expecting '%s' %d, got '%s' %d", tc.tz, tc.name, tc.tz*60, name, offset)
+		}
+	}
+
+	var hi MsgClientHi
+	if err := json.Unmarshal([]byte(`{"ver":"0.15","tz":-300}`), &hi); err != nil || hi.Tz != -300 {
+		t.Errorf("tz not parsed: %v, %+v", err, hi)
+	}
+}
+
+func TestPubSilent(t *testing.T) {
+	var msg ClientComMessage
+	if err := json.Unmarshal([]byte(`{"pub":{"topic":"grpAbc","silent":true,"content":"edit"}}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Pub.Silent {
+		t.Error("pub.silent not parsed")
+	}
+
+	data := &MsgServerData{Topic: "grpAbc", Content: "hello"}
+	if !data.ShouldNotify() {
+		t.Error("regular message must trigger notifications")
+	}
+	out, _ := json.Marshal(data)
+	if strings.Contains(string(out), "silent") {
+		t.Errorf("silent must be omitted, got '%s'", out)
+	}
+
+	data.Silent = msg.Pub.Silent
+	if data.ShouldNotify() {
+		t.Error("silent message must not trigger notifications")
+	}
+	out, _ = json.Marshal(data)
+	if !strings.Contains(string(out), `"silent":true`) {
+		t.Errorf("silent must be present, got '%s'", out)
+	}
+}
+
+func TestGetOptsSince(t *testing.T) {
+	var opts MsgGetOpts
+
+	// Seq only: not applicable to time-based queries.
+	if err := json.Unmarshal([]byte(`{"since":{"seq":15}}`), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Since == nil || opts.Since.SeqId != 15 {
+		t.Errorf("since.seq not parsed: %+v", opts.Since)
+	}
+	if ims := opts.ModifiedSince(); ims != nil {
+		t.Errorf("Expecting nil, got %v", ims)
+	}
+
+	// Time only.
+	opts = MsgGetOpts{}
+	if err := json.Unmarshal([]byte(`{"since":{"ts":"2018-01-02T03:04:05Z"}}`), &opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	if ims := opts.ModifiedSince(); ims == nil || !ims.Equal(expected) {
+		t.Errorf("Expecting %v, got %v", expected, ims)
+	}
+
+	// Both seq and time: time is used.
+	opts = MsgGetOpts{}
+	if err := json.Unmarshal([]byte(`{"since":{"seq":15,"ts":"2018-01-02T03:04:05Z"}}`), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if ims := opts.ModifiedSince(); ims == nil || !ims.Equal(expected) {
+		t.Errorf("Expecting %v, got %v", expected, ims)
+	}
+
+	// Explicit ims takes precedence over since.
+	explicit := expected.Add(time.Hour)
+	opts.IfModifiedSince = &explicit
+	if ims := opts.ModifiedSince(); ims == nil || !ims.Equal(explicit) {
+		t.Errorf("Expecting %v, got %v", explicit, ims)
+	}
+
+	var nilOpts *MsgGetOpts
+	if ims := nilOpts.ModifiedSince(); ims != nil {
+		t.Errorf("Expecting nil, got %v", ims)
+	}
+}
+
+func TestGetOptsIncludeSeen(t *testing.T) {
+	var query MsgGetQuery
+	if err := json.Unmarshal([]byte(`{"what":"desc","desc":{"seen":true}}`), &query); err != nil {
+		t.Fatal(err)
+	}
+	if query.Desc == nil || !query.Desc.IncludeSeen {
+		t.Errorf("desc.seen not parsed: %+v", query.Desc)
+	}
+
+	out, _ := json.Marshal(&MsgGetOpts{})
+	if string(out) != `{}` {
+		t.Errorf("seen must be omitted when not set, got '%s'", out)
+	}
+}
+
+func TestErrPermissionDeniedReason(t *testing.T) {
+	ts := time.Now().UTC()
+	msg := ErrPermissionDeniedReason("1a2b", "grpAbc", "not_owner", ts)
+	if msg.Ctrl.Code != 403 || msg.Ctrl.Id != "1a2b" || msg.Ctrl.Topic != "grpAbc" || msg.Ctrl.Text != "permission denied" {
+		t.Errorf("Unexpected ctrl %+v", msg.Ctrl)
+	}
+
+	out, _ := json.Marshal(msg)
+	if !strings.Contains(string(out), `"params":{"reason":"not_owner"}`) {
+		t.Errorf("Reason missing in '%s'", out)
+	}
+}
+
+func TestInfoChallenge(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := InfoChallenge("1a2b", map[string]string{"token": "xyz"}, ts)
+	if msg.Ctrl.Code != 300 || msg.Ctrl.Id != "1a2b" || msg.Ctrl.Topic != "" || msg.Ctrl.Text != "challenge" {
+		t.Errorf("Unexpected ctrl %+v", msg.Ctrl)
+	}
+
+	out, _ := json.Marshal(msg)
+	expected := `{"ctrl":{"id":"1a2b","params":{"challenge":{"token":"xyz"}},"code":300,"text":"challenge","ts":"2018-01-02T03:04:05Z"}}`
+	if string(out) != expected {
+		t.Errorf("Expecting '%s', got '%s'", expected, out)
+	}
+}
+
+func TestTopicDescOnlineCount(t *testing.T) {
+	desc := &MsgTopicDesc{SeqId: 10}
+	out, _ := json.Marshal(desc)
+	if strings.Contains(string(out), "onlinecount") {
+		t.Errorf("onlinecount must be omitted, got '%s'", out)
+	}
+
+	desc.OnlineCount = 3
+	out, _ = json.Marshal(desc)
+	if string(out) != `{"seq":10,"onlinecount":3}` {
+		t.Errorf("Unexpected desc '%s'", out)
+	}
+}
+
+func TestCtrlCodeText(t *testing.T) {
+	ts := time.Now().UTC()
+	testCodes := []struct {
+		msg      *ServerComMessage
+		expected string
+	}{
+		{NoErr("", "", ts), "ok"},
+		{InfoNotModified("", "", ts), "not modified"},
+		{ErrAuthFailed("", "", ts), "unauthorized"},
+		{ErrAlreadyExists("", "", ts), "conflict"},
+		{ErrUnknown("", "", ts), "internal error"},
+		{InfoChallenge("", nil, ts), "challenge"},
+	}
+
+	for _, tc := range testCodes {
+		if text := tc.msg.Ctrl.CodeText(); text != tc.expected {
+			t.Errorf("Code %d, expecting '%s', got '%s'", tc.msg.Ctrl.Code, tc.expected, text)
+		}
+	}
+
+	if text := (&MsgServerCtrl{Code: 999}).CodeText(); text != "" {
+		t.Errorf("Unknown code, expecting empty text, got '%s'", text)
+	}
+}
+
+func TestErrRequestTimeout(t *testing.T) {
+	ts := time.Now().UTC()
+	msg := ErrRequestTimeout("1", "fnd", ts)
+	if msg.Ctrl.Code != 408 {
+		t.Errorf("Expecting code 408, got %d", msg.Ctrl.Code)
+	}
+	if msg.Ctrl.Id != "1" || msg.Ctrl.Topic != "fnd" || msg.Ctrl.Text != "request timed out" {
+		t.Errorf("Unexpected ctrl %+v", msg.Ctrl)
+	}
+}
+
+func TestErrPreconditionFailed(t *testing.T) {
+	msg := ErrPreconditionFailed("1", "grp1XUtEhjv6HND", time.Now().UTC())
+	if msg.Ctrl.Code != 412 || msg.Ctrl.Text != "precondition failed" {
+		t.Errorf("Expecting 412 precondition failed, got %d %s", msg.Ctrl.Code, msg.Ctrl.Text)
+	}
+}
+
+func TestSetIfMatch(t *testing.T) {
+	var msg ClientComMessage
+	if err := json.Unmarshal([]byte(`{"set":{"topic":"grp1XUtEhjv6HND",
+		"ifmatch":"jc2q8m5k.f.1ekcd9x","desc":{"public":"x"}}}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Set.IfMatch != "jc2q8m5k.f.1ekcd9x" {
+		t.Errorf("Expecting ifmatch 'jc2q8m5k.f.1ekcd9x', got '%s'", msg.Set.IfMatch)
+	}
+
+	out, _ := json.Marshal(&MsgSetQuery{})
+	if strings.Contains(string(out), "ifmatch") {
+		t.Errorf("Empty ifmatch must be omitted, got '%s'", out)
+	}
+}
+
+func TestDelValidate(t *testing.T) {
+	before := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	testDels := []struct {
+		del      MsgClientDel
+		expected error
+	}{
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{LowId: 1}, {LowId: 5, HiId: 10}}}, nil},
+		{MsgClientDel{DelSeq: []MsgDelRange{{LowId: 3}}}, nil},
+		{MsgClientDel{What: "topic"}, nil},
+		{MsgClientDel{What: "sub", User: "usrAbc"}, nil},
+		{MsgClientDel{What: "bogus", DelSeq: []MsgDelRange{{LowId: 1}}}, errDelMalformed},
+		{MsgClientDel{What: "msg"}, errDelMalformed},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{}}}, errDelMalformed},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{LowId: -1}}}, errDelMalformed},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{HiId: 5}}}, errDelMalformed},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{LowId: 10, HiId: 5}}}, errDelMalformed},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{LowId: 1}, {LowId: 2}, {LowId: 3}, {LowId: 4}}},
+			errDelTooBig},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{LowId: 1, HiId: 101}}}, errDelTooBig},
+		{MsgClientDel{What: "msg", DelSeq: []MsgDelRange{{LowId: 1, HiId: 100}}}, nil},
+		{MsgClientDel{What: "msg", Before: &before}, nil},
+		{MsgClientDel{What: "msg", Before: &time.Time{}}, errDelMalformed},
+		{MsgClientDel{What: "msg", Before: &before, DelSeq: []MsgDelRange{{LowId: 1}}}, errDelMalformed},
+	}
+
+	for i, tc := range testDels {
+		if err := tc.del.Validate(3, 100); err != tc.expected {
+			t.Errorf("Test %d, expecting '%v', got '%v'", i, tc.expected, err)
+		}
+	}
+}
+
+func TestDataModified(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := &MsgServerData{Topic: "grpAbc", From: "usrAbc", Timestamp: ts, SeqId: 5, Content: "hello"}
+
+	out, _ := json.Marshal(data)
+	if strings.Contains(string(out), "modified") || strings.Contains(string(out), "updated") {
+		t.Errorf("Fresh message must not be marked as edited, got '%s'", out)
+	}
+
+	updated := ts.Add(time.Minute)
+	data.Modified = true
+	data.UpdatedAt = &updated
+	out, _ = json.Marshal(data)
+	if !strings.Contains(string(out), `"modified":true,"updated":"2018-01-02T03:05:05Z"`) {
+		t.Errorf("Edited message must be marked as such, got '%s'", out)
+	}
+}
+
+func TestMarkIfEdited(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	orig := &MsgServerData{SeqId: 5, Timestamp: ts}
+	orig.markIfEdited(ts)
+	if orig.Modified || orig.UpdatedAt != nil {
+		t.Error("Original message must not be marked as edited")
+	}
+
+	// Live edit: a new message replacing an earlier one.
+	edit := &MsgServerData{SeqId: 7, Timestamp: ts, Head: map[string]string{"replace": ":5"}}
+	edit.markIfEdited(ts)
+	if !edit.Modified || edit.UpdatedAt == nil || !edit.UpdatedAt.Equal(ts) {
+		t.Errorf("Replacement must be marked as edited, got %+v", edit)
+	}
+
+	// Stored message updated after publishing.
+	stored := &MsgServerData{SeqId: 5, Timestamp: ts}
+	stored.markIfEdited(ts.Add(time.Minute))
+	if !stored.Modified {
+		t.Error("Updated message must be marked as edited")
+	}
+}
+
+func TestValidNoteWhat(t *testing.T) {
+	testNotes := []struct {
+		note     MsgClientNote
+		expected bool
+	}{
+		{MsgClientNote{What: "kp"}, true},
+		{MsgClientNote{What: "kp", SeqId: 5}, false},
+		{MsgClientNote{What: "read", SeqId: 5}, true},
+		{MsgClientNote{What: "recv"}, false},
+		{MsgClientNote{What: "recv", SeqIds: []int{3, 7, 5}}, true},
+		{MsgClientNote{What: "recv", SeqId: 9, SeqIds: []int{3, 7}}, true},
+		{MsgClientNote{What: "recv", SeqIds: []int{3, 0}}, false},
+		{MsgClientNote{What: "recv", SeqIds: []int{-1}}, false},
+		{MsgClientNote{What: "read", SeqIds: []int{3}}, false},
+		{MsgClientNote{What: "kp", SeqIds: []int{3}}, false},
+		{MsgClientNote{What: "read_all"}, true},
+		{MsgClientNote{What: "read_all", SeqId: 5}, false},
+		{MsgClientNote{What: "call_end"}, true},
+		{MsgClientNote{What: "call_end", Payload: map[string]interface{}{"sdp": "..."}}, false},
+		{MsgClientNote{What: "call_accept"}, true},
+		{MsgClientNote{What: "call_accept", Payload: "busy"}, false},
+		{MsgClientNote{What: "call_reject"}, true},
+		{MsgClientNote{What: "react", SeqId: 5, Value: "👍"}, true},
+		{MsgClientNote{What: "react", SeqId: 5}, false},
+		{MsgClientNote{What: "loc", SeqId: 5, Payload: map[string]interface{}{"lat": 10.5, "lon": -20.0}}, true},
+		{MsgClientNote{What: "loc", Payload: map[string]interface{}{"lat": 10.5, "lon": -20.0}}, false},
+		{MsgClientNote{What: "loc", SeqId: 5, Payload: map[string]interface{}{"lat": 100.0, "lon": 0.0}}, false},
+		{MsgClientNote{What: "loc", SeqId: 5}, false},
+		{MsgClientNote{What: "react", Value: "👍"}, false},
+		{MsgClientNote{What: "call_reject", Payload: map[string]interface{}{"reason": "busy"}}, true},
+		{MsgClientNote{What: "video_playing", SeqId: 5}, true},
+		{MsgClientNote{What: "video_paused", SeqId: 5, Value: "12.5"}, true},
+		{MsgClientNote{What: "video_playing", SeqId: 5, Value: "0"}, true},
+		{MsgClientNote{What: "video_paused", Value: "12.5"}, false},
+		{MsgClientNote{What: "video_paused", SeqId: 5, Value: "-1"}, false},
+		{MsgClientNote{What: "video_playing", SeqId: 5, Value: "abc"}, false},
+		{MsgClientNote{What: "video_playing", SeqId: 5, Value: "NaN"}, false},
+		{MsgClientNote{What: "video_playing", SeqId: 5, Value: "+Inf"}, false},
+		{MsgClientNote{What: "bogus"}, false},
+	}
+
+	for _, tc := range testNotes {
+		if valid := validNoteWhat(&tc.note); valid != tc.expected {
+			t.Errorf("Note %+v, expecting %v, got %v", tc.note, tc.expected, valid)
+		}
+	}
+}
+
+func TestNoteMaxSeqId(t *testing.T) {
+	testNotes := []struct {
+		note     MsgClientNote
+		expected int
+	}{
+		{MsgClientNote{What: "recv", SeqId: 4}, 4},
+		{MsgClientNote{What: "recv", SeqIds: []int{3, 7, 5}}, 7},
+		{MsgClientNote{What: "recv", SeqId: 9, SeqIds: []int{3, 7}}, 9},
+		{MsgClientNote{What: "recv", SeqId: 2, SeqIds: []int{3, 7}}, 7},
+		{MsgClientNote{What: "kp"}, 0},
+	}
+
+	for _, tc := range testNotes {
+		if max := tc.note.MaxSeqId(); max != tc.expected {
+			t.Errorf("Note %+v, expecting %d, got %d", tc.note, tc.expected, max)
+		}
+	}
+}
+
+func TestServerMetaCombined(t *testing.T) {
+	meta := &MsgServerMeta{
+		Topic: "me",
+		Desc:  &MsgTopicDesc{},
+		Tags:  []string{"email:alice@example.com"},
+		Cred:  []*MsgCredServer{{Method: "email", Value: "alice@example.com", Done: true}},
+	}
+	out, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{`"desc":{`, `"tags":["email:alice@example.com"]`,
+		`"cred":[{"meth":"email","val":"alice@example.com","done":true}]`} {
+		if !strings.Contains(string(out), part) {
+			t.Errorf("Meta must contain '%s', got '%s'", part, out)
+		}
+	}
+}
+
+func TestServerMetaIsEmpty(t *testing.T) {
+	testMetas := []struct {
+		meta     MsgServerMeta
+		expected bool
+	}{
+		{MsgServerMeta{Id: "1", Topic: "me"}, true},
+		{MsgServerMeta{Tags: []string{}, Cred: []*MsgCredServer{}}, true},
+		{MsgServerMeta{Desc: &MsgTopicDesc{}}, false},
+		{MsgServerMeta{Sub: []MsgTopicSub{{}}}, false},
+		{MsgServerMeta{Del: &MsgDelValues{}}, false},
+		{MsgServerMeta{Tags: []string{"tag"}}, false},
+		{MsgServerMeta{Cred: []*MsgCredServer{{Method: "tel"}}}, false},
+	}
+
+	for i, tc := range testMetas {
+		if empty := tc.meta.IsEmpty(); empty != tc.expected {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, empty)
+		}
+	}
+}
+
+func TestCursorDelId(t *testing.T) {
+	testCases := []struct {
+		opts     *MsgBrowseOpts
+		expected int
+	}{
+		{nil, 0},
+		{&MsgBrowseOpts{}, 0},
+		{&MsgBrowseOpts{SinceId: 5}, 0},
+		{&MsgBrowseOpts{Cursor: "8"}, 8},
+	}
+	for i, tc := range testCases {
+		if delID, err := tc.opts.CursorDelId(); err != nil || delID != tc.expected {
+			t.Errorf("%d: expecting %d, got %d (%v)", i, tc.expected, delID, err)
+		}
+	}
+
+	for _, cursor := range []string{"x", "-1"} {
+		if _, err := (&MsgBrowseOpts{Cursor: cursor}).CursorDelId(); err == nil {
+			t.Errorf("Invalid cursor '%s' accepted", cursor)
+		}
+	}
+	if (&MsgServerMeta{Cursor: "2"}).HasMoreDel() {
+		t.Error("meta without deleted ranges has no more of them")
+	}
+	if !(&MsgServerMeta{Cursor: "2"}).HasMoreSubs() {
+		t.Error("meta with a cursor and no deleted ranges has more subscriptions")
+	}
+	if (&MsgServerMeta{Del: &MsgDelValues{DelId: 7}, Cursor: "8"}).HasMoreSubs() {
+		t.Error("meta with deleted ranges has no more subscriptions")
+	}
+}
+
+func TestServerDataBatch(t *testing.T) {
+	msg := &ServerComMessage{DataBatch: &MsgServerDataBatch{
+		Topic: "grp1XUtEhjv6HND",
+		Messages: []MsgServerData{
+			{Topic: "grp1XUtEhjv6HND", SeqId: 1, Content: "hello"},
+			{Topic: "grp1XUtEhjv6HND", SeqId: 2, Content: "world"},
+		}}}
+	out, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `{"databatch":{"topic":"grp1XUtEhjv6HND","messages":[{"topic":"grp1XUtEhjv6HND",`) ||
+		!strings.Contains(string(out), `"seq":2,"content":"world"}]}}`) {
+		t.Errorf("Unexpected batch '%s'", out)
+	}
+
+	out, _ = json.Marshal(&ServerComMessage{Data: &MsgServerData{Topic: "grp1XUtEhjv6HND"}})
+	if strings.Contains(string(out), "databatch") {
+		t.Errorf("Empty batch must be omitted, got '%s'", out)
+	}
+
+	var hi ClientComMessage
+	if err := json.Unmarshal([]byte(`{"hi":{"ver":"0.14","databatch":true}}`), &hi); err != nil {
+		t.Fatal(err)
+	}
+	if !hi.Hi.DataBatch {
+		t.Error("Batch must be requested in {hi}")
+	}
+	out, _ = json.Marshal(NoErrHi("1", 201, &MsgServerHiParams{Ver: "0.14", DataBatch: true}, time.Time{}))
+	if !strings.Contains(string(out), `"databatch":true`) {
+		t.Errorf("Batch must be confirmed in {ctrl}, got '%s'", out)
+	}
+}
+
+func TestPresRouting(t *testing.T) {
+	pres := &MsgServerPres{Topic: "me", What: "on", Src: "grp1XUtEhjv6HND"}
+	if pres.SingleUser() != "" || pres.SkippedTopic() != "" {
+		t.Fatalf("New notification must not be restricted, got '%s', '%s'", pres.SingleUser(), pres.SkippedTopic())
+	}
+
+	pres.SendToUser("usr2il9suCbuko")
+	pres.SkipTopic("grp1XUtEhjv6HND")
+	if pres.SingleUser() != "usr2il9suCbuko" {
+		t.Errorf("Expecting single user 'usr2il9suCbuko', got '%s'", pres.SingleUser())
+	}
+	if pres.SkippedTopic() != "grp1XUtEhjv6HND" {
+		t.Errorf("Expecting skipped topic 'grp1XUtEhjv6HND', got '%s'", pres.SkippedTopic())
+	}
+
+	out, _ := json.Marshal(pres)
+	if strings.Contains(string(out), "usr2il9suCbuko") {
+		t.Errorf("Routing parameters must not be serialized, got '%s'", out)
+	}
+
+	pres.SendToUser("")
+	pres.SkipTopic("")
+	if pres.SingleUser() != "" || pres.SkippedTopic() != "" {
+		t.Errorf("Restrictions must be removed, got '%s', '%s'", pres.SingleUser(), pres.SkippedTopic())
+	}
+}
+
+func TestSubInitialDataLimit(t *testing.T) {
+	testSubs := []struct {
+		sub      MsgClientSub
+		expected int
+	}{
+		{MsgClientSub{}, maxQueryLimit},
+		{MsgClientSub{Get: &MsgGetQuery{}}, maxQueryLimit},
+		{MsgClientSub{Get: &MsgGetQuery{Data: &MsgBrowseOpts{}}}, maxQueryLimit},
+		{MsgClientSub{Get: &MsgGetQuery{Data: &MsgBrowseOpts{Limit: 24}}}, 24},
+		{MsgClientSub{Get: &MsgGetQuery{Data: &MsgBrowseOpts{Limit: maxQueryLimit * 10}}}, maxQueryLimit},
+	}
+
+	for i, tc := range testSubs {
+		if limit := tc.sub.InitialDataLimit(); limit != tc.expected {
+			t.Errorf("%d: expecting %d, got %d", i, tc.expected, limit)
+		}
+	}
+}
+
+func TestSubWantMode(t *testing.T) {
+	testSubs := []struct {
+		sub      *MsgClientSub
+		expected string
+	}{
+		{nil, ""},
+		{&MsgClientSub{}, ""},
+		{&MsgClientSub{Set: &MsgSetQuery{}}, ""},
+		{&MsgClientSub{Set: &MsgSetQuery{Sub: &MsgSetSub{}}}, ""},
+		{&MsgClientSub{Set: &MsgSetQuery{Sub: &MsgSetSub{Mode: "JRW"}}}, "JRW"},
+	}
+
+	for i, tc := range testSubs {
+		if mode := tc.sub.WantMode(); mode != tc.expected {
+			t.Errorf("%d: expecting '%s', got '%s'", i, tc.expected, mode)
+		}
+	}
+}
+
+func TestFindSeqGaps(t *testing.T) {
+	testGaps := []struct {
+		have     []int
+		maxSeq   int
+		expected []MsgDelRange
+	}{
+		{[]int{1, 2, 3, 4, 5}, 5, nil},
+		{[]int{5, 3, 1, 2, 4, 4}, 5, nil},
+		{nil, 0, nil},
+		{nil, 1, []MsgDelRange{{LowId: 1}}},
+		{nil, 5, []MsgDelRange{{LowId: 1, HiId: 5}}},
+		{[]int{1, 3, 4, 8}, 10, []MsgDelRange{{LowId: 2}, {LowId: 5, HiId: 7}, {LowId: 9, HiId: 10}}},
+		{[]int{2, 3}, 3, []MsgDelRange{{LowId: 1}}},
+		{[]int{-1, 0, 1, 12}, 3, []MsgDelRange{{LowId: 2, HiId: 3}}},
+	}
+
+	for i, tc := range testGaps {
+		gaps := FindSeqGaps(tc.have, tc.maxSeq)
+		if len(gaps) != len(tc.expected) {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, gaps)
+			continue
+		}
+		for j := range gaps {
+			if gaps[j] != tc.expected[j] {
+				t.Errorf("%d: expecting %v, got %v", i, tc.expected, gaps)
+				break
+			}
+		}
+	}
+}
+
+func TestDataViewOnce(t *testing.T) {
+	broadcast := make(chan *ServerComMessage, 1)
+	sess := &Session{ver: 1, send: make(chan interface{}, 1),
+		subs: map[string]*Subscription{"grp1XUtEhjv6HND": {broadcast: broadcast}}}
+
+	for _, eor := range []bool{false, true} {
+		sess.publish(&ClientComMessage{Pub: &MsgClientPub{Topic: "grp1XUtEhjv6HND", Content: "hi",
+			ExpireOnRead: eor}, timestamp: time.Now()})
+		msg := <-broadcast
+		if msg.Data.IsViewOnce() != eor {
+			t.Errorf("Expecting view-once %v, got %v", eor, msg.Data.IsViewOnce())
+		}
+		if (msg.Data.Head[headerExpireOnRead] != "") != eor {
+			t.Errorf("Expecting view-once %v stored in head, got %v", eor, msg.Data.Head)
+		}
+
+		out, _ := json.Marshal(msg.Data)
+		if strings.Contains(string(out), `"eor":true`) != eor {
+			t.Errorf("Unexpected serialization of view-once %v: '%s'", eor, out)
+		}
+	}
+}
+
+func TestTopicDescPinned(t *testing.T) {
+	out, _ := json.Marshal(&MsgTopicDesc{Pinned: []int{12, 3}})
+	if !strings.Contains(string(out), `"pinned":[12,3]`) {
+		t.Errorf("Desc must report pinned messages, got '%s'", out)
+	}
+
+	var set MsgSetDesc
+	if err := json.Unmarshal([]byte(`{"pinned":[]}`), &set); err != nil {
+		t.Fatal(err)
+	}
+	if set.Pinned == nil {
+		t.Error("Empty list of pins must be distinguishable from missing pins")
+	}
+}
+
+func TestHiWantsResume(t *testing.T) {
+	var msg ClientComMessage
+	if err := json.Unmarshal([]byte(`{"hi":{"ver":"0.14","stok":"c2VjcmV0"}}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Hi.SessionToken != "c2VjcmV0" {
+		t.Errorf("Expecting token 'c2VjcmV0', got '%s'", msg.Hi.SessionToken)
+	}
+	if !msg.Hi.WantsResume() {
+		t.Error("Handshake with a token must request resuming")
+	}
+
+	if (&MsgClientHi{Version: "0.14"}).WantsResume() {
+		t.Error("Handshake without a token must not request resuming")
+	}
+}
+
+func TestDataCompress(t *testing.T) {
+	large := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100))
+	data := &MsgServerData{Topic: "grp1XUtEhjv6HND", Content: large}
+	if err := data.Compress(); err != nil {
+		t.Fatal(err)
+	}
+	if data.Head["content-encoding"] != "gzip" {
+		t.Fatalf("Large content must be marked as compressed, got %v", data.Head)
+	}
+	if compressed := data.Content.([]byte); len(compressed) >= len(large) {
+		t.Errorf("Compressed content is not smaller: %d >= %d", len(compressed), len(large))
+	}
+
+	// Round-trip through JSON turns the byte slice into a base64 string.
+	out, _ := json.Marshal(data)
+	var received MsgServerData
+	if err := json.Unmarshal(out, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := received.Decompress(); err != nil {
+		t.Fatal(err)
+	}
+	if string(received.Content.([]byte)) != string(large) {
+		t.Error("Decompressed content does not match the original")
+	}
+	if received.Head != nil {
+		t.Errorf("Encoding header must be removed, got %v", received.Head)
+	}
+
+	small := &MsgServerData{Content: []byte("hi")}
+	if err := small.Compress(); err != nil || small.Head != nil || string(small.Content.([]byte)) != "hi" {
+		t.Errorf("Small content must not be compressed, got %v, %v", small.Head, small.Content)
+	}
+	text := &MsgServerData{Content: string(large)}
+	if err := text.Compress(); err != nil || text.Head != nil {
+		t.Errorf("Non-byte content must not be compressed, got %v", text.Head)
+	}
+}
+
+func TestDefaultAcsModeValidate(t *testing.T) {
+	valid := []MsgDefaultAcsMode{
+		{},
+		{Auth: "JRWP"},
+		{Anon: "N"},
+		{Auth: "jrwpasd", Anon: "JR"},
+	}
+	for _, mode := range valid {
+		if err := mode.Validate(); err != nil {
+			t.Errorf("Mode %+v must be valid, got %v", mode, err)
+		}
+	}
+
+	invalid := []MsgDefaultAcsMode{
+		{Auth: "JRWX"},
+		{Anon: "read"},
+		{Auth: "JRWP", Anon: "J R"},
+		{Auth: "🙂"},
+	}
+	for _, mode := range invalid {
+		if err := mode.Validate(); err == nil {
+			t.Errorf("Mode %+v must be rejected", mode)
+		}
+	}
+}
+
+func TestGetOrderedParts(t *testing.T) {
+	testQueries := map[string][]int{
+		"data desc":         {constMsgMetaDesc, constMsgMetaData},
+		"del data sub desc": {constMsgMetaDesc, constMsgMetaSub, constMsgMetaData, constMsgMetaDel},
+		"tags data sub":     {constMsgMetaSub, constMsgMetaTags, constMsgMetaData},
+		"data":              {constMsgMetaData},
+		"":                  nil,
+		"bogus":             nil,
+	}
+
+	for what, expected := range testQueries {
+		parts := MsgGetQuery{What: what}.OrderedParts()
+		if len(parts) != len(expected) {
+			t.Errorf("'%s': expecting %v, got %v", what, expected, parts)
+			continue
+		}
+		for i := range parts {
+			if parts[i] != expected[i] {
+				t.Errorf("'%s': expecting %v, got %v", what, expected, parts)
+				break
+			}
+		}
+	}
+}
+
+func TestDelLimit(t *testing.T) {
+	testCases := []struct {
+		del      *MsgBrowseOpts
+		expected int
+	}{
+		{nil, 64},
+		{&MsgBrowseOpts{}, 64},
+		{&MsgBrowseOpts{Limit: -3}, 64},
+		{&MsgBrowseOpts{Limit: 10}, 10},
+		{&MsgBrowseOpts{Limit: 5000}, 1024},
+	}
+	for _, tc := range testCases {
+		if limit := (MsgGetQuery{What: "del", Del: tc.del}).DelLimit(64, 1024); limit != tc.expected {
+			t.Errorf("%+v: expecting %d, got %d", tc.del, tc.expected, limit)
+		}
+	}
+}
+
+func TestEnsureDefaultGet(t *testing.T) {
+	sub := &MsgClientSub{Topic: "grp1XUtEhjv6HND"}
+	sub.EnsureDefaultGet(24)
+	if sub.Get == nil {
+		t.Fatal("expecting default get")
+	}
+	parts := sub.Get.OrderedParts()
+	if len(parts) != 3 || parts[0] != constMsgMetaDesc || parts[1] != constMsgMetaSub || parts[2] != constMsgMetaData {
+		t.Errorf("expecting desc, sub and data, got %v", parts)
+	}
+	if sub.InitialDataLimit() != 24 {
+		t.Error("expecting data limit 24, got", sub.InitialDataLimit())
+	}
+
+	get := &MsgGetQuery{What: "desc"}
+	sub = &MsgClientSub{Topic: "grp1XUtEhjv6HND", Get: get}
+	sub.EnsureDefaultGet(24)
+	if sub.Get != get || sub.Get.What != "desc" || sub.Get.Data != nil {
+		t.Errorf("existing get should not be changed, got %+v", sub.Get)
+	}
+}
+
+func TestCtrlParamsInto(t *testing.T) {
+	type retryParams struct {
+		RetryAfter int `json:"retryAfter"`
+	}
+
+	ctrl := &MsgServerCtrl{Code: http.StatusTooManyRequests, Params: map[string]interface{}{"retryAfter": 30}}
+	var params retryParams
+	if err := ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.RetryAfter != 30 {
+		t.Error("expecting retryAfter=30, got", params.RetryAfter)
+	}
+
+	// Params sent over the wire are decoded as generic JSON.
+	var msg ServerComMessage
+	if err := json.Unmarshal([]byte(`{"ctrl":{"code":429,"params":{"retryAfter":5},"ts":"2018-01-01T00:00:00Z"}}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	params = retryParams{}
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.RetryAfter != 5 {
+		t.Error("expecting retryAfter=5, got", params.RetryAfter)
+	}
+
+	ctrl.Params = map[string]interface{}{"retryAfter": "soon"}
+	if err := ctrl.ParamsInto(&params); err == nil {
+		t.Error("incompatible params should fail")
+	}
+
+	ctrl.Params = nil
+	params = retryParams{RetryAfter: 1}
+	if err := ctrl.ParamsInto(&params); err != nil || params.RetryAfter != 1 {
+		t.Error("missing params should leave the value unchanged")
+	}
+}
+
+func TestNoErrHi(t *testing.T) {
+	ts := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	sent := &MsgServerHiParams{Ver: "0.14", Build: "test", MaxMessageSize: 1 << 17, MaxSubscriberCount: 128,
+		MaxBatchSize: 64}
+	msg := NoErrHi("1", http.StatusCreated, sent, ts)
+	if msg.Ctrl.Code != http.StatusCreated || msg.Ctrl.Text != "created" {
+		t.Error("unexpected code/text", msg.Ctrl.Code, msg.Ctrl.Text)
+	}
+
+	var params MsgServerHiParams
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params != *sent {
+		t.Errorf("expecting %+v, got %+v", *sent, params)
+	}
+
+	// Round-trip over the wire.
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received ServerComMessage
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	params = MsgServerHiParams{}
+	if err := received.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params != *sent {
+		t.Errorf("expecting %+v after round-trip, got %+v", *sent, params)
+	}
+	if !strings.Contains(string(data), `"maxBatchSize":64`) {
+		t.Error("expecting maxBatchSize in params:", string(data))
+	}
+
+	msg = NoErrHi("2", http.StatusOK, nil, ts)
+	if msg.Ctrl.Params != nil || msg.Ctrl.Text != "ok" {
+		t.Error("nil params should not be set", msg.Ctrl.Params)
+	}
+}
+
+func TestValidateHeadLimits(t *testing.T) {
+	if err := validateHeadLimits(nil, 2, 8); err != nil {
+		t.Error("empty head should pass:", err)
+	}
+	if err := validateHeadLimits(map[string]string{"mime": "text/x", "a": "12345678"}, 2, 8); err != nil {
+		t.Error("head within limits should pass:", err)
+	}
+	if err := validateHeadLimits(map[string]string{"a": "1", "b": "2", "c": "3"}, 2, 8); err == nil {
+		t.Error("too many keys should fail")
+	}
+	if err := validateHeadLimits(map[string]string{"mime": "text/x-long"}, 2, 8); err == nil {
+		t.Error("value too long should fail")
+	}
+}
+
+func TestInferredMime(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{`{"topic":"grp1XUtEhjv6HND","content":"hello"}`, "text/plain"},
+		{`{"topic":"grp1XUtEhjv6HND","content":""}`, "text/plain"},
+		{`{"topic":"grp1XUtEhjv6HND","content":{"txt":"hello","fmt":[{"at":0,"len":5}]}}`, "application/json"},
+		{`{"topic":"grp1XUtEhjv6HND","content":[1,2,3]}`, "application/json"},
+		{`{"topic":"grp1XUtEhjv6HND","content":42}`, "application/json"},
+		{`{"topic":"grp1XUtEhjv6HND","content":null}`, ""},
+		{`{"topic":"grp1XUtEhjv6HND"}`, ""},
+	}
+	for _, tc := range testCases {
+		var pub MsgClientPub
+		if err := json.Unmarshal([]byte(tc.in), &pub); err != nil {
+			t.Fatal(err)
+		}
+		if mime := pub.InferredMime(); mime != tc.expected {
+			t.Errorf("%s: expecting '%s', got '%s'", tc.in, tc.expected, mime)
+		}
+	}
+}
+
+func TestShouldDefer(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		ts := now.Add(d)
+		return &ts
+	}
+	testCases := []struct {
+		name     string
+		sendAt   *time.Time
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"past", at(-time.Minute), false},
+		{"now", at(0), false},
+		{"future", at(time.Hour), true},
+		{"limit", at(time.Hour * 24), true},
+		{"too far", at(time.Hour*24 + time.Second), false},
+	}
+	for _, tc := range testCases {
+		if deferred := shouldDefer(tc.sendAt, now, time.Hour*24); deferred != tc.expected {
+			t.Errorf("%s: expecting %v, got %v", tc.name, tc.expected, deferred)
+		}
+	}
+
+	var msg ClientComMessage
+	if err := json.Unmarshal([]byte(`{"pub":{"topic":"grp1XUtEhjv6HND","content":"hi","sendat":"2018-01-01T01:00:00Z"}}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Pub.SendAt == nil || !shouldDefer(msg.Pub.SendAt, now, time.Hour*24) {
+		t.Error("expecting scheduled delivery, got", msg.Pub.SendAt)
+	}
+}
+
+func TestValidateContentDepth(t *testing.T) {
+	// Builds content of objects and arrays alternating, nested depth levels deep.
+	nested := func(depth int) interface{} {
+		var content interface{} = "leaf"
+		for i := 0; i < depth; i++ {
+			if i%2 == 0 {
+				content = []interface{}{1, content}
+			} else {
+				content = map[string]interface{}{"ent": content, "txt": "x"}
+			}
+		}
+		return content
+	}
+
+	for _, depth := range []int{0, 1, 2, 5} {
+		if err := validateContentDepth(nested(depth), 5); err != nil {
+			t.Errorf("depth %d: unexpected error %s", depth, err)
+		}
+	}
+	for _, depth := range []int{6, 100} {
+		if err := validateContentDepth(nested(depth), 5); err == nil {
+			t.Errorf("depth %d: should be rejected", depth)
+		}
+	}
+
+	// Content as decoded from JSON.
+	var content interface{}
+	if err := json.Unmarshal([]byte(`{"txt":"hi","fmt":[{"at":0,"len":2}]}`), &content); err != nil {
+		t.Fatal(err)
+	}
+	if validateContentDepth(content, 3) != nil || validateContentDepth(content, 2) == nil {
+		t.Error("expecting depth 3 to be the limit")
+	}
+}
+
+func TestContactKind(t *testing.T) {
+	testTopics := map[string]string{
+		"me":              "self",
+		"usrAxcP6aFwdDk":  "p2p",
+		"p2pAxcP6aFwdDkX": "p2p",
+		"grp1XUtEhjv6HND": "grp",
+		"fnd":             "",
+		"":                "",
+	}
+
+	for topic, expected := range testTopics {
+		if kind := (MsgTopicSub{Topic: topic}).ContactKind(); kind != expected {
+			t.Errorf("'%s': expecting '%s', got '%s'", topic, expected, kind)
+		}
+	}
+}
+
+func TestDataFromPublic(t *testing.T) {
+	data := &MsgServerData{Topic: "grp1XUtEhjv6HND", From: "usrAxcP6aFwdDk", SeqId: 1}
+	data.SetFromPublic(types.TopicCatGrp, map[string]interface{}{"fn": "Alice"})
+	out, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"frompub":{"fn":"Alice"}`) {
+		t.Error("frompub should be present in group topics:", string(out))
+	}
+
+	data = &MsgServerData{Topic: "usrXyZUvW", From: "usrAxcP6aFwdDk", SeqId: 1}
+	data.SetFromPublic(types.TopicCatP2P, map[string]interface{}{"fn": "Alice"})
+	out, _ = json.Marshal(data)
+	if strings.Contains(string(out), "frompub") {
+		t.Error("frompub should be omitted in p2p topics:", string(out))
+	}
+
+	data = &MsgServerData{Topic: "grp1XUtEhjv6HND", SeqId: 1}
+	out, _ = json.Marshal(data)
+	if strings.Contains(string(out), "frompub") {
+		t.Error("empty frompub should be omitted:", string(out))
+	}
+}
+
+func TestErrUpgradeRequired(t *testing.T) {
+	msg := ErrUpgradeRequired("1", "", minSupportedVersion, time.Now())
+	if msg.Ctrl.Code != http.StatusUpgradeRequired {
+		t.Error("expecting code 426, got", msg.Ctrl.Code)
+	}
+	if msg.Ctrl.CodeText() != "upgrade required" {
+		t.Error("unexpected code text", msg.Ctrl.CodeText())
+	}
+
+	var params struct {
+		MinVer string `json:"minver"`
+	}
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.MinVer != minSupportedVersion {
+		t.Errorf("expecting minver '%s', got '%s'", minSupportedVersion, params.MinVer)
+	}
+
+	// Deprecated versions must sit between the compatible and the supported minimums.
+	if versionCompare(minCompatibleVersionValue, minSupportedVersionValue) > 0 {
+		t.Error("minimum compatible version is above the minimum supported version")
+	}
+}
+
+func TestPrivateComment(t *testing.T) {
+	testCases := []struct {
+		private  string
+		expected string
+		ok       bool
+	}{
+		{`"Bob the builder"`, "Bob the builder", true},
+		{`{"comment":"Bob the builder","muted":true}`, "Bob the builder", true},
+		{`""`, "", false},
+		{`{"comment":""}`, "", false},
+		{`{"comment":42}`, "", false},
+		{`{"nick":"Bob"}`, "", false},
+		{`["Bob"]`, "", false},
+		{`null`, "", false},
+	}
+	for _, tc := range testCases {
+		var sub MsgTopicSub
+		if err := json.Unmarshal([]byte(`{"user":"usrAbCdEfGhIjK","private":`+tc.private+`}`), &sub); err != nil {
+			t.Fatal(err)
+		}
+		if comment, ok := sub.PrivateComment(); comment != tc.expected || ok != tc.ok {
+			t.Errorf("%s: expecting '%s', %v, got '%s', %v", tc.private, tc.expected, tc.ok, comment, ok)
+		}
+	}
+}
+
+func TestDiffSubs(t *testing.T) {
+	then := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := then.Add(time.Hour)
+	thenCopy := then
+
+	old := []MsgTopicSub{
+		{User: "usrAlice", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &then},
+		{User: "usrBob", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &then},
+		{User: "usrCarol", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &then},
+		{User: "usrDave", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &then},
+	}
+	new := []MsgTopicSub{
+		// Unchanged, timestamp is an equal copy.
+		{User: "usrAlice", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &thenCopy},
+		// Access mode changed.
+		{User: "usrBob", Acs: MsgAccessMode{Mode: "JR"}, UpdatedAt: &then},
+		// Timestamp changed.
+		{User: "usrCarol", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &later},
+		// Joined.
+		{User: "usrEve", Acs: MsgAccessMode{Mode: "JRWP"}, UpdatedAt: &later},
+	}
+
+	added, removed, changed := DiffSubs(old, new)
+	if len(added) != 1 || added[0].User != "usrEve" {
+		t.Error("expecting usrEve added, got", added)
+	}
+	if len(removed) != 1 || removed[0].User != "usrDave" {
+		t.Error("expecting usrDave removed, got", removed)
+	}
+	if len(changed) != 2 || changed[0].User != "usrBob" || changed[1].User != "usrCarol" {
+		t.Error("expecting usrBob and usrCarol changed, got", changed)
+	}
+
+	added, removed, changed = DiffSubs(old, old)
+	if len(added) != 0 || len(removed) != 0 || len(changed) != 0 {
+		t.Error("identical lists should have no differences")
+	}
+}
+
+func TestNormalizeHead(t *testing.T) {
+	if normalizeHead(nil) != nil || normalizeHead(map[string]string{}) != nil {
+		t.Error("empty head should normalize to nil")
+	}
+
+	head := normalizeHead(map[string]string{
+		"Mime":             "text/x-drafty",
+		"Content-Encoding": "gzip",
+		"X-Custom":         "Value",
+		"thread":           "5",
+	})
+	expected := map[string]string{
+		"mime":             "text/x-drafty",
+		"content-encoding": "gzip",
+		"X-Custom":         "Value",
+		"thread":           "5",
+	}
+	if len(head) != len(expected) {
+		t.Fatalf("expecting %v, got %v", expected, head)
+	}
+	for key, val := range expected {
+		if head[key] != val {
+			t.Errorf("'%s': expecting '%s', got '%s'", key, val, head[key])
+		}
+	}
+
+	// The lowercase key takes precedence over a mixed-case duplicate.
+	head = normalizeHead(map[string]string{"MIME": "text/plain", "mime": "text/x-drafty"})
+	if len(head) != 1 || head["mime"] != "text/x-drafty" {
+		t.Error("expecting lowercase mime to win, got", head)
+	}
+}
+
+func TestFilterHeadForDelivery(t *testing.T) {
+	if filterHeadForDelivery(nil) != nil {
+		t.Error("empty head should filter to nil")
+	}
+	if head := filterHeadForDelivery(map[string]string{"draft": "1", "local-id": "abc"}); head != nil {
+		t.Error("head with no deliverable keys should filter to nil, got", head)
+	}
+
+	head := filterHeadForDelivery(map[string]string{
+		"mime":     "text/x-drafty",
+		"reply":    "42",
+		"X-Custom": "Value",
+		"x-app":    "1",
+		"draft":    "1",
+		"system":   "true",
+		"xcustom":  "2",
+	})
+	expected := map[string]string{
+		"mime":     "text/x-drafty",
+		"reply":    "42",
+		"X-Custom": "Value",
+		"x-app":    "1",
+	}
+	if len(head) != len(expected) {
+		t.Fatalf("expecting %v, got %v", expected, head)
+	}
+	for key, val := range expected {
+		if head[key] != val {
+			t.Errorf("'%s': expecting '%s', got '%s'", key, val, head[key])
+		}
+	}
+}
+
+func TestReplyToSeq(t *testing.T) {
+	for _, key := range []string{"reply", "Reply", "replyto", "replyTo", "reply-to", "Reply-To"} {
+		data := &MsgServerData{Head: normalizeHead(map[string]string{key: "42", "X-Custom": "1"})}
+		if len(data.Head) != 2 {
+			t.Errorf("'%s': unexpected head %v", key, data.Head)
+		}
+		if seq, ok := data.ReplyToSeq(); !ok || seq != 42 {
+			t.Errorf("'%s': expecting 42, got %d, %v", key, seq, ok)
+		}
+	}
+
+	// The canonical key wins over aliases.
+	head := normalizeHead(map[string]string{"reply-to": "1", "reply": "2", "replyto": "3"})
+	if len(head) != 1 || head["reply"] != "2" {
+		t.Error("expecting canonical reply to win, got", head)
+	}
+	// Lowercase alias wins over mixed case one.
+	head = normalizeHead(map[string]string{"Reply-To": "1", "replyto": "3"})
+	if len(head) != 1 || head["reply"] != "3" {
+		t.Error("expecting lowercase alias to win, got", head)
+	}
+
+	if seq, ok := (&MsgServerData{Head: map[string]string{"reply": ":42"}}).ReplyToSeq(); !ok || seq != 42 {
+		t.Error("expecting reference in ':seq' form to be accepted")
+	}
+
+	for _, val := range []string{"", "0", "-5", "abc", ":"} {
+		data := &MsgServerData{Head: map[string]string{"reply": val}}
+		if _, ok := data.ReplyToSeq(); ok {
+			t.Errorf("'%s': should not be a valid reply", val)
+		}
+	}
+}
+
+func TestSortKey(t *testing.T) {
+	messages := []*MsgServerData{
+		{SeqId: 5},
+		{SeqId: 6, Head: map[string]string{"thread": "5"}},
+		{SeqId: 7, Head: map[string]string{"replace": ":5"}},
+		{SeqId: 8, Head: map[string]string{"reply": ":6"}},
+		{SeqId: 9, Head: map[string]string{"replace": "5"}},
+		// Invalid reference: the edit can't precede the original.
+		{SeqId: 10, Head: map[string]string{"replace": ":12"}},
+	}
+	expected := [][2]int{{5, 0}, {6, 0}, {5, 7}, {8, 0}, {5, 9}, {10, 0}}
+	for i, msg := range messages {
+		if s1, s2 := msg.SortKey(); s1 != expected[i][0] || s2 != expected[i][1] {
+			t.Errorf("seq %d: expecting %v, got (%d, %d)", msg.SeqId, expected[i], s1, s2)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		i1, i2 := messages[i].SortKey()
+		j1, j2 := messages[j].SortKey()
+		return i1 < j1 || (i1 == j1 && i2 < j2)
+	})
+	order := []int{5, 7, 9, 6, 8, 10}
+	for i, msg := range messages {
+		if msg.SeqId != order[i] {
+			t.Fatalf("expecting edits next to originals %v, got seq %d at %d", order, msg.SeqId, i)
+		}
+	}
+}
+
+func TestResolveEdit(t *testing.T) {
+	ts := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		edited := ts.Add(d)
+		return &edited
+	}
+
+	first := &MsgServerData{SeqId: 7, From: "usrAbCdEfGhIjK", Timestamp: ts, UpdatedAt: at(time.Second)}
+	second := &MsgServerData{SeqId: 7, From: "usrAbCdEfGhIjK", Timestamp: ts, UpdatedAt: at(time.Minute)}
+	if resolveEdit(first, second) != second || resolveEdit(second, first) != second {
+		t.Error("later edit should win regardless of arrival order")
+	}
+
+	// Same time: ordered by sender.
+	alice := &MsgServerData{SeqId: 7, From: "usrAaaaaaaaaaa", Timestamp: ts, UpdatedAt: at(time.Minute)}
+	bob := &MsgServerData{SeqId: 7, From: "usrBbbbbbbbbbb", Timestamp: ts, UpdatedAt: at(time.Minute)}
+	if resolveEdit(alice, bob) != bob || resolveEdit(bob, alice) != bob {
+		t.Error("tie should be broken by sender")
+	}
+
+	// Unedited message has the time of publishing.
+	original := &MsgServerData{SeqId: 7, From: "usrAbCdEfGhIjK", Timestamp: ts}
+	if resolveEdit(original, first) != first || resolveEdit(first, original) != first {
+		t.Error("edit should win over unedited message")
+	}
+
+	if resolveEdit(nil, first) != first || resolveEdit(first, nil) != first {
+		t.Error("missing message should lose")
+	}
+}
+
+func TestNewSystemData(t *testing.T) {
+	ts := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := NewSystemData("grpAbCdEfGhIjK", 7, "joined", ts)
+	if data.Topic != "grpAbCdEfGhIjK" || data.SeqId != 7 || data.Content != "joined" || !data.Timestamp.Equal(ts) {
+		t.Errorf("unexpected message %+v", data)
+	}
+	if !data.IsSystem() {
+		t.Error("message should be a system message")
+	}
+	if data.Head["system"] != "true" || len(data.Head) != 1 {
+		t.Error("unexpected head", data.Head)
+	}
+	if out, _ := json.Marshal(data); strings.Contains(string(out), `"from"`) {
+		t.Error("system message should have no sender:", string(out))
+	}
+
+	// The head alone does not make a message a system one.
+	data = &MsgServerData{From: "usrAbCdEfGhIjK", Head: map[string]string{"system": "true"}}
+	if data.IsSystem() {
+		t.Error("message with a sender should not be a system message")
+	}
+}
+
+func TestAllowedMime(t *testing.T) {
+	// Only the default types are allowed by default.
+	for _, mime := range []string{"text/plain", "Text/Plain", "text/plain; charset=utf-8", "application/json",
+		"text/x-drafty", "image/jpeg", "image/png"} {
+		if !IsAllowedMime(mime) {
+			t.Errorf("'%s' must be allowed by default", mime)
+		}
+	}
+	for _, mime := range []string{"", "audio/ogg", "video/mp4", "text/html", "not a mime"} {
+		if IsAllowedMime(mime) {
+			t.Errorf("'%s' must not be allowed by default", mime)
+		}
+	}
+
+	defer func() { mimeRestricted = true }()
+	defer delete(allowedMimes, "video/mp4")
+	restrictMimes([]string{"Video/MP4"}, false)
+	if !IsAllowedMime("video/mp4") || IsAllowedMime("text/html") {
+		t.Error("only the default and the configured types must be allowed")
+	}
+
+	// Any well-formed type is allowed when the restriction is off.
+	restrictMimes(nil, true)
+	for _, mime := range []string{"audio/ogg", "Text/HTML; charset=utf-8"} {
+		if !IsAllowedMime(mime) {
+			t.Errorf("'%s' must be allowed", mime)
+		}
+	}
+	if IsAllowedMime("not a mime") {
+		t.Error("malformed type must not be allowed")
+	}
+	mimeRestricted = true
+
+	defer delete(allowedMimes, "audio/ogg")
+	RegisterAllowedMime("Audio/Ogg")
+	if !IsAllowedMime("audio/ogg") {
+		t.Error("'audio/ogg' must be allowed after registration")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering an empty mime must panic")
+		}
+	}()
+	RegisterAllowedMime("")
+}
+
+func TestAccValidateConsistency(t *testing.T) {
+	creds := []MsgCredClient{{Method: "email", Value: "Alice@Example.com"}, {Method: "tel", Value: "+17025550001"}}
+	testCases := []struct {
+		tags     []string
+		cred     []MsgCredClient
+		expected error
+	}{
+		{nil, nil, nil},
+		{[]string{"alice", "travel"}, nil, nil},
+		{[]string{"email:alice@example.com", "tel:+17025550001"}, creds, nil},
+		{[]string{" EMAIL: alice@example.com "}, creds, nil},
+		{[]string{"basic:alice"}, nil, nil},
+		{[]string{"email:alice@example.com"}, []MsgCredClient{{Method: " Email ", Value: " ALICE@example.com "}}, nil},
+		{[]string{"email:bob@example.com"}, creds, errAccInconsistent},
+		{[]string{"tel:+17025550002"}, creds, errAccInconsistent},
+		{[]string{"email:alice@example.com"}, nil, errAccInconsistent},
+		{[]string{"tel:alice@example.com"}, creds, errAccInconsistent},
+	}
+	for i, tc := range testCases {
+		acc := MsgClientAcc{User: "new", Tags: tc.tags, Cred: tc.cred}
+		if err := acc.ValidateConsistency(); err != tc.expected {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, err)
+		}
+	}
+}
+
+func TestDecodeLocationContent(t *testing.T) {
+	var pub MsgClientPub
+	in := `{"topic":"grp1XUtEhjv6HND","content":{"lat":59.9375,"lon":30.308611,"label":"Hermitage",` +
+		`"live":true,"until":"2018-01-01T01:00:00Z"}}`
+	if err := json.Unmarshal([]byte(in), &pub); err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := DecodeLocationContent(pub.Content)
+	if !ok {
+		t.Fatal("Location must be decoded")
+	}
+	until := time.Date(2018, 1, 1, 1, 0, 0, 0, time.UTC)
+	if loc.Lat != 59.9375 || loc.Lon != 30.308611 || loc.Label != "Hermitage" || !loc.Live ||
+		loc.Until == nil || !loc.Until.Equal(until) {
+		t.Errorf("Location decoded incorrectly: %+v", loc)
+	}
+
+	testCases := []struct {
+		content  string
+		expected bool
+	}{
+		{`{"lat":0,"lon":0}`, true},
+		{`{"lat":90,"lon":-180}`, true},
+		{`{"lat":-90,"lon":180}`, true},
+		{`{"lat":90.5,"lon":0}`, false},
+		{`{"lat":-91,"lon":0}`, false},
+		{`{"lat":0,"lon":180.1}`, false},
+		{`{"lat":0,"lon":-200}`, false},
+		{`{"lat":10}`, false},
+		{`{"lon":10}`, false},
+		{`{"lat":"10","lon":"20"}`, false},
+		{`{"lat":10,"lon":20,"until":"tomorrow"}`, false},
+		{`"hello"`, false},
+		{`null`, false},
+	}
+	for _, tc := range testCases {
+		var content interface{}
+		if err := json.Unmarshal([]byte(tc.content), &content); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := DecodeLocationContent(content); ok != tc.expected {
+			t.Errorf("%s: expecting %v, got %v", tc.content, tc.expected, ok)
+		}
+	}
+}
+
+func TestShouldEcho(t *testing.T) {
+	testCases := []struct {
+		pub      *MsgClientPub
+		target   string
+		expected bool
+	}{
+		{&MsgClientPub{}, "sid1", true},
+		{&MsgClientPub{}, "sid2", true},
+		{&MsgClientPub{NoEcho: true}, "sid1", false},
+		{&MsgClientPub{NoEcho: true}, "sid2", true},
+		{nil, "sid1", true},
+	}
+
+	for i, tc := range testCases {
+		if echo := shouldEcho(tc.pub, "sid1", tc.target); echo != tc.expected {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, echo)
+		}
+	}
+}
+
+func TestNewBroadcastNotice(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := NewBroadcastNotice("maintenance at 02:00", ts)
+	if msg.rcptto != "sys" || !msg.timestamp.Equal(ts) || msg.Data == nil {
+		t.Fatalf("unexpected notice %+v", msg)
+	}
+	if msg.Data.Topic != "sys" || !msg.Data.IsSystem() || msg.Data.SeqId != 0 || msg.Data.Content != "maintenance at 02:00" {
+		t.Errorf("unexpected data %+v", msg.Data)
+	}
+
+	out, _ := json.Marshal(msg)
+	expected := `{"data":{"topic":"sys","ts":"2018-01-02T03:04:05Z","seq":0,"head":{"system":"true"},"content":"maintenance at 02:00"}}`
+	if string(out) != expected {
+		t.Errorf("expecting '%s', got '%s'", expected, out)
+	}
+}
+
+func TestServerDataIsFrom(t *testing.T) {
+	data := &MsgServerData{From: "usrAbCdEfGhIjK"}
+	if !data.IsFrom("usrAbCdEfGhIjK") {
+		t.Error("message should be from the sender")
+	}
+	if data.IsFrom("usrZyXwVuTsRqP") || data.IsFrom("") {
+		t.Error("message should not be from another user")
+	}
+
+	system := NewSystemData("grpAbCdEfGhIjK", 7, "joined", time.Now())
+	if system.IsFrom("") || system.IsFrom("usrAbCdEfGhIjK") {
+		t.Error("system message should not be from anyone")
+	}
+}
+
+func TestServerComMessageValidate(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name  string
+		msg   *ServerComMessage
+		valid bool
+	}{
+		{"ctrl", NoErr("1", "grp1XUtEhjv6HND", now), true},
+		{"session ctrl", ErrCommandOutOfSequence("1", "", now), true},
+		{"data", &ServerComMessage{Data: &MsgServerData{Topic: "grp1XUtEhjv6HND", SeqId: 1}}, true},
+		{"meta", &ServerComMessage{Meta: &MsgServerMeta{Topic: "me"}}, true},
+		{"pres", &ServerComMessage{Pres: &MsgServerPres{Topic: "me", What: PresOn}}, true},
+		{"info", &ServerComMessage{Info: &MsgServerInfo{Topic: "grp1XUtEhjv6HND", What: "kp"}}, true},
+		{"databatch", &ServerComMessage{DataBatch: &MsgServerDataBatch{Topic: "grp1XUtEhjv6HND"}}, true},
+
+		{"empty", &ServerComMessage{}, false},
+		{"two payloads", &ServerComMessage{Ctrl: &MsgServerCtrl{Code: 200},
+			Data: &MsgServerData{Topic: "grp1XUtEhjv6HND"}}, false},
+		{"ctrl without code", &ServerComMessage{Ctrl: &MsgServerCtrl{Topic: "grp1XUtEhjv6HND"}}, false},
+		{"data without topic", &ServerComMessage{Data: &MsgServerData{SeqId: 1}}, false},
+		{"meta without topic", &ServerComMessage{Meta: &MsgServerMeta{Id: "1"}}, false},
+		{"pres without topic", &ServerComMessage{Pres: &MsgServerPres{What: PresOn}}, false},
+		{"pres without what", &ServerComMessage{Pres: &MsgServerPres{Topic: "me"}}, false},
+		{"info without topic", &ServerComMessage{Info: &MsgServerInfo{What: "kp"}}, false},
+		{"databatch without topic", &ServerComMessage{DataBatch: &MsgServerDataBatch{}}, false},
+	}
+	for _, tc := range testCases {
+		if err := tc.msg.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: expecting valid=%v, got %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestClearTopicIfEmpty(t *testing.T) {
+	now := time.Now()
+
+	msg := ErrAuthRequired("1", sessionScopedTopic, now)
+	msg.ClearTopicIfEmpty()
+	if out, _ := json.Marshal(msg); strings.Contains(string(out), `"topic"`) {
+		t.Error("session-scoped error should have no topic:", string(out))
+	}
+
+	msg = ErrCommandOutOfSequence("2", "grp1XUtEhjv6HND", now)
+	msg.ClearTopicIfEmpty()
+	if out, _ := json.Marshal(msg); strings.Contains(string(out), `"topic"`) {
+		t.Error("session-scoped error should have no topic:", string(out))
+	}
+
+	msg = ErrPermissionDenied("3", "grp1XUtEhjv6HND", now)
+	msg.ClearTopicIfEmpty()
+	if msg.Ctrl.Topic != "grp1XUtEhjv6HND" {
+		t.Error("topic-scoped error should keep the topic, got", msg.Ctrl.Topic)
+	}
+
+	// Messages other than {ctrl} are not affected.
+	msg = &ServerComMessage{Data: &MsgServerData{Topic: "grp1XUtEhjv6HND"}}
+	msg.ClearTopicIfEmpty()
+	if msg.Data.Topic != "grp1XUtEhjv6HND" {
+		t.Error("{data} topic should not change, got", msg.Data.Topic)
+	}
+}
+
+func TestNoErrAcceptedPub(t *testing.T) {
+	msg := NoErrAcceptedPub("1", "grp1XUtEhjv6HND", MsgPubAck{SeqId: 42, ClientMsgId: "m-17"}, time.Now())
+	if msg.Ctrl.Code != http.StatusAccepted {
+		t.Error("expecting code 202, got", msg.Ctrl.Code)
+	}
+
+	var ack MsgPubAck
+	if err := msg.Ctrl.ParamsInto(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.SeqId != 42 || ack.ClientMsgId != "m-17" {
+		t.Error("unexpected ack", ack)
+	}
+
+	// Same ack as decoded by the client.
+	out, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ServerComMessage
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	ack = MsgPubAck{}
+	if err := decoded.Ctrl.ParamsInto(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.SeqId != 42 || ack.ClientMsgId != "m-17" {
+		t.Error("unexpected decoded ack", ack)
+	}
+}
+
+func TestPrivateVer(t *testing.T) {
+	var msg ClientComMessage
+	if err := json.Unmarshal([]byte(`{"set":{"id":"1","topic":"grp1XUtEhjv6HND",
+		"desc":{"private":{"comment":"work"},"privatever":3}}}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Set.Desc == nil || msg.Set.Desc.PrivateVer != 3 {
+		t.Fatal("expecting privatever=3, got", msg.Set.Desc)
+	}
+
+	desc := &MsgTopicDesc{Private: msg.Set.Desc.Private, PrivateVer: msg.Set.Desc.PrivateVer}
+	out, err := json.Marshal(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded MsgTopicDesc
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.PrivateVer != 3 {
+		t.Error("privatever lost in round trip:", string(out))
+	}
+
+	out, _ = json.Marshal(&MsgTopicDesc{Private: "x"})
+	if strings.Contains(string(out), "privatever") {
+		t.Error("zero privatever should be omitted:", string(out))
+	}
+	out, _ = json.Marshal(&MsgSetDesc{Private: "x"})
+	if strings.Contains(string(out), "privatever") {
+		t.Error("zero privatever should be omitted:", string(out))
+	}
+}
+
+func TestSetSubsBatch(t *testing.T) {
+	alice, bob := types.Uid(1234567).UserId(), types.Uid(7654321).UserId()
+
+	var msg ClientComMessage
+	in := `{"set":{"id":"1","topic":"grp1XUtEhjv6HND","subs":[{"user":"` + alice + `","mode":"JRWP"},{"user":"` + bob + `"}]}}`
+	if err := json.Unmarshal([]byte(in), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Set.Sub != nil || len(msg.Set.Users) != 2 {
+		t.Fatalf("unexpected batch %+v", msg.Set.MsgSetQuery)
+	}
+	if msg.Set.Users[0].User != alice || msg.Set.Users[0].Mode != "JRWP" || msg.Set.Users[1].User != bob {
+		t.Errorf("unexpected batch entries %+v", msg.Set.Users)
+	}
+	if err := validateSetSubs(msg.Set.Users); err != nil {
+		t.Error("valid batch rejected:", err)
+	}
+
+	invalid := map[string][]MsgSetSub{
+		"missing user":   {{User: alice}, {Mode: "JRWP"}},
+		"invalid user":   {{User: "grp1XUtEhjv6HND"}},
+		"duplicate user": {{User: alice}, {User: bob, Mode: "JR"}, {User: alice}},
+	}
+	for name, subs := range invalid {
+		if err := validateSetSubs(subs); err == nil {
+			t.Errorf("%s: batch should be rejected", name)
+		}
+	}
+}
+
+func TestValidateBatchSize(t *testing.T) {
+	for size, valid := range map[int]bool{0: true, 1: true, 63: true, 64: true, 65: false, 1000: false} {
+		if err := validateBatchSize(size, 64); (err == nil) != valid {
+			t.Errorf("size %d: expecting valid=%v, got %v", size, valid, err)
+		}
+	}
+}
+
+func TestSetSubMuted(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected *bool
+	}{
+		{`{"set":{"topic":"grp1XUtEhjv6HND","sub":{"mode":"JRWP"}}}`, nil},
+		{`{"set":{"topic":"grp1XUtEhjv6HND","sub":{"muted":false}}}`, new(bool)},
+		{`{"set":{"topic":"grp1XUtEhjv6HND","sub":{"muted":true}}}`, func() *bool { b := true; return &b }()},
+	}
+	for _, tc := range testCases {
+		var msg ClientComMessage
+		if err := json.Unmarshal([]byte(tc.in), &msg); err != nil {
+			t.Fatal(err)
+		}
+		muted := msg.Set.Sub.Muted
+		if (muted == nil) != (tc.expected == nil) || (muted != nil && *muted != *tc.expected) {
+			t.Errorf("%s: unexpected muted %v", tc.in, muted)
+		}
+	}
+
+	// Unset muted is not sent, false is sent explicitly.
+	out, _ := json.Marshal(&MsgSetSub{Mode: "JRWP"})
+	if strings.Contains(string(out), "muted") {
+		t.Error("unset muted should be omitted:", string(out))
+	}
+	out, _ = json.Marshal(&MsgSetSub{Muted: new(bool)})
+	if !strings.Contains(string(out), `"muted":false`) {
+		t.Error("muted=false should be sent:", string(out))
+	}
+
+	out, _ = json.Marshal(&MsgTopicSub{Topic: "grp1XUtEhjv6HND", Muted: true})
+	var sub MsgTopicSub
+	if err := json.Unmarshal(out, &sub); err != nil {
+		t.Fatal(err)
+	}
+	if !sub.Muted {
+		t.Error("muted flag lost in round-trip:", string(out))
+	}
+	if out, _ = json.Marshal(&MsgTopicSub{Topic: "grp1XUtEhjv6HND"}); strings.Contains(string(out), "muted") {
+		t.Error("muted=false should be omitted in subscriptions:", string(out))
+	}
+}
+
+func TestDelRequiresOwner(t *testing.T) {
+	testDels := []struct {
+		del      MsgClientDel
+		expected bool
+	}{
+		{MsgClientDel{What: "msg"}, false},
+		{MsgClientDel{What: ""}, false},
+		{MsgClientDel{What: "msg", Hard: true}, true},
+		{MsgClientDel{What: "", Hard: true}, true},
+		{MsgClientDel{What: "topic"}, true},
+		{MsgClientDel{What: "topic", Hard: true}, true},
+		{MsgClientDel{What: "sub", User: "usrAxcP6aFwdDk"}, true},
+		{MsgClientDel{What: "sub", Hard: true}, true},
+		{MsgClientDel{What: "bogus", Hard: true}, false},
+	}
+
+	for _, tc := range testDels {
+		if owner := tc.del.RequiresOwner(); owner != tc.expected {
+			t.Errorf("Del %+v, expecting %v, got %v", tc.del, tc.expected, owner)
+		}
+	}
+}
+
+func TestDataThumbnail(t *testing.T) {
+	testData := []struct {
+		head map[string]string
+		ref  string
+		w, h int
+		ok   bool
+	}{
+		{map[string]string{"thumb": "/v0/file/s/abc.jpg", "thumbw": "64", "thumbh": "48"}, "/v0/file/s/abc.jpg", 64, 48, true},
+		{map[string]string{"thumb": "/v0/file/s/abc.jpg"}, "/v0/file/s/abc.jpg", 0, 0, true},
+		{map[string]string{"thumb": "/v0/file/s/abc.jpg", "thumbw": "wide", "thumbh": "-5"}, "/v0/file/s/abc.jpg", 0, 0, true},
+		{map[string]string{"thumbw": "64", "thumbh": "48"}, "", 0, 0, false},
+		{nil, "", 0, 0, false},
+	}
+
+	for i, tc := range testData {
+		data := &MsgServerData{Head: tc.head}
+		ref, w, h, ok := data.Thumbnail()
+		if ref != tc.ref || w != tc.w || h != tc.h || ok != tc.ok {
+			t.Errorf("%d: expecting '%s' %dx%d %v, got '%s' %dx%d %v", i, tc.ref, tc.w, tc.h, tc.ok, ref, w, h, ok)
+		}
+	}
+}
+
+func TestSetDescContentUpdate(t *testing.T) {
+	private := map[string]interface{}{"comment": "work"}
+
+	// Merge of only private leaves public intact.
+	public, priv := (&MsgSetDesc{Private: private, Merge: true}).contentUpdate()
+	if public != nil {
+		t.Error("merge: public must be left unchanged, got", public)
+	}
+	if priv == nil || isNullValue(priv) {
+		t.Error("merge: private must be assigned, got", priv)
+	}
+
+	// Replace of only private clears public, whether replace is requested explicitly or by default.
+	for _, desc := range []*MsgSetDesc{{Private: private, Merge: false}, {Private: private}} {
+		public, priv := desc.contentUpdate()
+		if !isNullValue(public) {
+			t.Error("replace: public must be cleared, got", public)
+		}
+		if priv == nil || isNullValue(priv) {
+			t.Error("replace: private must be assigned, got", priv)
+		}
+	}
+
+	// Replace of only public clears private.
+	public, priv = (&MsgSetDesc{Public: "Alice"}).contentUpdate()
+	if public != "Alice" || !isNullValue(priv) {
+		t.Errorf("replace: expecting public assigned and private cleared, got %v, %v", public, priv)
+	}
+
+	// Neither is given: nothing is replaced.
+	public, priv = (&MsgSetDesc{DefaultAcs: &MsgDefaultAcsMode{Auth: "JRWP"}}).contentUpdate()
+	if public != nil || priv != nil {
+		t.Errorf("no content: expecting both unchanged, got %v, %v", public, priv)
+	}
+}
+
+func TestNoErrDeleted(t *testing.T) {
+	msg := NoErrDeleted("1", "grp1XUtEhjv6HND", 12, 7, time.Now())
+	if msg.Ctrl.Code != http.StatusOK {
+		t.Error("expecting code 200, got", msg.Ctrl.Code)
+	}
+
+	var params struct {
+		Count int `json:"count"`
+		Clear int `json:"clear"`
+		Del   int `json:"del"`
+	}
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Count != 12 || params.Clear != 7 || params.Del != 7 {
+		t.Errorf("unexpected params %+v", params)
+	}
+}
+
+func TestNoErrWithWarning(t *testing.T) {
+	msg := NoErrWithWarning("1", "grp1XUtEhjv6HND", "result truncated", time.Now())
+	if msg.Ctrl.Code != http.StatusOK || msg.Ctrl.Id != "1" || msg.Ctrl.Topic != "grp1XUtEhjv6HND" {
+		t.Errorf("unexpected response %+v", msg.Ctrl)
+	}
+
+	var params struct {
+		Warning string `json:"warning"`
+	}
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Warning != "result truncated" {
+		t.Error("expecting the warning in params, got", params.Warning)
+	}
+}
+
+func TestInfoThrottled(t *testing.T) {
+	msg := InfoThrottled("grp1XUtEhjv6HND", time.Now())
+	if msg.Ctrl.Code != http.StatusNotModified || msg.Ctrl.Topic != "grp1XUtEhjv6HND" {
+		t.Errorf("unexpected response %+v", msg.Ctrl)
+	}
+	if out, _ := json.Marshal(msg); strings.Contains(string(out), `"id"`) {
+		t.Error("response to a note should have no id:", string(out))
+	}
+
+	var params struct {
+		Reason string `json:"reason"`
+	}
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Reason != "throttled" {
+		t.Error("expecting sub-code 'throttled', got", params.Reason)
+	}
+}
+
+func TestErrTopicArchived(t *testing.T) {
+	msg := ErrTopicArchived("1", "grp1XUtEhjv6HND", time.Now())
+	if msg.Ctrl.Code != http.StatusConflict {
+		t.Error("expecting code 409, got", msg.Ctrl.Code)
+	}
+
+	var params struct {
+		Reason string `json:"reason"`
+	}
+	if err := msg.Ctrl.ParamsInto(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Reason != "archived" {
+		t.Error("expecting sub-code 'archived', got", params.Reason)
+	}
+
+	// Other conflicts carry no sub-code.
+	if ErrCommandOutOfSequence("2", "", time.Now()).Ctrl.Params != nil {
+		t.Error("unexpected sub-code in a generic conflict")
+	}
+}
+
+func TestInfoLimitToActive(t *testing.T) {
+	info := &MsgServerInfo{Topic: "grp1XUtEhjv6HND", What: "kp"}
+	if info.ActiveOnly() {
+		t.Error("new info must not be limited to active sessions")
+	}
+	info.LimitToActive()
+	if !info.ActiveOnly() {
+		t.Error("expecting info to be limited to active sessions")
+	}
+
+	out, _ := json.Marshal(info)
+	if strings.Contains(string(out), "active") {
+		t.Errorf("routing flag must not be serialized: %s", out)
+	}
+}
+
+func TestNewLocationUpdate(t *testing.T) {
+	info := NewLocationUpdate("grp1XUtEhjv6HND", "usrAbc", 7, 59.9375, 30.308611)
+	if info.Topic != "grp1XUtEhjv6HND" || info.From != "usrAbc" || info.SeqId != 7 {
+		t.Errorf("unexpected fields: %+v", info)
+	}
+	if info.What != "loc" {
+		t.Errorf("expecting what 'loc', got '%s'", info.What)
+	}
+	loc, ok := info.Payload.(*MsgLocationContent)
+	if !ok || loc.Lat != 59.9375 || loc.Lon != 30.308611 {
+		t.Errorf("unexpected payload: %+v", info.Payload)
+	}
+
+	// The update must pass the same validation as the one sent by the client.
+	out, _ := json.Marshal(info)
+	var note MsgClientNote
+	if err := json.Unmarshal(out, &note); err != nil {
+		t.Fatal(err)
+	}
+	if !validNoteWhat(&note) {
+		t.Errorf("update must be a valid note: %s", out)
+	}
+}
+
+func TestAggregateReactions(t *testing.T) {
+	notes := []MsgServerInfo{
+		{From: "usrAbc", What: "react", SeqId: 7, Value: "👍"},
+		{From: "usrDef", What: "react", SeqId: 7, Value: "👍"},
+		{From: "usrAbc", What: "react", SeqId: 7, Value: "👍"},
+		{From: "usrAbc", What: "react", SeqId: 3, Value: "❤"},
+		{From: "usrDef", What: "react", SeqId: 7, Value: "😂"},
+		{From: "usrAbc", What: "read", SeqId: 7},
+	}
+
+	summary := aggregateReactions(notes)
+	if len(summary) != 2 {
+		t.Fatalf("expecting 2 summaries, got %+v", summary)
+	}
+	if summary[0].SeqId != 3 || len(summary[0].Counts) != 1 || summary[0].Counts["❤"] != 1 {
+		t.Errorf("unexpected summary for seq 3: %+v", summary[0])
+	}
+	if summary[1].SeqId != 7 || len(summary[1].Counts) != 2 ||
+		summary[1].Counts["👍"] != 2 || summary[1].Counts["😂"] != 1 {
+		t.Errorf("unexpected summary for seq 7: %+v", summary[1])
+	}
+
+	if summary := aggregateReactions([]MsgServerInfo{{What: "kp"}}); summary != nil {
+		t.Errorf("expecting nil, got %+v", summary)
+	}
+}
+
+func TestMetaReactionsJSON(t *testing.T) {
+	meta := &MsgServerMeta{Topic: "grp1XUtEhjv6HND",
+		Reactions: []MsgReactionSummary{{SeqId: 7, Counts: map[string]int{"+1": 2}}}}
+	if meta.IsEmpty() {
+		t.Error("meta with reactions must not be empty")
+	}
+	out, _ := json.Marshal(meta)
+	if !strings.Contains(string(out), `"reactions":[{"seq":7,"counts":{"+1":2}}]`) {
+		t.Errorf("unexpected JSON %s", out)
+	}
+
+	out, _ = json.Marshal(&MsgServerMeta{Topic: "grp1XUtEhjv6HND"})
+	if strings.Contains(string(out), "reactions") {
+		t.Errorf("empty reactions must be omitted, got %s", out)
+	}
+}
@@ -30,7 +30,7 @@ const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	dbVersion = 100
+	dbVersion = 104
 
 	adapterName = "mysql"
 )
@@ -130,6 +130,45 @@ func (a *adapter) CheckDbVersion() error {
 	return nil
 }
 
+// schemaUpgrades are the statements which upgrade the database from the previous version to the given one.
+var schemaUpgrades = []struct {
+	version int
+	stmts   []string
+}{
+	{101, []string{"ALTER TABLE topics ADD pinned JSON"}},
+	{102, []string{"ALTER TABLE subscriptions ADD privatever INT DEFAULT 0"}},
+	{103, []string{"ALTER TABLE subscriptions ADD muted TINYINT DEFAULT 0"}},
+	{104, []string{"ALTER TABLE topics ADD touchedat DATETIME(3)"}},
+}
+
+// UpgradeDb upgrades the database schema to the version expected by this adapter one version at a time.
+// The version is recorded after each step, so an interrupted upgrade can be resumed.
+func (a *adapter) UpgradeDb() error {
+	if _, err := a.getDbVersion(); err != nil {
+		return err
+	}
+
+	for _, step := range schemaUpgrades {
+		if a.version >= step.version {
+			continue
+		}
+		if a.version != step.version-1 {
+			return errors.New("mysql: cannot upgrade from database version " + strconv.Itoa(a.version))
+		}
+		for _, stmt := range step.stmts {
+			if _, err := a.db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if _, err := a.db.Exec("UPDATE kvmeta SET `value`=? WHERE `key`='version'", strconv.Itoa(step.version)); err != nil {
+			return err
+		}
+		a.version = step.version
+	}
+
+	return a.CheckDbVersion()
+}
+
 // GetName returns string that adapter uses to register itself with store.
 func (a *adapter) GetName() string {
 	return adapterName
@@ -172,7 +211,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			`)`); err != nil {
 		return err
 	}
-	if _, err = tx.Exec("INSERT INTO kvmeta(`key`, `value`) VALUES('version', '100')"); err != nil {
+	if _, err = tx.Exec("INSERT INTO kvmeta(`key`, `value`) VALUES('version', ?)", strconv.Itoa(dbVersion)); err != nil {
 		return err
 	}
 
@@ -253,6 +292,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			delid 		INT DEFAULT 0,
 			public 		JSON,
 			tags		JSON,
+			pinned		JSON,
+			touchedat 	DATETIME(3),
 			PRIMARY KEY(id),
 			UNIQUE INDEX topics_name (name)
 		)`); err != nil {
@@ -287,6 +328,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			modewant	CHAR(8),
 			modegiven  	CHAR(8),
 			private 	JSON,
+			privatever 	INT DEFAULT 0,
+			muted 		TINYINT DEFAULT 0,
 			PRIMARY KEY(id)	,
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX subscriptions_topic_userid (topic, userid),
@@ -631,7 +674,7 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	// Fetch topic by name
 	var tt = new(t.Topic)
 	err := a.db.Get(tt,
-		"SELECT createdat,updatedat,deletedat,name AS id,access,seqid,delid,public,tags FROM topics WHERE name=?",
+		"SELECT createdat,updatedat,deletedat,name AS id,access,seqid,delid,public,tags,pinned FROM topics WHERE name=?",
 		topic)
 
 	if err != nil {
@@ -645,17 +688,29 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' subscription.
 // Reads and denormalizes Public value.
-func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error) {
-	// Fetch user's subscriptions
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.PageOpt) ([]t.Subscription, error) {
+	// Fetch user's subscriptions, except 'me' and 'fnd'
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,modewant,modegiven,private,privatever,muted FROM subscriptions WHERE userid=? AND topic NOT IN (?,?)`
+	args := []interface{}{store.DecodeUid(uid), uid.UserId(), uid.FndName()}
 	if !keepDeleted {
 		// Filter out rows with defined DeletedAt
 		q += " AND deletedAt IS NULL"
 	}
-	q += " LIMIT ?"
+	limit := maxResults
+	if opts != nil {
+		if opts.After != "" {
+			q += " AND topic>?"
+			args = append(args, opts.After)
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q += " ORDER BY topic LIMIT ?"
+	args = append(args, limit)
 
-	rows, err := a.db.Queryx(q, store.DecodeUid(uid), maxResults)
+	rows, err := a.db.Queryx(q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -711,7 +766,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription,
 	if len(topq) > 0 {
 		// Fetch grp & p2p topics
 		q, _, _ := sqlx.In(
-			"SELECT createdat,updatedat,deletedat,name AS id,access,seqid,delid,public,tags "+
+			"SELECT createdat,updatedat,deletedat,name AS id,access,seqid,delid,public,tags,touchedat "+
 				"FROM topics WHERE name IN (?)", topq)
 		rows, err = a.db.Queryx(q, topq...)
 		if err != nil {
@@ -727,6 +782,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription,
 			sub = join[top.Id]
 			sub.ObjHeader.MergeTimes(&top.ObjHeader)
 			sub.SetSeqId(top.SeqId)
+			sub.SetTouchedAt(top.TouchedAt)
 			// sub.SetDelId(top.DelId)
 			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
 				// all done with a grp topic
@@ -766,22 +822,38 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription,
 		}
 		rows.Close()
 	}
+
+	// The joins above return grp and p2p subscriptions out of order.
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+
 	return subs, err
 }
 
 // UsersForTopic loads users subscribed to the given topic
-func (a *adapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Subscription, error) {
-	// Fetch all subscribed users. The number of users is not large
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.PageOpt) ([]t.Subscription, error) {
+	// Fetch a page of subscribed users.
 	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
-		s.readseqid,s.modewant,s.modegiven,u.public,s.private
+		s.readseqid,s.modewant,s.modegiven,u.public,s.private,s.privatever,s.muted
 		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id 
 		WHERE s.topic=?`
+	args := []interface{}{topic}
 	if !keepDeleted {
 		// Filter out rows with DeletedAt being not null
 		q += " AND s.deletedAt IS NULL"
 	}
-	q += " LIMIT ?"
-	rows, err := a.db.Queryx(q, topic, maxSubscribers)
+	limit := maxSubscribers
+	if opts != nil {
+		if opts.After != "" {
+			q += " AND s.userid>?"
+			args = append(args, store.DecodeUid(t.ParseUid(opts.After)))
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q += " ORDER BY s.userid LIMIT ?"
+	args = append(args, limit)
+	rows, err := a.db.Queryx(q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -795,7 +867,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Subscriptio
 			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
 			&sub.User, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
 			&sub.ReadSeqId, &sub.ModeWant, &sub.ModeGiven,
-			&public, &sub.Private); err != nil {
+			&public, &sub.Private, &sub.PrivateVer, &sub.Muted); err != nil {
 			break
 		}
 		sub.User = encodeString(sub.User).String()
@@ -835,7 +907,7 @@ func (a *adapter) TopicDelete(topic string) error {
 }
 
 func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
-	_, err := a.db.Exec("UPDATE topics SET seqid=? WHERE name=?", msg.SeqId, topic)
+	_, err := a.db.Exec("UPDATE topics SET seqid=?,touchedat=? WHERE name=?", msg.SeqId, msg.CreatedAt, topic)
 
 	return err
 }
@@ -876,7 +948,7 @@ func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool) ([]t.Subscription
 	}
 
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,modewant,modegiven,private,privatever,muted FROM subscriptions WHERE userid=?`
 	if !keepDeleted {
 		q += " AND deletedAt IS NULL"
 	}
@@ -919,7 +991,7 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool) ([]t.Subscription
 	}
 
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+		readseqid,modewant,modegiven,private,privatever,muted FROM subscriptions WHERE topic=?`
 	if !keepDeleted {
 		// Filter out rows where DeletedAt is defined
 		q += " AND deletedAt IS NULL"
@@ -994,7 +1066,8 @@ func (a *adapter) SubsDelForTopic(topic string) error {
 
 // Returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:18003287448".
 // Searching the 'users.Tags' for the given tags using respective index.
-func (a *adapter) FindUsers(uid t.Uid, tags []string) ([]t.Subscription, error) {
+// Users with any of the excluded tags are skipped.
+func (a *adapter) FindUsers(uid t.Uid, tags, excl []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
 	var args []interface{}
 	for _, tag := range tags {
@@ -1002,11 +1075,20 @@ func (a *adapter) FindUsers(uid t.Uid, tags []string) ([]t.Subscription, error)
 		index[tag] = struct{}{}
 	}
 
+	var exclude string
+	if len(excl) > 0 {
+		exclude = "AND u.id NOT IN (SELECT userid FROM usertags WHERE tag IN (?" +
+			strings.Repeat(",?", len(excl)-1) + ")) "
+		for _, tag := range excl {
+			args = append(args, tag)
+		}
+	}
+
 	// Get users matched by tags, sort by number of matches from high to low.
 	rows, err := a.db.Queryx(
 		"SELECT u.id,u.createdat,u.updatedat,u.public,u.tags,COUNT(*) AS matches "+
 			"FROM users AS u LEFT JOIN usertags as t ON t.userid=u.id "+
-			"WHERE t.tag IN (?"+strings.Repeat(",?", len(tags)-1)+") "+
+			"WHERE t.tag IN (?"+strings.Repeat(",?", len(tags)-1)+") "+exclude+
 			"GROUP BY u.id,u.createdat,u.updatedat,u.public,u.tags ORDER BY matches DESC LIMIT ?",
 		append(args, maxResults)...)
 
@@ -1052,7 +1134,8 @@ func (a *adapter) FindUsers(uid t.Uid, tags []string) ([]t.Subscription, error)
 
 // Returns a list of topics with matching tags.
 // Searching the 'topics.Tags' for the given tags using respective index.
-func (a *adapter) FindTopics(tags []string) ([]t.Subscription, error) {
+// Topics with any of the excluded tags are skipped.
+func (a *adapter) FindTopics(tags, excl []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
 	var args []interface{}
 	for _, tag := range tags {
@@ -1060,10 +1143,19 @@ func (a *adapter) FindTopics(tags []string) ([]t.Subscription, error) {
 		index[tag] = struct{}{}
 	}
 
+	var exclude string
+	if len(excl) > 0 {
+		exclude = "AND t.name NOT IN (SELECT topic FROM topictags WHERE tag IN (?" +
+			strings.Repeat(",?", len(excl)-1) + ")) "
+		for _, tag := range excl {
+			args = append(args, tag)
+		}
+	}
+
 	rows, err := a.db.Queryx(
 		"SELECT t.id,t.createdat,t.updatedat,t.public,t.tags,COUNT(*) AS matches "+
 			"FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic "+
-			"WHERE tt.tag IN (?"+strings.Repeat(",?", len(tags)-1)+") "+
+			"WHERE tt.tag IN (?"+strings.Repeat(",?", len(tags)-1)+") "+exclude+
 			"GROUP BY t.id,t.createdat,t.updatedat,t.public,t.tags "+
 			"ORDER BY matches DESC LIMIT ?", append(args, maxResults)...)
 
@@ -1292,6 +1384,14 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.BrowseOpt)
 	return msgs, err
 }
 
+// Get the ID of the most recent message created before the given time
+func (a *adapter) MessageLastSeqBefore(topic string, before time.Time) (int, error) {
+	var seq int
+	err := a.db.Get(&seq, "SELECT COALESCE(MAX(seqid),0) FROM messages WHERE topic=? AND createdat<?",
+		topic, before)
+	return seq, err
+}
+
 var dellog struct {
 	Topic      string
 	Deletedfor int64
@@ -1319,10 +1419,12 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.BrowseO
 		}
 	}
 
-	// Fetch log of deletions
-	rows, err := a.db.Queryx("SELECT * FROM dellog WHERE topic=? AND delid BETWEEN ? and ?"+
-		" AND (deletedFor=0 OR deletedFor=?)"+
-		" ORDER BY delid LIMIT ?", topic, lower, upper, store.DecodeUid(forUser), limit)
+	// Fetch log of deletions. The limit applies to delete transactions, not to individual ranges.
+	rows, err := a.db.Queryx("SELECT d.* FROM dellog AS d JOIN"+
+		" (SELECT DISTINCT delid FROM dellog WHERE topic=? AND delid BETWEEN ? and ?"+
+		" AND (deletedFor=0 OR deletedFor=?) ORDER BY delid LIMIT ?) AS t ON d.delid=t.delid"+
+		" WHERE d.topic=? AND (d.deletedFor=0 OR d.deletedFor=?) ORDER BY d.delid",
+		topic, lower, upper, store.DecodeUid(forUser), limit, topic, store.DecodeUid(forUser))
 	if err != nil {
 		return nil, err
 	}
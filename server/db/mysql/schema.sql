@@ -11,7 +11,7 @@ CREATE TABLE kvmeta(
 	PRIMARY KEY(`key`)
 );
 
-INSERT INTO kvmeta(`key`, `value`) VALUES("version", "100");
+INSERT INTO kvmeta(`key`, `value`) VALUES("version", "104");
 
 CREATE TABLE users(
 	id 			BIGINT NOT NULL,
@@ -82,6 +82,8 @@ CREATE TABLE topics(
 	delid 		INT DEFAULT 0,
 	public 		JSON,
 	tags		JSON, -- Denormalized array of tags
+	pinned		JSON, -- Array of IDs of pinned messages
+	touchedat 	DATETIME(3), -- Time of the latest message
 	
 	PRIMARY KEY(id),
 	UNIQUE INDEX topics_name (name)
@@ -112,6 +114,8 @@ CREATE TABLE subscriptions(
 	modewant	CHAR(8),
 	modegiven  	CHAR(8),
 	private 	JSON,
+	privatever 	INT DEFAULT 0,
+	muted 		TINYINT DEFAULT 0,
 	
 	PRIMARY KEY(id)	,
 	FOREIGN KEY(userid) REFERENCES users(id),
@@ -152,6 +152,15 @@ func (a *adapter) CheckDbVersion() error {
 	return nil
 }
 
+// UpgradeDb upgrades the database to the version expected by this adapter. RethinkDB has no schema:
+// only the current version is supported.
+func (a *adapter) UpgradeDb() error {
+	if _, err := a.getDbVersion(); err != nil {
+		return err
+	}
+	return a.CheckDbVersion()
+}
+
 // GetName returns string that adapter uses to register itself with store.
 func (a *adapter) GetName() string {
 	return adapterName
@@ -503,15 +512,25 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' subscription.
 // Reads and denormalizes Public value.
-func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error) {
-	// Fetch user's subscriptions
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.PageOpt) ([]t.Subscription, error) {
+	// Fetch user's subscriptions, except 'me' and 'fnd'
 	// Subscription have Topic.UpdatedAt denormalized into Subscription.UpdatedAt
-	q := rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("User", uid.String())
+	q := rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("User", uid.String()).
+		Filter(rdb.Row.Field("Topic").Ne(uid.UserId()).And(rdb.Row.Field("Topic").Ne(uid.FndName())))
 	if !keepDeleted {
 		// Filter out rows with defined DeletedAt
 		q = q.Filter(rdb.Row.HasFields("DeletedAt").Not())
 	}
-	q = q.Limit(maxResults)
+	limit := maxResults
+	if opts != nil {
+		if opts.After != "" {
+			q = q.Filter(rdb.Row.Field("Topic").Gt(opts.After))
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q = q.OrderBy("Topic").Limit(limit)
 	//log.Printf("RethinkDbAdapter.TopicsForUser q: %+v", q)
 	rows, err := q.Run(a.conn)
 	if err != nil {
@@ -566,6 +585,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription,
 			sub = join[top.Id]
 			sub.ObjHeader.MergeTimes(&top.ObjHeader)
 			sub.SetSeqId(top.SeqId)
+			sub.SetTouchedAt(top.TouchedAt)
 			// sub.SetDelId(top.DelId)
 			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
 				// all done with a grp topic
@@ -604,19 +624,31 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription,
 		//log.Printf("RethinkDbAdapter.TopicsForUser 2: %#+v", subs)
 	}
 
+	// The joins above return grp and p2p subscriptions out of order.
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+
 	return subs, nil
 }
 
 // UsersForTopic loads users subscribed to the given topic
-func (a *adapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Subscription, error) {
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.PageOpt) ([]t.Subscription, error) {
 	// Fetch topic subscribers
-	// Fetch all subscribed users. The number of users is not large
+	// Fetch a page of subscribed users.
 	q := rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("Topic", topic)
 	if !keepDeleted {
 		// Filter out rows with DeletedAt being not null
 		q = q.Filter(rdb.Row.HasFields("DeletedAt").Not())
 	}
-	q = q.Limit(maxSubscribers)
+	limit := maxSubscribers
+	if opts != nil {
+		if opts.After != "" {
+			q = q.Filter(rdb.Row.Field("User").Gt(opts.After))
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q = q.OrderBy("User").Limit(limit)
 	//log.Printf("RethinkDbAdapter.UsersForTopic q: %+v", q)
 	rows, err := q.Run(a.conn)
 	if err != nil {
@@ -652,6 +684,9 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool) ([]t.Subscriptio
 			}
 		}
 		//log.Printf("RethinkDbAdapter.UsersForTopic users: %+v", subs)
+
+		// The join above returns subscriptions out of order.
+		sort.Slice(subs, func(i, j int) bool { return subs[i].User < subs[j].User })
 	}
 
 	return subs, nil
@@ -681,8 +716,9 @@ func (a *adapter) TopicDelete(topic string) error {
 func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
 
 	update := struct {
-		SeqId int
-	}{msg.SeqId}
+		SeqId     int
+		TouchedAt time.Time
+	}{msg.SeqId, msg.CreatedAt}
 
 	// FIXME(gene): remove 'me' update; no longer relevant
 	var err error
@@ -850,7 +886,8 @@ func (a *adapter) SubsDelForTopic(topic string) error {
 
 // Returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:18003287448".
 // Searching the 'users.Tags' for the given tags using respective index.
-func (a *adapter) FindUsers(uid t.Uid, tags []string) ([]t.Subscription, error) {
+// Users with any of the excluded tags are skipped.
+func (a *adapter) FindUsers(uid t.Uid, tags, excl []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
 	var query []interface{}
 	for _, tag := range tags {
@@ -862,6 +899,7 @@ func (a *adapter) FindUsers(uid t.Uid, tags []string) ([]t.Subscription, error)
 	rows, err := rdb.DB(a.dbName).
 		Table("users").
 		GetAllByIndex("Tags", query...).
+		Filter(excludeTags(excl)).
 		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").
 		Group("Id").
 		Ungroup().
@@ -911,9 +949,20 @@ func (a *adapter) FindUsers(uid t.Uid, tags []string) ([]t.Subscription, error)
 
 }
 
+// excludeTags returns a filter which passes records without any of the given tags.
+func excludeTags(excl []string) func(rdb.Term) rdb.Term {
+	return func(row rdb.Term) rdb.Term {
+		if len(excl) == 0 {
+			return rdb.Expr(true)
+		}
+		return row.Field("Tags").SetIntersection(excl).IsEmpty()
+	}
+}
+
 // Returns a list of topics with matching tags.
 // Searching the 'topics.Tags' for the given tags using respective index.
-func (a *adapter) FindTopics(tags []string) ([]t.Subscription, error) {
+// Topics with any of the excluded tags are skipped.
+func (a *adapter) FindTopics(tags, excl []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
 	var query []interface{}
 	for _, tag := range tags {
@@ -940,6 +989,7 @@ func (a *adapter) FindTopics(tags []string) ([]t.Subscription, error) {
 	rows, err := rdb.DB(a.dbName).
 		Table("topics").
 		GetAllByIndex("Tags", query...).
+		Filter(excludeTags(excl)).
 		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").
 		Group("Id").
 		Ungroup().
@@ -1169,6 +1219,26 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.BrowseOpt)
 	return msgs, nil
 }
 
+// Get the ID of the most recent message created before the given time
+func (a *adapter) MessageLastSeqBefore(topic string, before time.Time) (int, error) {
+	rows, err := rdb.DB(a.dbName).Table("messages").
+		Between([]interface{}{topic, rdb.MinVal}, []interface{}{topic, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		// Newest first, stop at the first message which is old enough
+		OrderBy(rdb.OrderByOpts{Index: rdb.Desc("Topic_SeqId")}).
+		Filter(rdb.Row.Field("CreatedAt").Lt(before)).
+		Limit(1).Field("SeqId").Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+
+	var seqs []int
+	if err = rows.All(&seqs); err != nil || len(seqs) == 0 {
+		return 0, err
+	}
+	return seqs[0], nil
+}
+
 // Get ranges of deleted messages
 func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.BrowseOpt) ([]t.DelMessage, error) {
 	var limit = 1024 // TODO(gene): pass into adapter as a config param
@@ -123,6 +123,11 @@ loop:
 	for {
 		select {
 		case <-stop:
+			// Let the clients know why they are about to be disconnected. The notice is sent to the
+			// sessions directly: the sessions are terminated before the hub gets to route anything.
+			globals.sessionStore.Broadcast(NewBroadcastNotice("server is shutting down",
+				time.Now().UTC().Round(time.Millisecond)))
+
 			// Flip the flag that we are terminating and close the Accept-ing socket, so no new connections are possible
 			shuttingDown = true
 			if err := server.Shutdown(nil); err != nil {
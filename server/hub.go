@@ -150,7 +150,10 @@ func (h *Hub) run() {
 			// This is a message from a connection not subscribed to topic
 			// Route incoming message to topic if topic permits such routing
 
-			if dst := h.topicGet(msg.rcptto); dst != nil {
+			if msg.rcptto == sysTopic {
+				// Server notice for everyone
+				globals.sessionStore.Broadcast(msg)
+			} else if dst := h.topicGet(msg.rcptto); dst != nil {
 				// Everything is OK, sending packet to known topic
 				if dst.broadcast != nil {
 					select {
@@ -417,12 +420,14 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 					public:    subs[i].GetPublic(),
 					topicName: types.ParseUid(subs[(i+1)%2].User).UserId(),
 
-					private:   subs[i].Private,
-					modeWant:  subs[i].ModeWant,
-					modeGiven: subs[i].ModeGiven,
-					delID:     subs[i].DelId,
-					recvID:    subs[i].RecvSeqId,
-					readID:    subs[i].ReadSeqId,
+					private:    subs[i].Private,
+					privateVer: subs[i].PrivateVer,
+					muted:      subs[i].Muted,
+					modeWant:   subs[i].ModeWant,
+					modeGiven:  subs[i].ModeGiven,
+					delID:      subs[i].DelId,
+					recvID:     subs[i].RecvSeqId,
+					readID:     subs[i].ReadSeqId,
 				}
 			}
 
@@ -673,13 +678,13 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 			}
 
 			// Owner/creator may restrict own access to topic
-			if sreg.pkt.Set.Sub != nil && sreg.pkt.Set.Sub.Mode != "" {
-				userData.modeWant = parseMode(sreg.pkt.Set.Sub.Mode, types.ModeCFull)
+			if mode := sreg.pkt.WantMode(); mode != "" {
+				userData.modeWant = parseMode(mode, types.ModeCFull)
 				// User must not unset ModeJoin or the owner flags
 				userData.modeWant |= types.ModeJoin | types.ModeOwner
 			}
 
-			tags = normalizeTags(tags, sreg.pkt.Set.Tags)
+			tags = normalizeTags(sreg.pkt.Set.Tags)
 			if len(tags) > globals.maxTagCount {
 				// If user sent too many tags, silently discard excessive tags.
 				tags = tags[:globals.maxTagCount]
@@ -739,6 +744,7 @@ func topicInit(sreg *sessionJoin, h *Hub) {
 		t.accessAnon = stopic.Access.Anon
 
 		t.public = stopic.Public
+		t.pinned = stopic.Pinned
 
 		t.created = stopic.CreatedAt
 		t.updated = stopic.UpdatedAt
@@ -782,14 +788,16 @@ func (t *Topic) loadSubscribers() error {
 	for _, sub := range subs {
 		uid := types.ParseUid(sub.User)
 		t.perUser[uid] = perUserData{
-			created:   sub.CreatedAt,
-			updated:   sub.UpdatedAt,
-			delID:     sub.DelId,
-			readID:    sub.ReadSeqId,
-			recvID:    sub.RecvSeqId,
-			private:   sub.Private,
-			modeWant:  sub.ModeWant,
-			modeGiven: sub.ModeGiven}
+			created:    sub.CreatedAt,
+			updated:    sub.UpdatedAt,
+			delID:      sub.DelId,
+			readID:     sub.ReadSeqId,
+			recvID:     sub.RecvSeqId,
+			private:    sub.Private,
+			privateVer: sub.PrivateVer,
+			muted:      sub.Muted,
+			modeWant:   sub.ModeWant,
+			modeGiven:  sub.ModeGiven}
 
 		if (sub.ModeGiven & sub.ModeWant).IsOwner() {
 			t.owner = uid
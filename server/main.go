@@ -41,11 +41,18 @@ const (
 	idleSessionTimeout = time.Second * 55
 	// idleTopicTimeout defines now long to keep topic alive after the last session detached.
 	idleTopicTimeout = time.Second * 5
+	// maxScheduleAhead is how far in the future a {pub} may be scheduled for delivery.
+	maxScheduleAhead = time.Hour * 24 * 365
+	// maxScheduledPerTopic is the maximum number of messages pending scheduled delivery in one topic.
+	maxScheduledPerTopic = 64
 
 	// currentVersion is the current API version
 	currentVersion = "0.14"
 	// minSupportedVersion is the minimum supported API version
 	minSupportedVersion = "0.14"
+	// minCompatibleVersion is the lowest deprecated API version. Clients between it and
+	// minSupportedVersion are asked to upgrade; clients below it are not supported at all.
+	minCompatibleVersion = "0.13"
 
 	// defaultMaxMessageSize is the default maximum message size
 	defaultMaxMessageSize = 1 << 19 // 512K
@@ -59,12 +66,58 @@ const (
 
 	// minTagLength is the shortest acceptable length of a tag
 	minTagLength = 4
+	// maxLoggedTagLength is the number of runes of an invalid tag to keep in error messages
+	maxLoggedTagLength = 32
+
+	// maxPinnedCount is the maximum number of pinned messages in a group topic
+	maxPinnedCount = 10
+
+	// maxReactedMessages is the maximum number of messages per topic with reactions kept in memory
+	maxReactedMessages = 1024
+
+	// contentCompressThreshold is the size of byte-slice content in bytes above which it's compressed
+	contentCompressThreshold = 1024
+
+	// maxQueryLimit is the default and the maximum number of subscriptions or messages
+	// returned in response to a single {get} request
+	maxQueryLimit = 1024
+	// defaultDelQueryLimit is the default number of deletion records returned in response
+	// to {get what="del"}
+	defaultDelQueryLimit = 32
+	// subPageSize is the default and the maximum number of subscriptions in a single {meta} packet.
+	// Longer lists are fetched in several requests using the cursor.
+	subPageSize = 128
+
+	// maxHeadKeys is the maximum number of keys in {pub head}
+	maxHeadKeys = 32
+	// maxHeadValueLength is the maximum length of a {pub head} value in bytes
+	maxHeadValueLength = 1024
+	// maxBatchSize is the maximum number of entries in a batch sent by the client, such as {set subs}
+	maxBatchSize = 64
+	// maxContentDepth is the maximum nesting of objects and arrays in {pub content}
+	maxContentDepth = 32
 
 	// Delay before updating a User Agent
 	uaTimerDelay = time.Second * 5
+	// presCoalesceWindow is the delay of contacts' "on" and "off" notifications on 'me': rapid changes
+	// within the window are delivered as the net state.
+	presCoalesceWindow = time.Second * 2
+
+	// kpFanoutThreshold is the number of group topic subscribers above which "kp" notifications
+	// are sent only to sessions which are actively viewing the topic.
+	kpFanoutThreshold = 32
+	// activeSessionWindow is how recently a session must have received a message from the client
+	// to be considered actively viewing the topic.
+	activeSessionWindow = time.Minute
 
 	// maxDeleteCount is the maximum allowed number of messages to delete in one call.
 	defaultMaxDeleteCount = 1024
+
+	// defaultMaxDeleteRanges is the maximum allowed number of ranges in a single {del} request.
+	defaultMaxDeleteRanges = 256
+
+	// defaultMaxDeleteSpan is the maximum allowed number of IDs in a single range of messages to delete.
+	defaultMaxDeleteSpan = 1 << 20
 )
 
 // Build timestamp defined by the compiler.
@@ -89,6 +142,8 @@ var globals struct {
 	maxSubscriberCount int
 	// Maximum number of indexable tags.
 	maxTagCount int
+	// Reject client messages with unrecognized fields.
+	strictJSON bool
 }
 
 // Contentx of the configuration file
@@ -116,6 +171,12 @@ type configType struct {
 	// Tags which must be unique, all other tags will be just
 	// indexed without uniqueness enforcement (user discovery)
 	UniqueTags []string `json:"unique_tags"`
+	// Reject client messages which contain unknown fields instead of silently ignoring them.
+	StrictJSON bool `json:"strict_json"`
+	// MIME types accepted in {pub head["mime"]} in addition to the default ones.
+	AllowedMimes []string `json:"allowed_mimes"`
+	// Accept any well-formed MIME type in {pub head["mime"]}.
+	AllowAnyMime bool `json:"allow_any_mime"`
 
 	// Configs for subsystems
 	ClusterConfig json.RawMessage            `json:"cluster_config"`
@@ -191,6 +252,10 @@ func main() {
 	globals.apiKeySalt = config.APIKeySalt
 	// List of indexable tags for user discovery treated as globally unique.
 	globals.uniqueTags = config.UniqueTags
+	// Treat unknown fields in client messages as errors
+	globals.strictJSON = config.StrictJSON
+	// Restrict the types of published content
+	restrictMimes(config.AllowedMimes, config.AllowAnyMime)
 	// Maximum message size
 	globals.maxMessageSize = int64(config.MaxMessageSize)
 	if globals.maxMessageSize <= 0 {
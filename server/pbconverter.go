@@ -40,27 +40,27 @@ func pbServDataSerialize(data *MsgServerData) *pbx.ServerMsg_Data {
 func pbServPresSerialize(pres *MsgServerPres) *pbx.ServerMsg_Pres {
 	var what pbx.ServerPres_What
 	switch pres.What {
-	case "on":
+	case PresOn:
 		what = pbx.ServerPres_ON
-	case "off":
+	case PresOff:
 		what = pbx.ServerPres_OFF
-	case "ua":
+	case PresUA:
 		what = pbx.ServerPres_UA
-	case "upd":
+	case PresUpd:
 		what = pbx.ServerPres_UPD
-	case "gone":
+	case PresGone:
 		what = pbx.ServerPres_GONE
-	case "acs":
+	case PresAcs:
 		what = pbx.ServerPres_ACS
-	case "term":
+	case PresTerm:
 		what = pbx.ServerPres_TERM
-	case "msg":
+	case PresMsg:
 		what = pbx.ServerPres_MSG
-	case "read":
+	case PresRead:
 		what = pbx.ServerPres_READ
-	case "recv":
+	case PresRecv:
 		what = pbx.ServerPres_RECV
-	case "del":
+	case PresDel:
 		what = pbx.ServerPres_DEL
 	default:
 		log.Fatal("Unknown pres.what value", pres.What)
@@ -136,30 +136,30 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			Content:   data.GetContent(),
 		}
 	} else if pres := pkt.GetPres(); pres != nil {
-		var what string
+		var what PresWhat
 		switch pres.GetWhat() {
 		case pbx.ServerPres_ON:
-			what = "on"
+			what = PresOn
 		case pbx.ServerPres_OFF:
-			what = "off"
+			what = PresOff
 		case pbx.ServerPres_UA:
-			what = "ua"
+			what = PresUA
 		case pbx.ServerPres_UPD:
-			what = "upd"
+			what = PresUpd
 		case pbx.ServerPres_GONE:
-			what = "gone"
+			what = PresGone
 		case pbx.ServerPres_ACS:
-			what = "acs"
+			what = PresAcs
 		case pbx.ServerPres_TERM:
-			what = "term"
+			what = PresTerm
 		case pbx.ServerPres_MSG:
-			what = "msg"
+			what = PresMsg
 		case pbx.ServerPres_READ:
-			what = "read"
+			what = PresRead
 		case pbx.ServerPres_RECV:
-			what = "recv"
+			what = PresRecv
 		case pbx.ServerPres_DEL:
-			what = "del"
+			what = PresDel
 		}
 		msg.Pres = &MsgServerPres{
 			Topic:     pres.GetTopic(),
@@ -544,6 +544,15 @@ func pbSetQueryDeserialize(in *pbx.SetQuery) *MsgSetQuery {
 	return &msg
 }
 
+// Checks if the {info what} has a protobuf representation.
+func pbInfoNoteWhatSupported(what string) bool {
+	switch what {
+	case "kp", "read", "recv":
+		return true
+	}
+	return false
+}
+
 func pbInfoNoteWhatSerialize(what string) pbx.InfoNote {
 	var out pbx.InfoNote
 	switch what {
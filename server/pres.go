@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"strings"
+	"time"
 
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
@@ -17,10 +18,15 @@ type PresParams struct {
 
 	// Uid who performed the action
 	actor string
+	// Public data of the actor, if cheaply available
+	actorPublic interface{}
 	// Subject of the action
 	target string
 	dWant  string
 	dGiven string
+
+	// Fields of the description changed by the "upd"
+	changed []string
 }
 
 func (p PresParams) packAcs() *MsgAccessMode {
@@ -30,6 +36,37 @@ func (p PresParams) packAcs() *MsgAccessMode {
 	return nil
 }
 
+// AccessModeDelta returns permission letters gained and lost in the transition from old to new
+// cumulative access mode, e.g. "JRP" -> "JRWS" gives "WS" added and "P" removed.
+// Empty or "N" modes are treated as no access. Invalid modes are treated as no access too.
+func AccessModeDelta(old, new MsgAccessMode) (added, removed string) {
+	o, n := cumulativeMode(old), cumulativeMode(new)
+
+	if a := n &^ o; a != types.ModeNone {
+		added = a.String()
+	}
+	if r := o &^ n; r != types.ModeNone {
+		removed = r.String()
+	}
+	return
+}
+
+// cumulativeMode parses MsgAccessMode.Mode or, if it's missing, Want & Given.
+func cumulativeMode(acs MsgAccessMode) types.AccessMode {
+	parse := func(str string) types.AccessMode {
+		mode := types.ModeNone
+		if err := mode.UnmarshalText([]byte(str)); err != nil {
+			return types.ModeNone
+		}
+		return mode
+	}
+
+	if acs.Mode != "" {
+		return parse(acs.Mode)
+	}
+	return parse(acs.Want) & parse(acs.Given)
+}
+
 // Presence: Add another user to the list of contacts to notify of presence and other changes
 func (t *Topic) addToPerSubs(topic string, online, enabled bool) {
 	if topic == t.name {
@@ -186,7 +223,8 @@ func (t *Topic) presProcReq(fromUserID string, what string, wantReply bool) stri
 		globals.hub.route <- &ServerComMessage{
 			// Topic is 'me' even for group topics; group topics will use 'me' as a signal to drop the message
 			// without forwarding to sessions
-			Pres:   &MsgServerPres{Topic: "me", What: replyAs, Src: t.name, wantReply: reqReply},
+			Pres: &MsgServerPres{Topic: "me", What: PresWhat(replyAs), Src: t.name, wantReply: reqReply,
+				ts: types.TimeNow()},
 			rcptto: fromUserID}
 
 		// log.Printf("presProcReq: topic[%s]: replying to %s with own status='%s', wantReply=%v",
@@ -206,7 +244,8 @@ func (t *Topic) presUsersOfInterest(what string, ua string) {
 	for topic := range t.perSubs {
 		globals.hub.route <- &ServerComMessage{
 			Pres: &MsgServerPres{
-				Topic: "me", What: what, Src: t.name, UserAgent: ua, wantReply: (what == "on")},
+				Topic: "me", What: PresWhat(what), Src: t.name, UserAgent: ua, wantReply: (what == "on"),
+				ts: types.TimeNow()},
 			rcptto: topic}
 
 		// log.Printf("Pres A, B, C, D: User'%s' to '%s' what='%s', ua='%s'", t.name, topic, what, ua)
@@ -214,6 +253,13 @@ func (t *Topic) presUsersOfInterest(what string, ua string) {
 	}
 }
 
+// presUsersOfInterestUpd tells the users of interest that the description of the user has changed.
+func (t *Topic) presUsersOfInterestUpd(changed []string) {
+	for topic := range t.perSubs {
+		globals.hub.route <- &ServerComMessage{Pres: NewUpdPres(t.name, changed), rcptto: topic}
+	}
+}
+
 func (t *Topic) presEnableUser() {
 	if t.cat == types.TopicCatP2P {
 	}
@@ -234,21 +280,24 @@ func (t *Topic) presSubsOnline(what, src string, params *PresParams,
 
 	// If affected user is the same as the user making the change, clear 'who'
 	actor := params.actor
+	actorPublic := params.actorPublic
 	target := params.target
 	if actor == src {
 		actor = ""
+		actorPublic = nil
 	}
 
 	if target == src {
 		target = ""
 	}
 
-	globals.hub.route <- &ServerComMessage{
-		Pres: &MsgServerPres{Topic: t.xoriginal, What: what, Src: src,
-			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target,
-			SeqId: params.seqID, DelId: params.delID, DelSeq: params.delSeq,
-			filter: int(filter), singleUser: singleUser},
-		rcptto: t.name, skipSid: skipSid}
+	pres := &MsgServerPres{Topic: t.xoriginal, What: PresWhat(what), Src: src,
+		Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, ActorPublic: actorPublic,
+		SeqId: params.seqID, DelId: params.delID, DelSeq: params.delSeq,
+		filter: int(filter), ts: types.TimeNow()}
+	pres.SendToUser(singleUser)
+
+	globals.hub.route <- &ServerComMessage{Pres: pres, rcptto: t.name, skipSid: skipSid}
 
 	// log.Printf("Pres K.2, L.3, W.2: topic'%s' what='%s', who='%s', acs='w:%s/g:%s'", t.name, what,
 	// 	params.who, params.dWant, params.dGiven)
@@ -257,7 +306,7 @@ func (t *Topic) presSubsOnline(what, src string, params *PresParams,
 
 // Send presence notification to attached sessions directly, without routing though topic.
 func (t *Topic) presSubsOnlineDirect(what string) {
-	msg := &ServerComMessage{Pres: &MsgServerPres{Topic: t.xoriginal, What: what}}
+	msg := &ServerComMessage{Pres: &MsgServerPres{Topic: t.xoriginal, What: PresWhat(what)}}
 
 	for sess := range t.sessions {
 		// Check presence filters
@@ -303,21 +352,23 @@ func (t *Topic) presSubsOffline(what string, params *PresParams, filter types.Ac
 
 		user := uid.UserId()
 		actor := params.actor
+		actorPublic := params.actorPublic
 		target := params.target
 		if actor == user {
 			actor = ""
+			actorPublic = nil
 		}
 
 		if target == user {
 			target = ""
 		}
 
-		globals.hub.route <- &ServerComMessage{
-			Pres: &MsgServerPres{Topic: "me", What: what, Src: t.original(uid),
-				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target,
-				SeqId: params.seqID, DelId: params.delID,
-				skipTopic: skipTopic},
-			rcptto: user, skipSid: skipSid}
+		pres := &MsgServerPres{Topic: "me", What: PresWhat(what), Src: t.original(uid),
+			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, ActorPublic: actorPublic,
+			SeqId: params.seqID, DelId: params.delID, Changed: params.changed, ts: types.TimeNow()}
+		pres.SkipTopic(skipTopic)
+
+		globals.hub.route <- &ServerComMessage{Pres: pres, rcptto: user, skipSid: skipSid}
 	}
 }
 
@@ -339,9 +390,11 @@ func presSubsOfflineOffline(topic string, cat types.TopicCat, subs []types.Subsc
 
 		user := types.ParseUid(sub.User).UserId()
 		actor := params.actor
+		actorPublic := params.actorPublic
 		target := params.target
 		if actor == user {
 			actor = ""
+			actorPublic = nil
 		}
 
 		if target == user {
@@ -349,9 +402,9 @@ func presSubsOfflineOffline(topic string, cat types.TopicCat, subs []types.Subsc
 		}
 
 		globals.hub.route <- &ServerComMessage{
-			Pres: &MsgServerPres{Topic: "me", What: what, Src: original,
-				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target,
-				SeqId: params.seqID, DelId: params.delID},
+			Pres: &MsgServerPres{Topic: "me", What: PresWhat(what), Src: original,
+				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, ActorPublic: actorPublic,
+				SeqId: params.seqID, DelId: params.delID, ts: types.TimeNow()},
 			rcptto: user, skipSid: skipSid}
 	}
 }
@@ -371,21 +424,25 @@ func (t *Topic) presSingleUserOffline(uid types.Uid, what string, params *PresPa
 	if pud, ok := t.perUser[uid]; ok && presOfflineFilter(pud.modeGiven&pud.modeWant, types.ModeNone) {
 		user := uid.UserId()
 		actor := params.actor
+		actorPublic := params.actorPublic
 		target := params.target
 		if actor == user {
 			actor = ""
+			actorPublic = nil
 		}
 
 		if target == user {
 			target = ""
 		}
 
-		globals.hub.route <- &ServerComMessage{
-			Pres: &MsgServerPres{Topic: "me", What: what,
-				Src: t.original(uid), SeqId: params.seqID, DelId: params.delID,
-				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, UserAgent: params.userAgent,
-				wantReply: strings.HasPrefix(what, "?unkn"), skipTopic: skipTopic},
-			rcptto: user, skipSid: skipSid}
+		pres := &MsgServerPres{Topic: "me", What: PresWhat(what),
+			Src: t.original(uid), SeqId: params.seqID, DelId: params.delID,
+			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, ActorPublic: actorPublic,
+			UserAgent: params.userAgent, Changed: params.changed,
+			wantReply: strings.HasPrefix(what, "?unkn"), ts: types.TimeNow()}
+		pres.SkipTopic(skipTopic)
+
+		globals.hub.route <- &ServerComMessage{Pres: pres, rcptto: user, skipSid: skipSid}
 	}
 
 	// log.Printf("Pres J.1, K, M.1, N: topic'%s' what='%s', who='%s'", t.name, what, who.UserId())
@@ -397,9 +454,11 @@ func presSingleUserOfflineOffline(uid types.Uid, original string, what string,
 
 	user := uid.UserId()
 	actor := params.actor
+	actorPublic := params.actorPublic
 	target := params.target
 	if actor == user {
 		actor = ""
+		actorPublic = nil
 	}
 
 	if target == user {
@@ -407,9 +466,10 @@ func presSingleUserOfflineOffline(uid types.Uid, original string, what string,
 	}
 
 	globals.hub.route <- &ServerComMessage{
-		Pres: &MsgServerPres{Topic: "me", What: what,
+		Pres: &MsgServerPres{Topic: "me", What: PresWhat(what),
 			Src: original, SeqId: params.seqID, DelId: params.delID,
-			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target},
+			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, ActorPublic: actorPublic,
+			ts: types.TimeNow()},
 		rcptto: uid.UserId(), skipSid: skipSid}
 }
 
@@ -430,11 +490,155 @@ func (t *Topic) presPubMessageCount(uid types.Uid, recv, read int, skip string)
 		// Announce to user's other sessions on 'me' only if they are not attached to this topic.
 		// Attached topics will receive an {info}
 		t.presSingleUserOffline(uid, what, &PresParams{seqID: seq}, skip, true)
+
+		// Let the other party of a p2p topic update the read/recv marker of the contact.
+		if t.cat == types.TopicCatP2P {
+			if pres := newP2PSeqPres(what, t.name, uid.UserId(), seq); pres != nil {
+				other := types.ParseUserId(pres.SingleUser())
+				if pud := t.perUser[other]; (pud.modeGiven & pud.modeWant).IsPresencer() {
+					globals.hub.route <- &ServerComMessage{Pres: pres, rcptto: pres.SingleUser()}
+				}
+			}
+		}
 	} else {
 		log.Printf("Case U: topic[%s] invalid request - missing payload", t.name)
 	}
 }
 
+// NewReadPres creates a notification for the 'me' topic of the other party of the p2p topic that
+// fromUser has read messages up to seq. Returns nil if fromUser is not a party of a p2p topic.
+func NewReadPres(topic, fromUser string, seq int) *MsgServerPres {
+	return newP2PSeqPres("read", topic, fromUser, seq)
+}
+
+// newP2PSeqPres creates a "read" or "recv" notification for the 'me' topic of the other party of
+// the p2p topic. The contact is reported as fromUser because that's the name of the p2p topic
+// as seen by the other party.
+func newP2PSeqPres(what, topic, fromUser string, seq int) *MsgServerPres {
+	other, ok := otherP2PUser(topic, fromUser)
+	if !ok {
+		return nil
+	}
+
+	pres := &MsgServerPres{Topic: "me", What: PresWhat(what), Src: fromUser, SeqId: seq}
+	pres.SendToUser(other)
+	return pres
+}
+
+// MsgAccessChange is a record of a change of the access mode for an audit trail.
+type MsgAccessChange struct {
+	// Topic of the {pres} which reported the change
+	Topic string
+	// User who made the change; empty if it's the recipient of the notification
+	Actor string
+	// User whose access mode has changed; empty if it's the recipient of the notification
+	Target string
+	// Access modes before and after the change
+	Old MsgAccessMode
+	New MsgAccessMode
+	// Time when the {pres} was generated
+	At time.Time
+}
+
+// AccessChangeFromPres creates a record of the change of the access mode from an "acs" {pres}.
+// The {pres} reports only the delta, so Old contains just the permissions lost and New just the
+// permissions gained; retained permissions are not known. The Mode is not reported.
+// Returns false if the notification is not an "acs" one.
+func AccessChangeFromPres(p *MsgServerPres) (*MsgAccessChange, bool) {
+	if p == nil || p.What != PresAcs || p.Acs == nil {
+		return nil, false
+	}
+
+	change := &MsgAccessChange{
+		Topic:  p.Topic,
+		Actor:  p.AcsActor,
+		Target: p.AcsTarget,
+		At:     p.ts,
+	}
+	change.New.Want, change.Old.Want = splitModeDelta(p.Acs.Want)
+	change.New.Given, change.Old.Given = splitModeDelta(p.Acs.Given)
+	return change, true
+}
+
+// splitModeDelta splits the delta of access modes such as "+AS-D" into the added "AS" and removed "D"
+// permissions.
+func splitModeDelta(delta string) (added, removed string) {
+	var plus bool
+	for _, r := range delta {
+		switch r {
+		case '+':
+			plus = true
+		case '-':
+			plus = false
+		default:
+			if plus {
+				added += string(r)
+			} else {
+				removed += string(r)
+			}
+		}
+	}
+	return
+}
+
+// coalescePresence collapses rapid "on"/"off" notifications for the same user in the same topic into
+// the net state: an "on" or "off" which follows the previous one for the same user within the window
+// replaces it. The chain is debounced, i.e. on-off-on with gaps shorter than the window results in
+// a single "on". The surviving notification takes the position of the latest one. Other notifications
+// are kept in order. The input is not modified.
+func coalescePresence(events []MsgServerPres, window time.Duration) []MsgServerPres {
+	keep := make([]bool, len(events))
+	// topic + src -> index of the latest "on" or "off".
+	latest := make(map[string]int)
+	for i, ev := range events {
+		keep[i] = true
+		if ev.What != PresOn && ev.What != PresOff {
+			continue
+		}
+		key := ev.Topic + "/" + ev.Src
+		if prev, ok := latest[key]; ok && ev.ts.Sub(events[prev].ts) <= window {
+			keep[prev] = false
+		}
+		latest[key] = i
+	}
+
+	out := make([]MsgServerPres, 0, len(events))
+	for i, ev := range events {
+		if keep[i] {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// presFlush delivers the pending "on" and "off" notifications of the contacts to the sessions of 'me'
+// after collapsing rapid changes of the same contact.
+func (t *Topic) presFlush() {
+	pending := coalescePresence(t.presPending, presCoalesceWindow)
+	t.presPending = nil
+
+	for i := range pending {
+		msg := &ServerComMessage{Pres: &pending[i], timestamp: pending[i].ts}
+		for sess := range t.sessions {
+			pud := t.perUser[sess.uid]
+			if !(pud.modeGiven & pud.modeWant).IsPresencer() {
+				continue
+			}
+			if !sess.queueOut(msg) {
+				log.Printf("topic[%s]: connection stuck, detaching", t.name)
+				t.unreg <- &sessionLeave{sess: sess, unsub: false}
+			}
+		}
+	}
+}
+
+// NewUpdPres creates a notification for the 'me' topic that the description of the topic has changed.
+// The changed lists the updated fields of the description, like "public" or "defacs", so the client
+// can fetch only what's needed.
+func NewUpdPres(topic string, changed []string) *MsgServerPres {
+	return &MsgServerPres{Topic: "me", What: PresUpd, Src: topic, Changed: changed}
+}
+
 // Let other sessions of a given user know that messages are now deleted
 // Cases V.1, V.2
 func (t *Topic) presPubMessageDelete(uid types.Uid, delID int, list []MsgDelRange, skip string) {
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestAccessModeDelta(t *testing.T) {
+	testModes := []struct {
+		old, new       MsgAccessMode
+		added, removed string
+	}{
+		{MsgAccessMode{Mode: "JRP"}, MsgAccessMode{Mode: "JRWS"}, "WS", "P"},
+		{MsgAccessMode{Mode: "JRWP"}, MsgAccessMode{Mode: "JRWP"}, "", ""},
+		{MsgAccessMode{}, MsgAccessMode{Mode: "JRW"}, "JRW", ""},
+		{MsgAccessMode{Mode: "N"}, MsgAccessMode{Mode: "JR"}, "JR", ""},
+		{MsgAccessMode{Mode: "JRWPASDO"}, MsgAccessMode{Mode: "N"}, "", "JRWPASDO"},
+		{MsgAccessMode{Mode: "JRWP"}, MsgAccessMode{}, "", "JRWP"},
+		{MsgAccessMode{Want: "JRWP", Given: "JRW"}, MsgAccessMode{Want: "JRWP", Given: "JRWP"}, "P", ""},
+		{MsgAccessMode{Mode: "JR"}, MsgAccessMode{Mode: "XYZ"}, "", "JR"},
+	}
+
+	for _, tc := range testModes {
+		added, removed := AccessModeDelta(tc.old, tc.new)
+		if added != tc.added || removed != tc.removed {
+			t.Errorf("%+v -> %+v: expecting +'%s' -'%s', got +'%s' -'%s'",
+				tc.old, tc.new, tc.added, tc.removed, added, removed)
+		}
+	}
+}
+
+func TestNewReadPres(t *testing.T) {
+	alice, bob := types.Uid(1234567), types.Uid(7654321)
+	p2p := alice.P2PName(bob)
+
+	pres := NewReadPres(p2p, alice.UserId(), 12)
+	if pres == nil {
+		t.Fatal("expecting a notification")
+	}
+	if pres.Topic != "me" || pres.What != "read" || pres.Src != alice.UserId() || pres.SeqId != 12 {
+		t.Errorf("unexpected notification %+v", pres)
+	}
+	if pres.SingleUser() != bob.UserId() {
+		t.Errorf("expecting delivery to '%s' only, got '%s'", bob.UserId(), pres.SingleUser())
+	}
+
+	if pres := newP2PSeqPres("recv", p2p, bob.UserId(), 3); pres == nil || pres.What != "recv" ||
+		pres.Src != bob.UserId() || pres.SingleUser() != alice.UserId() {
+		t.Errorf("unexpected recv notification %+v", pres)
+	}
+
+	if NewReadPres("grp1XUtEhjv6HND", alice.UserId(), 12) != nil {
+		t.Error("group topics should not produce a notification")
+	}
+	if NewReadPres(p2p, types.Uid(1111).UserId(), 12) != nil {
+		t.Error("a user who is not a party should not produce a notification")
+	}
+}
+
+func TestNewUpdPres(t *testing.T) {
+	pres := NewUpdPres("grp1XUtEhjv6HND", []string{"public", "defacs"})
+	if pres.Topic != "me" || pres.What != "upd" || pres.Src != "grp1XUtEhjv6HND" {
+		t.Errorf("unexpected notification %+v", pres)
+	}
+
+	out, err := json.Marshal(pres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"changed":["public","defacs"]`) {
+		t.Error("expecting the list of changed fields:", string(out))
+	}
+
+	if out, _ = json.Marshal(NewUpdPres("grp1XUtEhjv6HND", nil)); strings.Contains(string(out), "changed") {
+		t.Error("unknown changes should be omitted:", string(out))
+	}
+}
+
+func TestPresWhat(t *testing.T) {
+	out, err := json.Marshal(&MsgServerPres{Topic: "me", Src: "usrAbCdEfGhIjK", What: PresOn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"what":"on"`) {
+		t.Error("expecting what=on, got", string(out))
+	}
+
+	// Decoding maps the wire value back to the constant.
+	var pres MsgServerPres
+	if err := json.Unmarshal([]byte(`{"topic":"me","src":"usrAbCdEfGhIjK","what":"del"}`), &pres); err != nil {
+		t.Fatal(err)
+	}
+	if pres.What != PresDel {
+		t.Error("expecting PresDel, got", pres.What)
+	}
+	if err := json.Unmarshal([]byte(`{"topic":"me","what":"?unkn+en"}`), &pres); err != nil || pres.What != "?unkn+en" {
+		t.Error("expecting internal value to be preserved, got", pres.What)
+	}
+}
+
+func TestCoalescePresence(t *testing.T) {
+	t0 := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	at := func(what PresWhat, src string, offset time.Duration) MsgServerPres {
+		return MsgServerPres{Topic: "me", Src: src, What: what, ts: t0.Add(offset)}
+	}
+	whats := func(events []MsgServerPres) string {
+		var out []string
+		for _, ev := range events {
+			out = append(out, ev.Src+":"+string(ev.What))
+		}
+		return strings.Join(out, " ")
+	}
+
+	testCases := []struct {
+		name     string
+		events   []MsgServerPres
+		expected string
+	}{
+		{"on-off-on within window",
+			[]MsgServerPres{at(PresOn, "usrA", 0), at(PresOff, "usrA", time.Second), at(PresOn, "usrA", 2*time.Second)},
+			"usrA:on"},
+		{"on-off within window",
+			[]MsgServerPres{at(PresOn, "usrA", 0), at(PresOff, "usrA", time.Second)},
+			"usrA:off"},
+		{"outside window",
+			[]MsgServerPres{at(PresOn, "usrA", 0), at(PresOff, "usrA", 10*time.Second)},
+			"usrA:on usrA:off"},
+		{"different users",
+			[]MsgServerPres{at(PresOn, "usrA", 0), at(PresOff, "usrB", time.Second)},
+			"usrA:on usrB:off"},
+		{"other notifications are kept in order",
+			[]MsgServerPres{at(PresOn, "usrA", 0), at(PresMsg, "usrB", time.Second), at(PresOff, "usrA", 2*time.Second)},
+			"usrB:msg usrA:off"},
+		{"empty", nil, ""},
+	}
+
+	for _, tc := range testCases {
+		var orig []MsgServerPres
+		orig = append(orig, tc.events...)
+		if got := whats(coalescePresence(tc.events, 5*time.Second)); got != tc.expected {
+			t.Errorf("%s: expecting '%s', got '%s'", tc.name, tc.expected, got)
+		}
+		if whats(tc.events) != whats(orig) {
+			t.Errorf("%s: input must not be modified", tc.name)
+		}
+	}
+}
+
+func TestPresTimestamp(t *testing.T) {
+	defer func(hub *Hub) { globals.hub = hub }(globals.hub)
+	globals.hub = &Hub{route: make(chan *ServerComMessage, 2)}
+
+	topic := &Topic{name: "usrAbCdEfGhIjK", cat: types.TopicCatMe,
+		perSubs: map[string]perSubsData{"usrRkDVe0PYDOo": {}}}
+	topic.presUsersOfInterest("on", "")
+	topic.presUsersOfInterest("off", "")
+
+	events := []MsgServerPres{*(<-globals.hub.route).Pres, *(<-globals.hub.route).Pres}
+	for _, ev := range events {
+		if ev.ts.IsZero() {
+			t.Errorf("'%s' must have the time it was generated", ev.What)
+		}
+	}
+	if got := coalescePresence(events, time.Minute); len(got) != 1 || got[0].What != PresOff {
+		t.Errorf("expecting the generated on-off to collapse to 'off', got %v", got)
+	}
+}
+
+func TestPresFlush(t *testing.T) {
+	t0 := time.Now()
+	sess := &Session{send: make(chan interface{}, 4)}
+	topic := &Topic{name: "usrAbCdEfGhIjK", cat: types.TopicCatMe,
+		sessions: map[*Session]bool{sess: true},
+		perUser:  map[types.Uid]perUserData{sess.uid: {modeWant: types.ModeCSelf, modeGiven: types.ModeCSelf}},
+		presPending: []MsgServerPres{
+			{Topic: "me", Src: "usrRkDVe0PYDOo", What: PresOn, ts: t0},
+			{Topic: "me", Src: "usrRkDVe0PYDOo", What: PresOff, ts: t0.Add(time.Second)},
+			{Topic: "me", Src: "usrRkDVe0PYDOo", What: PresOn, ts: t0.Add(2 * time.Second)},
+			{Topic: "me", Src: "usr1XUtEhjv6HN", What: PresOff, ts: t0.Add(2 * time.Second)},
+		}}
+
+	topic.presFlush()
+	if len(topic.presPending) != 0 {
+		t.Error("pending notifications must be cleared")
+	}
+	if len(sess.send) != 2 {
+		t.Fatalf("expecting 2 notifications, got %d", len(sess.send))
+	}
+	for _, expected := range []string{`"src":"usrRkDVe0PYDOo","what":"on"`, `"src":"usr1XUtEhjv6HN","what":"off"`} {
+		if out := string((<-sess.send).([]byte)); !strings.Contains(out, expected) {
+			t.Errorf("expecting '%s', got '%s'", expected, out)
+		}
+	}
+}
+
+func TestAccessChangeFromPres(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	pres := &MsgServerPres{Topic: "grp1XUtEhjv6HND", Src: "usrRkDVe0PYDOo", What: PresAcs,
+		AcsActor: "usrAbCdEfGhIjK", AcsTarget: "usrRkDVe0PYDOo",
+		Acs: &MsgAccessMode{Want: "+AS-D", Given: "-W"}, ts: ts}
+
+	change, ok := AccessChangeFromPres(pres)
+	if !ok {
+		t.Fatal("expecting an access change")
+	}
+	if change.Topic != "grp1XUtEhjv6HND" || change.Actor != "usrAbCdEfGhIjK" || change.Target != "usrRkDVe0PYDOo" {
+		t.Errorf("unexpected change %+v", change)
+	}
+	if change.New.Want != "AS" || change.Old.Want != "D" || change.New.Given != "" || change.Old.Given != "W" {
+		t.Errorf("unexpected modes: old %+v, new %+v", change.Old, change.New)
+	}
+	if !change.At.Equal(ts) {
+		t.Error("expecting the time of the notification, got", change.At)
+	}
+
+	for _, pres := range []*MsgServerPres{
+		nil,
+		{Topic: "me", Src: "grp1XUtEhjv6HND", What: PresOn},
+		{Topic: "me", Src: "grp1XUtEhjv6HND", What: PresUpd, Acs: &MsgAccessMode{Want: "+W"}},
+		{Topic: "me", Src: "grp1XUtEhjv6HND", What: PresAcs},
+	} {
+		if _, ok := AccessChangeFromPres(pres); ok {
+			t.Errorf("%+v: should not be an access change", pres)
+		}
+	}
+}
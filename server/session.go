@@ -10,8 +10,12 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"strings"
@@ -35,6 +39,7 @@ const (
 )
 
 var minSupportedVersionValue = parseVersion(minSupportedVersion)
+var minCompatibleVersionValue = parseVersion(minCompatibleVersion)
 
 // Session represents a single WS connection or a long polling session. A user may have multiple
 // sessions.
@@ -67,6 +72,8 @@ type Session struct {
 	deviceID string
 	// Human language of the client
 	lang string
+	// Stored messages are sent as {databatch}
+	dataBatch bool
 
 	// ID of the current user or 0
 	uid types.Uid
@@ -126,6 +133,13 @@ func (s *Session) queueOut(msg *ServerComMessage) bool {
 		return true
 	}
 
+	if s.proto == GRPC && msg.Info != nil && !pbInfoNoteWhatSupported(msg.Info.What) {
+		// Protobuf has no representation for this {info}, skip it.
+		return true
+	}
+
+	msg.ClearTopicIfEmpty()
+
 	select {
 	case s.send <- s.serialize(msg):
 	case <-time.After(time.Microsecond * 50):
@@ -162,20 +176,48 @@ func (s *Session) cleanUp() {
 	}
 }
 
+// isActive checks if the session received a message from the client within activeSessionWindow before now.
+func (s *Session) isActive(now time.Time) bool {
+	return !s.lastAction.IsZero() && now.Sub(s.lastAction) <= activeSessionWindow
+}
+
 // Message received, convert bytes to ClientComMessage and dispatch
 func (s *Session) dispatchRaw(raw []byte) {
-	var msg ClientComMessage
-
 	log.Printf("Session.dispatch got '%s' from '%s'", raw, s.remoteAddr)
 
-	if err := json.Unmarshal(raw, &msg); err != nil {
+	msg, err := DecodeClientMessage(raw, globals.strictJSON)
+	if err != nil {
 		// Malformed message
 		log.Println("Session.dispatch: " + err.Error())
 		s.queueOut(ErrMalformed("", "", time.Now().UTC().Round(time.Millisecond)))
 		return
 	}
 
-	s.dispatch(&msg)
+	s.dispatch(msg)
+}
+
+// DecodeClientMessage parses a JSON-formatted client message. In strict mode fields which are
+// not part of the protocol are treated as errors, otherwise they are ignored.
+func DecodeClientMessage(data []byte, strict bool) (*ClientComMessage, error) {
+	var msg ClientComMessage
+
+	if !strict {
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&msg); err != nil {
+		return nil, errors.New("strict decoding of client message failed: " + err.Error())
+	}
+	// Make sure there is nothing but whitespace after the message, same as json.Unmarshal.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("strict decoding of client message failed: unexpected data after message")
+	}
+	return &msg, nil
 }
 
 func (s *Session) dispatch(msg *ClientComMessage) {
@@ -343,19 +385,61 @@ func (s *Session) publish(msg *ClientComMessage) {
 		return
 	}
 
-	data := &ServerComMessage{Data: &MsgServerData{
-		Topic:     msg.Pub.Topic,
-		From:      msg.from,
-		Timestamp: msg.timestamp,
-		Head:      msg.Pub.Head,
-		Content:   msg.Pub.Content},
-		rcptto: expanded, sessFrom: s, id: msg.Pub.Id, timestamp: msg.timestamp}
-	if msg.Pub.NoEcho {
-		data.skipSid = s.sid
+	if err := validateHeadLimits(msg.Pub.Head, maxHeadKeys, maxHeadValueLength); err != nil {
+		log.Println("s.publish:", err)
+		s.queueOut(ErrPolicy(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+		return
 	}
 
+	if msg.Pub.SendAt != nil && msg.Pub.SendAt.After(msg.timestamp.Add(maxScheduleAhead)) {
+		log.Println("s.publish: scheduled too far ahead", msg.Pub.SendAt)
+		s.queueOut(ErrPolicy(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+		return
+	}
+
+	if err := validateContentDepth(msg.Pub.Content, maxContentDepth); err != nil {
+		log.Println("s.publish:", err)
+		s.queueOut(ErrMalformed(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+		return
+	}
+
+	if contentSanitizer != nil {
+		content, err := contentSanitizer.Sanitize(msg.Pub.Content)
+		if err != nil {
+			log.Println("s.publish: content rejected by sanitizer", err)
+			s.queueOut(ErrMalformed(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+			return
+		}
+		msg.Pub.Content = content
+	}
+
+	head := filterHeadForDelivery(normalizeHead(msg.Pub.Head))
+	if mimeType, ok := head["mime"]; ok && !IsAllowedMime(mimeType) {
+		log.Println("s.publish: unsupported mime", mimeType)
+		s.queueOut(ErrUnsupportedMediaType(msg.Pub.Id, msg.Pub.Topic, msg.timestamp))
+		return
+	}
+	if msg.Pub.ExpireOnRead {
+		if head == nil {
+			head = make(map[string]string)
+		}
+		head[headerExpireOnRead] = "1"
+	}
+
+	data := &ServerComMessage{Data: &MsgServerData{
+		Topic:        msg.Pub.Topic,
+		From:         msg.from,
+		Timestamp:    msg.timestamp,
+		Head:         head,
+		Content:      msg.Pub.Content,
+		Silent:       msg.Pub.Silent,
+		ExpireOnRead: msg.Pub.ExpireOnRead,
+		Draft:        msg.Pub.Draft},
+		rcptto: expanded, sessFrom: s, id: msg.Pub.Id, timestamp: msg.timestamp, pub: msg.Pub}
+
 	if sub, ok := s.subs[expanded]; ok {
-		// This is a post to a subscribed topic. The message is sent to the topic only
+		// This is a post to a subscribed topic. The message is sent to the topic only. Scheduled
+		// messages are held by the topic until due.
 		sub.broadcast <- data
 	} else if globals.cluster.isRemoteTopic(expanded) {
 		// The topic is handled by a remote node. Forward message to it.
@@ -376,7 +460,14 @@ func (s *Session) hello(msg *ClientComMessage) {
 		return
 	}
 
-	var params map[string]interface{}
+	if !msg.Hi.ValidTz() {
+		errMsg := ErrMalformed(msg.Hi.Id, "", msg.timestamp)
+		errMsg.Ctrl.Params = map[string]string{"what": "tz"}
+		s.queueOut(errMsg)
+		return
+	}
+
+	var params *MsgServerHiParams
 
 	if s.ver == 0 {
 		s.ver = parseVersion(msg.Hi.Version)
@@ -385,12 +476,27 @@ func (s *Session) hello(msg *ClientComMessage) {
 			return
 		}
 		// Check version compatibility
-		if versionCompare(s.ver, minSupportedVersionValue) < 0 {
+		if versionCompare(s.ver, minCompatibleVersionValue) < 0 {
 			s.ver = 0
 			s.queueOut(ErrVersionNotSupported(msg.Hi.Id, "", msg.timestamp))
 			return
 		}
-		params = map[string]interface{}{"ver": currentVersion, "build": buildstamp}
+		if versionCompare(s.ver, minSupportedVersionValue) < 0 {
+			s.ver = 0
+			s.queueOut(ErrUpgradeRequired(msg.Hi.Id, "", minSupportedVersion, msg.timestamp))
+			return
+		}
+		params = &MsgServerHiParams{
+			Ver:                currentVersion,
+			Build:              buildstamp,
+			MaxMessageSize:     globals.maxMessageSize,
+			MaxSubscriberCount: globals.maxSubscriberCount,
+			MaxBatchSize:       maxBatchSize,
+		}
+
+		// The batch has no protobuf representation.
+		s.dataBatch = msg.Hi.DataBatch && s.proto != GRPC
+		params.DataBatch = s.dataBatch
 
 	} else if msg.Hi.Version == "" || parseVersion(msg.Hi.Version) == s.ver {
 		// Save changed device ID or Lang.
@@ -415,24 +521,58 @@ func (s *Session) hello(msg *ClientComMessage) {
 	s.deviceID = msg.Hi.DeviceID
 	s.lang = msg.Hi.Lang
 
-	var httpStatus int
-	var httpStatusText string
+	// Invalid or expired token is not an error: the session simply remains unauthenticated.
+	if params != nil && msg.Hi.WantsResume() && s.uid.IsZero() && s.resume(msg.Hi.SessionToken, msg.timestamp) {
+		params.User = s.uid.UserId()
+		params.AuthLevel = auth.AuthLevelName(s.authLvl)
+	}
+
+	httpStatus := http.StatusCreated
 	if s.proto == LPOLL {
 		// In case of long polling StatusCreated was reported earlier.
 		httpStatus = http.StatusOK
-		httpStatusText = "ok"
+	}
 
-	} else {
-		httpStatus = http.StatusCreated
-		httpStatusText = "created"
+	s.queueOut(NoErrHi(msg.Hi.Id, httpStatus, params, msg.timestamp))
+}
+
+// resume authenticates the session with a token issued to an earlier session.
+func (s *Session) resume(token string, now time.Time) bool {
+	secret, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return false
 	}
 
-	// fix null printed value in params
-	ctrl := &MsgServerCtrl{Id: msg.Hi.Id, Code: httpStatus, Text: httpStatusText, Timestamp: msg.timestamp}
-	if len(params) > 0 {
-		ctrl.Params = params
+	handler := store.GetAuthHandler("token")
+	if handler == nil {
+		return false
+	}
+
+	uid, authLvl, _, authErr := handler.Authenticate(secret)
+	if authErr.IsError() || uid.IsZero() {
+		log.Println("s.resume: token rejected", authErr.Err)
+		return false
+	}
+
+	s.authenticated(uid, authLvl, now)
+	return true
+}
+
+// authenticated binds the session to the user who has just logged in or resumed the session and
+// records the device used in this session.
+func (s *Session) authenticated(uid types.Uid, authLvl int, now time.Time) {
+	s.uid = uid
+	s.authLvl = authLvl
+
+	// Record deviceId used in this session
+	if s.deviceID != "" {
+		store.Devices.Update(uid, "", &types.DeviceDef{
+			DeviceId: s.deviceID,
+			Platform: "",
+			LastSeen: now,
+			Lang:     s.lang,
+		})
 	}
-	s.queueOut(&ServerComMessage{Ctrl: ctrl})
 }
 
 // Authenticate
@@ -448,12 +588,29 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
-	handler := store.GetAuthHandler(msg.Login.Scheme)
+	var handler auth.AuthHandler
+	if validAuthScheme(msg.Login.Scheme) {
+		handler = store.GetAuthHandler(msg.Login.Scheme)
+	}
 	if handler == nil {
 		s.queueOut(ErrAuthUnknownScheme(msg.Login.Id, "", msg.timestamp))
 		return
 	}
 
+	if challenger, ok := handler.(auth.Challenger); ok {
+		// Multi-step scheme: the secret is incomplete until the client responds to the challenge.
+		challenge, authErr := challenger.Challenge(msg.Login.Secret)
+		if authErr.IsError() {
+			log.Println("auth challenge", authErr.Err)
+			s.queueOut(decodeAuthError(authErr.Code, msg.Login.Id, msg.timestamp))
+			return
+		}
+		if challenge != nil {
+			s.queueOut(InfoChallenge(msg.Login.Id, challenge, msg.timestamp))
+			return
+		}
+	}
+
 	uid, authLvl, expires, authErr := handler.Authenticate(msg.Login.Secret)
 	if authErr.IsError() {
 		log.Println("auth result", authErr.Err)
@@ -476,8 +633,7 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
-	s.uid = uid
-	s.authLvl = authLvl
+	s.authenticated(uid, authLvl, msg.timestamp)
 
 	if msg.Login.Scheme != "token" {
 		handler = store.GetAuthHandler("token")
@@ -494,16 +650,6 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
-	// Record deviceId used in this session
-	if s.deviceID != "" {
-		store.Devices.Update(uid, "", &types.DeviceDef{
-			DeviceId: s.deviceID,
-			Platform: "",
-			LastSeen: msg.timestamp,
-			Lang:     s.lang,
-		})
-	}
-
 	resp := NoErr(msg.Login.Id, "", msg.timestamp)
 	resp.Ctrl.Params = map[string]interface{}{"user": uid.UserId(), "token": secret, "expires": expires}
 	s.queueOut(resp)
@@ -517,6 +663,18 @@ func (s *Session) acc(msg *ClientComMessage) {
 		return
 	}
 
+	if strings.HasPrefix(msg.Acc.User, "new") {
+		if errMsg := validateAccSecret(msg.Acc, msg.timestamp); errMsg != nil {
+			s.queueOut(errMsg)
+			return
+		}
+	}
+
+	if msg.Acc.Scheme != "" && !validAuthScheme(msg.Acc.Scheme) {
+		s.queueOut(ErrAuthUnknownScheme(msg.Acc.Id, "", msg.timestamp))
+		return
+	}
+
 	authhdl := store.GetAuthHandler(msg.Acc.Scheme)
 	if strings.HasPrefix(msg.Acc.User, "new") {
 		log.Println("Creating new account")
@@ -544,6 +702,11 @@ func (s *Session) acc(msg *ClientComMessage) {
 			return
 		}
 
+		if errMsg := validateAccDesc(msg.Acc, msg.timestamp); errMsg != nil {
+			s.queueOut(errMsg)
+			return
+		}
+
 		var user types.User
 		var private interface{}
 
@@ -578,8 +741,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 		}
 
 		if len(msg.Acc.Tags) > 0 {
-			var tags []string
-			if tags = normalizeTags(tags, msg.Acc.Tags); len(tags) > 0 {
+			if tags := normalizeTags(msg.Acc.Tags); len(tags) > 0 {
 				user.Tags = tags
 			}
 		}
@@ -670,6 +832,66 @@ func (s *Session) acc(msg *ClientComMessage) {
 	}
 }
 
+// validateAccDesc checks the {acc desc} and tags of a new account. The tags are checked against the
+// credentials only if the credentials are provided. It returns an error message naming the offending
+// field or nil if the desc is valid.
+func validateAccDesc(acc *MsgClientAcc, ts time.Time) *ServerComMessage {
+	if len(acc.Cred) > 0 {
+		if err := acc.ValidateConsistency(); err != nil {
+			log.Println("s.acc:", err)
+			errMsg := ErrMalformed(acc.Id, "", ts)
+			errMsg.Ctrl.Params = map[string]string{"what": "tags"}
+			return errMsg
+		}
+	}
+
+	if acc.Desc == nil || acc.Desc.DefaultAcs == nil {
+		return nil
+	}
+
+	if err := acc.Desc.DefaultAcs.Validate(); err != nil {
+		log.Println("s.acc:", err)
+		field := "defacs"
+		if acsErr, ok := err.(*defaultAcsError); ok {
+			field += "." + acsErr.field
+		}
+		errMsg := ErrMalformed(acc.Id, "", ts)
+		errMsg.Ctrl.Params = map[string]string{"what": field}
+		return errMsg
+	}
+	return nil
+}
+
+// validateAccSecret checks that a new account has a secret unless it's anonymous. Accounts created
+// from credentials alone are rejected as not implemented: the server cannot verify the credentials,
+// and an unverified email or phone number would let anyone claim someone else's. It returns an error
+// message naming the offending field or nil if the {acc} is valid.
+func validateAccSecret(acc *MsgClientAcc, ts time.Time) *ServerComMessage {
+	var errMsg *ServerComMessage
+	var field string
+	switch {
+	case acc.Scheme == "anonymous":
+		// Anonymous accounts have no secret.
+	case acc.IsCredentialOnly():
+		field = "cred"
+		errMsg = ErrNotImplemented(acc.Id, "", ts)
+		for _, cred := range acc.Cred {
+			if cred.Method == "" || cred.Value == "" {
+				errMsg = ErrMalformed(acc.Id, "", ts)
+				break
+			}
+		}
+	case len(acc.Secret) == 0:
+		field = "secret"
+		errMsg = ErrMalformed(acc.Id, "", ts)
+	}
+
+	if errMsg != nil {
+		errMsg.Ctrl.Params = map[string]string{"what": field}
+	}
+	return errMsg
+}
+
 func (s *Session) get(msg *ClientComMessage) {
 	log.Println("s.get: processing 'get." + msg.Get.What + "'")
 
@@ -692,9 +914,11 @@ func (s *Session) get(msg *ClientComMessage) {
 		sess:  s,
 		what:  parseMsgClientMeta(msg.Get.What)}
 
-	if meta.what == 0 {
-		s.queueOut(ErrMalformed(msg.Get.Id, msg.Get.Topic, msg.timestamp))
-		log.Println("s.get: invalid Get message action: '" + msg.Get.What + "'")
+	if msg.Get.IsEmpty() {
+		errMsg := ErrMalformed(msg.Get.Id, msg.Get.Topic, msg.timestamp)
+		errMsg.Ctrl.Params = map[string]string{"reason": "nothing_requested"}
+		s.queueOut(errMsg)
+		log.Println("s.get: nothing requested: '" + msg.Get.What + "'")
 	} else if ok {
 		sub.meta <- meta
 	} else if globals.cluster.isRemoteTopic(expanded) {
@@ -740,6 +964,24 @@ func (s *Session) set(msg *ClientComMessage) {
 		if msg.Set.Sub != nil {
 			meta.what |= constMsgMetaSub
 		}
+		if len(msg.Set.Users) > 0 {
+			// Either a single change or a batch, not both.
+			if msg.Set.Sub != nil {
+				s.queueOut(ErrMalformed(msg.Set.Id, msg.Set.Topic, msg.timestamp))
+				return
+			}
+			if err := validateBatchSize(len(msg.Set.Users), maxBatchSize); err != nil {
+				log.Println("s.set:", err)
+				s.queueOut(ErrPolicy(msg.Set.Id, msg.Set.Topic, msg.timestamp))
+				return
+			}
+			if err := validateSetSubs(msg.Set.Users); err != nil {
+				log.Println("s.set:", err)
+				s.queueOut(ErrMalformed(msg.Set.Id, msg.Set.Topic, msg.timestamp))
+				return
+			}
+			meta.what |= constMsgMetaSub
+		}
 		if msg.Set.Tags != nil {
 			meta.what |= constMsgMetaTags
 		}
@@ -776,12 +1018,18 @@ func (s *Session) del(msg *ClientComMessage) {
 		return
 	}
 
-	what := parseMsgClientDel(msg.Del.What)
-	if what == 0 {
-		s.queueOut(ErrMalformed(msg.Del.Id, msg.Del.Topic, msg.timestamp))
-		log.Println("s.del: invalid Del action '" + msg.Del.What + "'")
+	if err := msg.Del.Validate(defaultMaxDeleteRanges, defaultMaxDeleteSpan); err != nil {
+		if err == errDelTooBig {
+			s.queueOut(ErrPolicy(msg.Del.Id, msg.Del.Topic, msg.timestamp))
+		} else {
+			s.queueOut(ErrMalformed(msg.Del.Id, msg.Del.Topic, msg.timestamp))
+		}
+		log.Println("s.del: invalid Del request '" + msg.Del.What + "': " + err.Error())
+		return
 	}
 
+	what := parseMsgClientDel(msg.Del.What)
+
 	sub, ok := s.subs[expanded]
 	if ok && what != constMsgDelTopic {
 		// Session is attached, deleting subscription or messages. Send to topic.
@@ -825,26 +1073,19 @@ func (s *Session) note(msg *ClientComMessage) {
 		return
 	}
 
-	switch msg.Note.What {
-	case "kp":
-		if msg.Note.SeqId != 0 {
-			return
-		}
-	case "read", "recv":
-		if msg.Note.SeqId <= 0 {
-			return
-		}
-	default:
+	if !validNoteWhat(msg.Note) {
 		return
 	}
 
 	if sub, ok := s.subs[expanded]; ok {
 		// Pings can be sent to subscribed topics only
 		sub.broadcast <- &ServerComMessage{Info: &MsgServerInfo{
-			Topic: msg.Note.Topic,
-			From:  s.uid.UserId(),
-			What:  msg.Note.What,
-			SeqId: msg.Note.SeqId,
+			Topic:   msg.Note.Topic,
+			From:    s.uid.UserId(),
+			What:    msg.Note.What,
+			SeqId:   msg.Note.MaxSeqId(),
+			Value:   msg.Note.Value,
+			Payload: msg.Note.Payload,
 		}, rcptto: expanded, timestamp: msg.timestamp, skipSid: s.sid}
 	} else if globals.cluster.isRemoteTopic(expanded) {
 		// The topic is handled by a remote node. Forward message to it.
@@ -863,9 +1104,14 @@ func (s *Session) validateTopicName(msgID, topic string, timestamp time.Time) (s
 		return "", ErrMalformed(msgID, "", timestamp)
 	}
 
+	if err := ValidateTopicName(topic); err != nil {
+		return "", ErrMalformed(msgID, topic, timestamp)
+	}
+
 	if !strings.HasPrefix(topic, "grp") && s.uid.IsZero() {
-		// me, fnd, p2p topics require authentication
-		return "", ErrAuthRequired(msgID, topic, timestamp)
+		// me, fnd, p2p topics require authentication. It's the session which is not authenticated,
+		// the topic is irrelevant.
+		return "", ErrAuthRequired(msgID, sessionScopedTopic, timestamp)
 	}
 
 	// Topic to route to i.e. rcptto: or s.subs[routeTo]
@@ -944,3 +1190,35 @@ func decodeAuthError(code int, id string, timestamp time.Time) *ServerComMessage
 	}
 	return errmsg
 }
+
+// ContentSanitizer cleans up content of {pub} messages before they are stored and distributed,
+// i.e. strips dangerous HTML or script from rich text.
+type ContentSanitizer interface {
+	// Sanitize returns a safe copy of the content or an error if the content must be rejected.
+	Sanitize(content interface{}) (interface{}, error)
+}
+
+var contentSanitizer ContentSanitizer
+
+// SetContentSanitizer installs the sanitizer for published content. Passing nil disables sanitizing.
+// It's not safe for concurrent use and must be called before the server starts accepting connections.
+func SetContentSanitizer(s ContentSanitizer) {
+	contentSanitizer = s
+}
+
+// Auth schemes accepted in {login} and {acc}: the built-in ones and those added by RegisterAuthScheme.
+var authSchemes = map[string]bool{"basic": true, "token": true, "anonymous": true}
+
+// RegisterAuthScheme makes the scheme acceptable in {login} and {acc}. The scheme's handler must be
+// registered with the store too. Must be called before the server starts serving requests.
+func RegisterAuthScheme(name string) {
+	if name == "" {
+		panic("RegisterAuthScheme: scheme name is empty")
+	}
+	authSchemes[name] = true
+}
+
+// validAuthScheme checks if the scheme is one of the known auth schemes.
+func validAuthScheme(scheme string) bool {
+	return authSchemes[scheme]
+}
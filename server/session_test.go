@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestValidAuthScheme(t *testing.T) {
+	for _, scheme := range []string{"basic", "token", "anonymous"} {
+		if !validAuthScheme(scheme) {
+			t.Errorf("Built-in scheme '%s' must be valid", scheme)
+		}
+	}
+
+	for _, scheme := range []string{"", "Basic", "oauth"} {
+		if validAuthScheme(scheme) {
+			t.Errorf("Scheme '%s' must be invalid", scheme)
+		}
+	}
+
+	RegisterAuthScheme("test-oauth")
+	if !validAuthScheme("test-oauth") {
+		t.Error("Registered scheme must be valid")
+	}
+}
+
+type upperSanitizer struct{}
+
+func (upperSanitizer) Sanitize(content interface{}) (interface{}, error) {
+	if text, ok := content.(string); ok {
+		return strings.ToUpper(text), nil
+	}
+	return nil, errors.New("unsupported content")
+}
+
+func TestContentSanitizer(t *testing.T) {
+	defer SetContentSanitizer(nil)
+
+	broadcast := make(chan *ServerComMessage, 1)
+	sess := &Session{ver: 1, send: make(chan interface{}, 1),
+		subs: map[string]*Subscription{"grp1XUtEhjv6HND": {broadcast: broadcast}}}
+	pub := func(content interface{}) *ClientComMessage {
+		return &ClientComMessage{Pub: &MsgClientPub{Id: "1", Topic: "grp1XUtEhjv6HND", Content: content},
+			timestamp: time.Now()}
+	}
+
+	// No sanitizer installed: content is passed as is.
+	sess.publish(pub("hello"))
+	if msg := <-broadcast; msg.Data.Content != "hello" {
+		t.Errorf("Expecting unchanged content, got '%v'", msg.Data.Content)
+	}
+
+	SetContentSanitizer(upperSanitizer{})
+	sess.publish(pub("hello"))
+	if msg := <-broadcast; msg.Data.Content != "HELLO" {
+		t.Errorf("Expecting sanitized content, got '%v'", msg.Data.Content)
+	}
+
+	// Rejected content is not forwarded to the topic.
+	sess.publish(pub(42))
+	select {
+	case msg := <-broadcast:
+		t.Errorf("Rejected content must not be published, got '%v'", msg.Data.Content)
+	default:
+	}
+	if reply := string((<-sess.send).([]byte)); !strings.Contains(reply, `"code":400`) {
+		t.Errorf("Expecting malformed error, got '%s'", reply)
+	}
+}
+
+func TestPublishMime(t *testing.T) {
+	broadcast := make(chan *ServerComMessage, 1)
+	sess := &Session{ver: 1, send: make(chan interface{}, 1),
+		subs: map[string]*Subscription{"grp1XUtEhjv6HND": {broadcast: broadcast}}}
+	pub := func(mime string) *ClientComMessage {
+		return &ClientComMessage{Pub: &MsgClientPub{Id: "1", Topic: "grp1XUtEhjv6HND", Content: "hi",
+			Head: map[string]string{"Mime": mime}}, timestamp: time.Now()}
+	}
+
+	defer func() { mimeRestricted = false }()
+	mimeRestricted = true
+
+	sess.publish(pub("text/x-drafty"))
+	if msg := <-broadcast; msg.Data.Head["mime"] != "text/x-drafty" {
+		t.Errorf("Expecting allowed mime to be published, got %v", msg.Data.Head)
+	}
+
+	sess.publish(pub("text/html"))
+	select {
+	case msg := <-broadcast:
+		t.Errorf("Unsupported mime must not be published, got %v", msg.Data.Head)
+	default:
+	}
+	if reply := string((<-sess.send).([]byte)); !strings.Contains(reply, `"code":415`) {
+		t.Errorf("Expecting unsupported media type error, got '%s'", reply)
+	}
+}
+
+func TestSessionStoreBroadcast(t *testing.T) {
+	ss := NewSessionStore(time.Minute)
+	ws := &Session{sid: "s1", proto: WEBSOCK, send: make(chan interface{}, 1)}
+	grpc := &Session{sid: "s2", proto: GRPC, send: make(chan interface{}, 1)}
+	remote := &Session{sid: "s3", proto: CLUSTER, send: make(chan interface{}, 1)}
+	for _, s := range []*Session{ws, grpc, remote} {
+		ss.sessCache[s.sid] = s
+	}
+
+	ss.Broadcast(NewBroadcastNotice("maintenance", time.Now()))
+	for _, s := range []*Session{ws, grpc} {
+		if len(s.send) != 1 {
+			t.Errorf("%s: expecting the notice", s.sid)
+		}
+	}
+	if len(remote.send) != 0 {
+		t.Error("clustered session must be skipped")
+	}
+}
+
+func TestGetNothingRequested(t *testing.T) {
+	sess := &Session{ver: 1, uid: types.Uid(1), send: make(chan interface{}, 1)}
+	sess.get(&ClientComMessage{Get: &MsgClientGet{Id: "1", Topic: "me", MsgGetQuery: MsgGetQuery{What: "bogus"}},
+		timestamp: time.Now()})
+	reply := string((<-sess.send).([]byte))
+	if !strings.Contains(reply, `"params":{"reason":"nothing_requested"},"code":400`) {
+		t.Errorf("Expecting malformed error, got '%s'", reply)
+	}
+}
+
+func TestDecodeClientMessage(t *testing.T) {
+	valid := []byte(`{"pub":{"id":"1","topic":"grp1XUtEhjv6HND","content":{"text":"hi","extra":1}}}`)
+	typo := []byte(`{"pub":{"id":"1","topik":"grp1XUtEhjv6HND","content":"hi"}}`)
+
+	for _, strict := range []bool{false, true} {
+		msg, err := DecodeClientMessage(valid, strict)
+		if err != nil {
+			t.Fatalf("Strict %v: valid message rejected: %v", strict, err)
+		}
+		if msg.Pub == nil || msg.Pub.Topic != "grp1XUtEhjv6HND" {
+			t.Errorf("Strict %v: unexpected message %+v", strict, msg)
+		}
+
+		if _, err = DecodeClientMessage([]byte(`{"pub":`), strict); err == nil {
+			t.Errorf("Strict %v: truncated message must be rejected", strict)
+		}
+		if _, err = DecodeClientMessage([]byte(`{"pub":{}} {}`), strict); err == nil {
+			t.Errorf("Strict %v: trailing data must be rejected", strict)
+		}
+	}
+
+	msg, err := DecodeClientMessage(typo, false)
+	if err != nil {
+		t.Fatalf("Unknown field must be ignored in non-strict mode: %v", err)
+	}
+	if msg.Pub.Topic != "" {
+		t.Errorf("Misspelled field must not be assigned, got '%s'", msg.Pub.Topic)
+	}
+
+	if _, err = DecodeClientMessage(typo, true); err == nil || !strings.Contains(err.Error(), "topik") {
+		t.Errorf("Strict mode must report the unknown field, got %v", err)
+	}
+}
+
+// otpAuth is an auth handler which requires a challenge round trip: the secret "+17025550001"
+// is incomplete, the secret "+17025550001:<code>" completes the login.
+type otpAuth struct{}
+
+func (otpAuth) Init(string) error { return nil }
+func (otpAuth) AddRecord(types.Uid, []byte, time.Duration) (int, auth.AuthErr) {
+	return 0, auth.NewErr(auth.ErrUnsupported, nil)
+}
+func (otpAuth) UpdateRecord(types.Uid, []byte, time.Duration) auth.AuthErr {
+	return auth.NewErr(auth.ErrUnsupported, nil)
+}
+func (otpAuth) Authenticate(secret []byte) (types.Uid, int, time.Time, auth.AuthErr) {
+	return types.ZeroUid, 0, time.Time{}, auth.NewErr(auth.ErrFailed, errors.New("wrong code"))
+}
+func (otpAuth) IsUnique([]byte) (bool, auth.AuthErr) { return true, auth.NewErr(auth.NoErr, nil) }
+func (otpAuth) GenSecret(types.Uid, int, time.Duration) ([]byte, time.Time, auth.AuthErr) {
+	return nil, time.Time{}, auth.NewErr(auth.ErrUnsupported, nil)
+}
+func (otpAuth) Challenge(secret []byte) (interface{}, auth.AuthErr) {
+	if len(secret) == 0 {
+		return nil, auth.NewErr(auth.ErrMalformed, errors.New("missing phone number"))
+	}
+	if !strings.Contains(string(secret), ":") {
+		return map[string]string{"token": "otp-token"}, auth.NewErr(auth.NoErr, nil)
+	}
+	return nil, auth.NewErr(auth.NoErr, nil)
+}
+
+func TestLoginChallenge(t *testing.T) {
+	if store.GetAuthHandler("test-otp") == nil {
+		store.RegisterAuthScheme("test-otp", otpAuth{})
+	}
+	RegisterAuthScheme("test-otp")
+
+	sess := &Session{ver: 1, send: make(chan interface{}, 1)}
+	login := func(secret string) string {
+		sess.login(&ClientComMessage{Login: &MsgClientLogin{Id: "1", Scheme: "test-otp", Secret: []byte(secret)},
+			timestamp: time.Now()})
+		return string((<-sess.send).([]byte))
+	}
+
+	// Incomplete secret: the client is challenged.
+	if reply := login("+17025550001"); !strings.Contains(reply, `"params":{"challenge":{"token":"otp-token"}},"code":300`) {
+		t.Errorf("Expecting challenge, got '%s'", reply)
+	}
+	// Follow-up login is passed to authentication.
+	if reply := login("+17025550001:123456"); !strings.Contains(reply, `"code":401`) {
+		t.Errorf("Expecting authentication to fail, got '%s'", reply)
+	}
+	// Challenge errors are reported.
+	if reply := login(""); !strings.Contains(reply, `"code":400`) {
+		t.Errorf("Expecting malformed error, got '%s'", reply)
+	}
+	if !sess.uid.IsZero() {
+		t.Errorf("Session must remain unauthenticated, got '%s'", sess.uid.UserId())
+	}
+}
+
+func TestResumeInvalidToken(t *testing.T) {
+	sess := &Session{}
+	for _, token := range []string{"not base64!", "c2VjcmV0"} {
+		if sess.resume(token, time.Now()) {
+			t.Errorf("Token '%s' must be rejected", token)
+		}
+		if !sess.uid.IsZero() {
+			t.Errorf("Session must remain unauthenticated, got '%s'", sess.uid.UserId())
+		}
+	}
+}
+
+func TestValidateAccDesc(t *testing.T) {
+	now := time.Now()
+
+	good := &MsgClientAcc{Id: "1", User: "new", Desc: &MsgSetDesc{
+		DefaultAcs: &MsgDefaultAcsMode{Auth: "JRWP", Anon: "N"}}}
+	if errMsg := validateAccDesc(good, now); errMsg != nil {
+		t.Error("valid defacs rejected:", errMsg.Ctrl.Text)
+	}
+
+	if errMsg := validateAccDesc(&MsgClientAcc{Id: "2", User: "new"}, now); errMsg != nil {
+		t.Error("missing desc rejected:", errMsg.Ctrl.Text)
+	}
+
+	bad := &MsgClientAcc{Id: "3", User: "new", Desc: &MsgSetDesc{
+		DefaultAcs: &MsgDefaultAcsMode{Auth: "JRWP", Anon: "bogus!"}}}
+	errMsg := validateAccDesc(bad, now)
+	if errMsg == nil {
+		t.Fatal("invalid defacs accepted")
+	}
+	if errMsg.Ctrl.Code != 400 || errMsg.Ctrl.Id != "3" {
+		t.Errorf("expecting 400 for id '3', got %d for id '%s'", errMsg.Ctrl.Code, errMsg.Ctrl.Id)
+	}
+	if what := errMsg.Ctrl.Params.(map[string]string)["what"]; what != "defacs.anon" {
+		t.Error("expecting offending field 'defacs.anon', got", what)
+	}
+
+	conflict := &MsgClientAcc{Id: "4", User: "new", Tags: []string{"email:alice@example.com"},
+		Cred: []MsgCredClient{{Method: "email", Value: "bob@example.com"}}}
+	errMsg = validateAccDesc(conflict, now)
+	if errMsg == nil {
+		t.Fatal("tags conflicting with credentials accepted")
+	}
+	if what := errMsg.Ctrl.Params.(map[string]string)["what"]; errMsg.Ctrl.Code != 400 || what != "tags" {
+		t.Errorf("expecting 400 for 'tags', got %d for '%s'", errMsg.Ctrl.Code, what)
+	}
+
+	// Signup with tags but without credentials is not checked for consistency.
+	tagged := &MsgClientAcc{Id: "5", User: "new", Scheme: "basic", Secret: []byte("alice:secret"),
+		Tags: []string{"email:alice@example.com", "tel:+17025550001"}}
+	if errMsg := validateAccDesc(tagged, now); errMsg != nil {
+		t.Error("tagged signup without credentials rejected:", errMsg.Ctrl.Text)
+	}
+}
+
+func TestValidateAccSecret(t *testing.T) {
+	now := time.Now()
+	email := []MsgCredClient{{Method: "email", Value: "alice@example.com"}}
+
+	testAccs := []struct {
+		acc      MsgClientAcc
+		credOnly bool
+		code     int
+		what     string
+	}{
+		{MsgClientAcc{Scheme: "basic", Secret: []byte("alice:secret")}, false, 0, ""},
+		// Credentials cannot be verified, credential-only accounts are not created.
+		{MsgClientAcc{Scheme: "cred", Cred: email}, true, 501, "cred"},
+		{MsgClientAcc{Scheme: "cred", Secret: []byte("123456"), Cred: email}, false, 0, ""},
+		{MsgClientAcc{Scheme: "cred"}, false, 400, "secret"},
+		{MsgClientAcc{Scheme: "basic", Cred: email}, false, 400, "secret"},
+		{MsgClientAcc{Scheme: "basic"}, false, 400, "secret"},
+		{MsgClientAcc{Scheme: "anonymous"}, false, 0, ""},
+		{MsgClientAcc{Scheme: "cred", Cred: []MsgCredClient{{Method: "tel"}}}, true, 400, "cred"},
+	}
+
+	for i, tc := range testAccs {
+		tc.acc.Id = strconv.Itoa(i)
+		if credOnly := tc.acc.IsCredentialOnly(); credOnly != tc.credOnly {
+			t.Errorf("%d: expecting credential-only %v, got %v", i, tc.credOnly, credOnly)
+		}
+		errMsg := validateAccSecret(&tc.acc, now)
+		if tc.what == "" {
+			if errMsg != nil {
+				t.Errorf("%d: valid acc rejected: %s", i, errMsg.Ctrl.Text)
+			}
+			continue
+		}
+		if errMsg == nil {
+			t.Errorf("%d: invalid acc accepted", i)
+			continue
+		}
+		if errMsg.Ctrl.Code != tc.code || errMsg.Ctrl.Id != tc.acc.Id {
+			t.Errorf("%d: expecting %d for id '%s', got %d for id '%s'", i, tc.code, tc.acc.Id, errMsg.Ctrl.Code,
+				errMsg.Ctrl.Id)
+		}
+		if what := errMsg.Ctrl.Params.(map[string]string)["what"]; what != tc.what {
+			t.Errorf("%d: expecting offending field '%s', got '%s'", i, tc.what, what)
+		}
+	}
+}
+
+func TestSessionIsActive(t *testing.T) {
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	testCases := []struct {
+		lastAction time.Time
+		expected   bool
+	}{
+		{time.Time{}, false},
+		{now, true},
+		{now.Add(-activeSessionWindow), true},
+		{now.Add(-activeSessionWindow - time.Second), false},
+	}
+
+	for i, tc := range testCases {
+		s := &Session{lastAction: tc.lastAction}
+		if active := s.isActive(now); active != tc.expected {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, active)
+		}
+	}
+}
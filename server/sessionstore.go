@@ -141,6 +141,19 @@ func (ss *SessionStore) Shutdown() {
 	log.Printf("SessionStore shut down, sessions terminated: %d", len(ss.sessCache))
 }
 
+// Broadcast sends the message to all sessions. Clustered sessions are skipped: the notice is
+// expected to be broadcast by every node.
+func (ss *SessionStore) Broadcast(msg *ServerComMessage) {
+	ss.rw.RLock()
+	defer ss.rw.RUnlock()
+
+	for _, s := range ss.sessCache {
+		if s.send != nil && s.proto != CLUSTER {
+			s.queueOut(msg)
+		}
+	}
+}
+
 // NewSessionStore initializes a session store.
 func NewSessionStore(lifetime time.Duration) *SessionStore {
 	store := &SessionStore{
@@ -17,6 +17,8 @@ type Adapter interface {
 	GetName() string
 
 	CreateDb(reset bool) error
+	// UpgradeDb upgrades the database schema to the version expected by the adapter
+	UpgradeDb() error
 
 	// User management
 	UserCreate(usr *t.User) error
@@ -42,10 +44,10 @@ type Adapter interface {
 	TopicCreateP2P(initiator, invited *t.Subscription) error
 	// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
 	TopicGet(topic string) (*t.Topic, error)
-	// TopicsForUser loads subscriptions for a given user. Reads public value.
-	TopicsForUser(uid t.Uid, keepDeleted bool) ([]t.Subscription, error)
-	// UsersForTopic loads users' subscriptions for a given topic
-	UsersForTopic(topic string, keepDeleted bool) ([]t.Subscription, error)
+	// TopicsForUser loads a page of subscriptions for a given user ordered by topic name. Reads public value.
+	TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.PageOpt) ([]t.Subscription, error)
+	// UsersForTopic loads a page of users' subscriptions for a given topic ordered by user ID
+	UsersForTopic(topic string, keepDeleted bool, opts *t.PageOpt) ([]t.Subscription, error)
 	TopicShare(subs []*t.Subscription) (int, error)
 	TopicDelete(topic string) error
 	// Increment Topic's or User's SeqId value
@@ -65,16 +67,18 @@ type Adapter interface {
 	// SubsDelForTopic deletes all subscriptions to the given topic
 	SubsDelForTopic(topic string) error
 
-	// FindUsers searches for new contacts given a list of tags
-	FindUsers(user t.Uid, tags []string) ([]t.Subscription, error)
-	// FindTopics searches for group topics given a list of tags
-	FindTopics(tags []string) ([]t.Subscription, error)
+	// FindUsers searches for new contacts given a list of tags, skipping those with any of the excluded tags
+	FindUsers(user t.Uid, tags, excl []string) ([]t.Subscription, error)
+	// FindTopics searches for group topics given a list of tags, skipping those with any of the excluded tags
+	FindTopics(tags, excl []string) ([]t.Subscription, error)
 	UserTagsUpdate(user t.Uid, unique, tags t.StringSlice) error
 	TopicTagsUpdate(topic string, unique, tags t.StringSlice) error
 
 	// Messages
 	MessageSave(msg *t.Message) error
 	MessageGetAll(topic string, forUser t.Uid, opts *t.BrowseOpt) ([]t.Message, error)
+	// Get the ID of the most recent message created before the given time or 0 if there is none
+	MessageLastSeqBefore(topic string, before time.Time) (int, error)
 	// Mark messages as deleted. Soft- or Hard- is defined by forUser value: forUSer.IsZero == true is hard.
 	MessageDeleteList(topic string, toDel *t.DelMessage) error
 	// Get a list of deleted message Ids
@@ -98,6 +98,17 @@ func InitDb(jsonconf string, reset bool) error {
 	return adp.CreateDb(reset)
 }
 
+// UpgradeDb upgrades the database schema to the version expected by the adapter. If the connection
+// is not open, it will use the config string to open it first.
+func UpgradeDb(jsonconf string) error {
+	if !IsOpen() {
+		if err := openAdapter(jsonconf); err != nil {
+			return err
+		}
+	}
+	return adp.UpgradeDb()
+}
+
 // Registered database adapters.
 var dbAdapters map[string]adapter.Adapter
 
@@ -252,13 +263,14 @@ func (u UsersObjMapper) GetSubs(id types.Uid) ([]types.Subscription, error) {
 	return adp.SubsForUser(id, false)
 }
 
-// FindSubs loads a list of users for the given tags.
-func (u UsersObjMapper) FindSubs(id types.Uid, query []string) ([]types.Subscription, error) {
-	usubs, err := adp.FindUsers(id, query)
+// FindSubs loads a list of users and topics for the given tags. Users and topics which have any of
+// the excluded tags are skipped.
+func (u UsersObjMapper) FindSubs(id types.Uid, query, excl []string) ([]types.Subscription, error) {
+	usubs, err := adp.FindUsers(id, query, excl)
 	if err != nil {
 		return nil, err
 	}
-	tsubs, err := adp.FindTopics(query)
+	tsubs, err := adp.FindTopics(query, excl)
 	if err != nil {
 		return nil, err
 	}
@@ -270,15 +282,17 @@ func (u UsersObjMapper) UpdateTags(id types.Uid, unique, newTags []string) error
 	return adp.UserTagsUpdate(id, unique, newTags)
 }
 
-// GetTopics load a list of user's subscriptions with Public field copied to subscription
-func (u UsersObjMapper) GetTopics(id types.Uid) ([]types.Subscription, error) {
-	return adp.TopicsForUser(id, false)
+// GetTopics load a page of user's subscriptions ordered by topic name with Public field copied to
+// subscription. Reports if there are more subscriptions past the page.
+func (u UsersObjMapper) GetTopics(id types.Uid, opts *types.PageOpt) ([]types.Subscription, bool, error) {
+	subs, err := adp.TopicsForUser(id, false, pageOptPlusOne(opts))
+	return subsPage(subs, opts, err)
 }
 
-// GetTopicsAny load a list of user's subscriptions with Public field copied to subscription.
-// Deleted topics are returned too.
-func (u UsersObjMapper) GetTopicsAny(id types.Uid) ([]types.Subscription, error) {
-	return adp.TopicsForUser(id, true)
+// GetTopicsAny is the same as GetTopics, except it loads deleted subscriptions too.
+func (u UsersObjMapper) GetTopicsAny(id types.Uid, opts *types.PageOpt) ([]types.Subscription, bool, error) {
+	subs, err := adp.TopicsForUser(id, true, pageOptPlusOne(opts))
+	return subsPage(subs, opts, err)
 }
 
 // TopicsObjMapper is a struct to hold methods for persistence mapping for the topic object.
@@ -323,14 +337,39 @@ func (TopicsObjMapper) Get(topic string) (*types.Topic, error) {
 	return adp.TopicGet(topic)
 }
 
-// GetUsers loads subscriptions for topic plus loads user.Public
-func (TopicsObjMapper) GetUsers(topic string) ([]types.Subscription, error) {
-	return adp.UsersForTopic(topic, false)
+// GetUsers loads a page of subscriptions for topic ordered by user ID plus loads user.Public.
+// Reports if there are more subscriptions past the page.
+func (TopicsObjMapper) GetUsers(topic string, opts *types.PageOpt) ([]types.Subscription, bool, error) {
+	subs, err := adp.UsersForTopic(topic, false, pageOptPlusOne(opts))
+	return subsPage(subs, opts, err)
 }
 
 // GetUsersAny is the same as GetUsers, except it loads deleted subscriptions too.
-func (TopicsObjMapper) GetUsersAny(topic string) ([]types.Subscription, error) {
-	return adp.UsersForTopic(topic, true)
+func (TopicsObjMapper) GetUsersAny(topic string, opts *types.PageOpt) ([]types.Subscription, bool, error) {
+	subs, err := adp.UsersForTopic(topic, true, pageOptPlusOne(opts))
+	return subsPage(subs, opts, err)
+}
+
+// pageOptPlusOne asks for one extra item to find out if there are more of them past the limit.
+func pageOptPlusOne(opts *types.PageOpt) *types.PageOpt {
+	if opts == nil || opts.Limit <= 0 {
+		return opts
+	}
+	query := *opts
+	query.Limit++
+	return &query
+}
+
+// subsPage trims the subscriptions fetched with pageOptPlusOne to the limit and reports if there
+// are more of them.
+func subsPage(subs []types.Subscription, opts *types.PageOpt, err error) ([]types.Subscription, bool, error) {
+	if err != nil {
+		return nil, false, err
+	}
+	if opts != nil && opts.Limit > 0 && len(subs) > opts.Limit {
+		return subs[:opts.Limit], true, nil
+	}
+	return subs, false, nil
 }
 
 // GetSubs loads a list of subscriptions to the given topic, user.Public and deleted
@@ -449,11 +488,32 @@ func (MessagesObjMapper) GetAll(topic string, forUser types.Uid, opt *types.Brow
 	return adp.MessageGetAll(topic, forUser, opt)
 }
 
-// GetDeleted returns the ranges of deleted messages and the largest DelId reported in the list.
-func (MessagesObjMapper) GetDeleted(topic string, forUser types.Uid, opt *types.BrowseOpt) ([]types.Range, int, error) {
+// LastSeqBefore returns the ID of the most recent message in the topic created before the given time,
+// 0 if there is no such message.
+func (MessagesObjMapper) LastSeqBefore(topic string, before time.Time) (int, error) {
+	return adp.MessageLastSeqBefore(topic, before)
+}
+
+// GetDeleted returns the ranges of deleted messages, the largest DelId reported in the list and
+// whether there are more delete transactions past opt.Limit.
+func (MessagesObjMapper) GetDeleted(topic string, forUser types.Uid, opt *types.BrowseOpt) ([]types.Range, int, bool, error) {
+	// Fetch one extra transaction to find out if there are more of them past the limit.
+	var limit int
+	if opt != nil && opt.Limit > 0 {
+		limit = opt.Limit
+		query := *opt
+		query.Limit++
+		opt = &query
+	}
+
 	dmsgs, err := adp.MessageGetDeleted(topic, forUser, opt)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, false, err
+	}
+
+	more := limit > 0 && len(dmsgs) > limit
+	if more {
+		dmsgs = dmsgs[:limit]
 	}
 
 	var ranges []types.Range
@@ -468,7 +528,7 @@ func (MessagesObjMapper) GetDeleted(topic string, forUser types.Uid, opt *types.
 	sort.Sort(types.RangeSorter(ranges))
 	types.RangeSorter(ranges).Normalize()
 
-	return ranges, maxID, nil
+	return ranges, maxID, more, nil
 }
 
 // Registered authentication handlers.
@@ -273,6 +273,23 @@ func (ss StringSlice) Value() (driver.Value, error) {
 	return json.Marshal(ss)
 }
 
+// IntSlice is defined so Scanner and Valuer can be attached to it.
+type IntSlice []int
+
+// Scan implements sql.Scanner interface.
+func (is *IntSlice) Scan(val interface{}) error {
+	if val == nil {
+		*is = nil
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), is)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (is IntSlice) Value() (driver.Value, error) {
+	return json.Marshal(is)
+}
+
 // GenericData is wrapper for Public/Private fields. MySQL JSON field requires a valid
 // JSON object, but public/private could contain basic types, like a string. Must wrap it in an object.
 type GenericData struct {
@@ -602,6 +619,10 @@ type Subscription struct {
 	ModeGiven AccessMode
 	// User's private data associated with the subscription to topic
 	Private interface{}
+	// Client-defined version of the Private schema
+	PrivateVer int
+	// User does not want push notifications from the topic
+	Muted bool
 
 	// Deserialized ephemeral values
 
@@ -612,6 +633,8 @@ type Subscription struct {
 	seqId int
 	// Id of the last delete operation deserialized from user or topic
 	// delId int
+	// timestamp of the latest message in the topic
+	touchedAt time.Time
 	// timestamp when the user was last online
 	lastSeen time.Time
 	// user agent string of the last online access
@@ -653,6 +676,18 @@ func (s *Subscription) SetSeqId(id int) {
 	s.seqId = id
 }
 
+// GetTouchedAt returns the time of the latest message in the topic.
+func (s *Subscription) GetTouchedAt() time.Time {
+	return s.touchedAt
+}
+
+// SetTouchedAt sets the time of the latest message in the topic.
+func (s *Subscription) SetTouchedAt(when *time.Time) {
+	if when != nil {
+		s.touchedAt = *when
+	}
+}
+
 // GetLastSeen returns lastSeen.
 func (s *Subscription) GetLastSeen() time.Time {
 	return s.lastSeen
@@ -718,6 +753,12 @@ type Topic struct {
 	// Indexed tags for finding this topic.
 	Tags StringSlice
 
+	// IDs of pinned messages, group topics only.
+	Pinned IntSlice
+
+	// Time of the latest message, if any.
+	TouchedAt *time.Time
+
 	// Deserialized ephemeral params
 	owner   Uid                  // first assigned owner
 	perUser map[Uid]*perUserData // deserialized from Subscription
@@ -894,6 +935,12 @@ type BrowseOpt struct {
 	Limit  int
 }
 
+// PageOpt is a key-based query: items with the keys greater than After, ordered by the key
+type PageOpt struct {
+	After string
+	Limit int
+}
+
 // TopicCat is an enum of topic categories.
 type TopicCat int
 
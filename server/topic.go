@@ -9,9 +9,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"hash/fnv"
 	"log"
+	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -65,12 +69,33 @@ type Topic struct {
 	// Topic's public data
 	public interface{}
 
+	// IDs of pinned messages, group topics only
+	pinned []int
+
 	// Topic's per-subscriber data
 	perUser map[types.Uid]perUserData
 	// User's contact list (not nil for 'me' topic only).
 	// The map keys are UserIds for P2P topics and grpXXX for group topics.
 	perSubs map[string]perSubsData
 
+	// Reactions to messages received since the topic was loaded: seq ID -> user -> the latest reaction.
+	// Kept in memory only for at most maxReactedMessages most recent messages.
+	reactions map[int]map[types.Uid]string
+
+	// Live locations shared since the topic was loaded: seq ID -> sender and end of sharing.
+	liveLocations map[int]liveLocation
+
+	// View-once messages published or sent to subscribers since the topic was loaded: seq ID -> sender.
+	// A message is forgotten once all subscribers other than the sender have read it.
+	viewOnce map[int]types.Uid
+
+	// 'me' only: contacts' "on" and "off" notifications waiting to be coalesced and delivered.
+	presPending []MsgServerPres
+
+	// Messages pending scheduled delivery -> delivery timers. Kept in memory only. The topic is not
+	// unloaded while there are pending messages.
+	scheduled map[*ServerComMessage]*time.Timer
+
 	// Sessions attached to this topic
 	sessions map[*Session]bool
 
@@ -97,6 +122,12 @@ type Topic struct {
 
 type atomicBool int32
 
+// liveLocation is the message with the location which is updated live until the given time.
+type liveLocation struct {
+	from  types.Uid
+	until time.Time
+}
+
 // perUserData holds topic's cache of per-subscriber data
 type perUserData struct {
 	// Timestamps when the subscription was created and updated
@@ -112,6 +143,12 @@ type perUserData struct {
 	delID int
 
 	private interface{}
+	// Client-defined version of the private schema
+	privateVer int
+	// Push notifications are disabled by the user
+	muted bool
+	// The latest unsent draft of a message, kept in memory only
+	draft *MsgServerData
 
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
@@ -182,6 +219,8 @@ func (t *Topic) run(hub *Hub) {
 	var currentUA string
 	uaTimer = time.NewTimer(time.Minute)
 	uaTimer.Stop()
+	presTimer := time.NewTimer(time.Minute)
+	presTimer.Stop()
 
 	for {
 		select {
@@ -287,19 +326,45 @@ func (t *Topic) run(hub *Hub) {
 					continue
 				}
 
+				// A scheduled message is due. The sender was acked when the message was scheduled and
+				// the session may be gone by now.
+				_, due := t.scheduled[msg]
+				if due {
+					delete(t.scheduled, msg)
+					msg.sessFrom, msg.id = nil, ""
+					msg.timestamp = types.TimeNow()
+					msg.Data.Timestamp = msg.timestamp
+					if len(t.scheduled) == 0 && len(t.sessions) == 0 {
+						killTimer.Reset(keepAlive)
+					}
+				}
+
 				from := types.ParseUserId(msg.Data.From)
 				userData := t.perUser[from]
 
 				// msg.sessFrom is not nil when the message originated at the client.
-				// for internally generated messages the akn is nil
-				if msg.sessFrom != nil {
+				// for internally generated messages the akn is nil. Permissions of the sender of a
+				// scheduled message are checked again at delivery time.
+				if msg.sessFrom != nil || due {
 					if !(userData.modeWant & userData.modeGiven).IsWriter() {
-						msg.sessFrom.queueOut(ErrPermissionDenied(msg.id, t.original(msg.sessFrom.uid),
-							msg.timestamp))
+						if msg.sessFrom != nil {
+							msg.sessFrom.queueOut(ErrPermissionDenied(msg.id, t.original(msg.sessFrom.uid),
+								msg.timestamp))
+						}
 						continue
 					}
 				}
 
+				if msg.pub.IsDraft() {
+					t.saveDraft(from, msg)
+					continue
+				}
+
+				if msg.sessFrom != nil && shouldDefer(msg.pub.ScheduledAt(), msg.timestamp, maxScheduleAhead) {
+					t.schedule(msg)
+					continue
+				}
+
 				if err := store.Messages.Save(&types.Message{
 					ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
 					SeqId:     t.lastID + 1,
@@ -309,21 +374,31 @@ func (t *Topic) run(hub *Hub) {
 					Content:   msg.Data.Content}); err != nil {
 
 					log.Printf("topic[%s]: failed to save message: %v", t.name, err)
-					msg.sessFrom.queueOut(ErrUnknown(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
+					if msg.sessFrom != nil {
+						msg.sessFrom.queueOut(ErrUnknown(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
+					}
 
 					continue
 				}
 
 				t.lastID++
 				msg.Data.SeqId = t.lastID
+				msg.Data.markIfEdited(msg.Data.Timestamp)
+
+				t.trackLiveLocation(t.lastID, from, msg.Data.Content, msg.timestamp)
+				if msg.Data.IsViewOnce() {
+					t.trackViewOnce(t.lastID, from)
+				}
 
 				if msg.id != "" {
-					reply := NoErrAccepted(msg.id, t.original(msg.sessFrom.uid), msg.timestamp)
-					reply.Ctrl.Params = map[string]int{"seq": t.lastID}
+					reply := NoErrAcceptedPub(msg.id, t.original(msg.sessFrom.uid), MsgPubAck{SeqId: t.lastID},
+						msg.timestamp)
 					msg.sessFrom.queueOut(reply)
 				}
 
-				pushRcpt = t.makePushReceipt(msg.Data)
+				if msg.Data.ShouldNotify() {
+					pushRcpt = t.makePushReceipt(msg.Data)
+				}
 
 				// Message sent: notify offline 'R' subscrbers on 'me'
 				t.presSubsOffline("msg", &PresParams{seqID: t.lastID}, types.ModeRead, "", true)
@@ -333,20 +408,36 @@ func (t *Topic) run(hub *Hub) {
 
 			} else if msg.Pres != nil {
 
-				what := t.presProcReq(msg.Pres.Src, msg.Pres.What, msg.Pres.wantReply)
+				what := t.presProcReq(msg.Pres.Src, string(msg.Pres.What), msg.Pres.wantReply)
 				if t.xoriginal != msg.Pres.Topic || what == "" {
 					// This is just a request for status, don't forward it to sessions
 					continue
 				}
 
 				// "what" may have changed, i.e. unset or "+command" removed ("on+en" -> "on")
-				msg.Pres.What = what
+				msg.Pres.What = PresWhat(what)
+
+				if t.cat == types.TopicCatMe && (msg.Pres.What == PresOn || msg.Pres.What == PresOff) {
+					// Contacts on flaky connections go on and off rapidly: deliver the net state after a delay.
+					if msg.Pres.ts.IsZero() {
+						msg.Pres.ts = types.TimeNow()
+					}
+					if len(t.presPending) == 0 {
+						presTimer.Reset(presCoalesceWindow)
+					}
+					t.presPending = append(t.presPending, *msg.Pres)
+					continue
+				}
 			} else if msg.Info != nil {
 				if t.isSuspended() {
 					// Ignore info messages - topic is being deleted
 					continue
 				}
 
+				if msg.Info.What == noteReadAll {
+					resolveReadAll(msg.Info, t.lastID)
+				}
+
 				if msg.Info.SeqId > t.lastID {
 					// Drop bogus read notification
 					continue
@@ -355,11 +446,29 @@ func (t *Topic) run(hub *Hub) {
 				uid := types.ParseUserId(msg.Info.From)
 				pud := t.perUser[uid]
 
-				// Filter out "kp" from users with no 'W' permission
-				if msg.Info.What == "kp" && !(pud.modeGiven & pud.modeWant).IsWriter() {
+				// Filter out "kp" and call signaling from users with no 'W' permission
+				if (msg.Info.What == "kp" || isCallNote(msg.Info.What)) &&
+					!(pud.modeGiven & pud.modeWant).IsWriter() {
+					continue
+				}
+
+				// Location updates are accepted from the author of the live location until it expires.
+				if msg.Info.What == noteLocation && !t.liveLocationActive(msg.Info.SeqId, uid, msg.timestamp) {
 					continue
 				}
 
+				if msg.Info.What == noteReact {
+					if !(pud.modeGiven & pud.modeWant).IsReader() {
+						continue
+					}
+					t.addReaction(msg.Info.SeqId, uid, msg.Info.Value)
+				}
+
+				// Typing notifications in large groups are sent to active sessions only.
+				if msg.Info.What == "kp" && t.cat == types.TopicCatGrp && len(t.perUser) > kpFanoutThreshold {
+					msg.Info.LimitToActive()
+				}
+
 				if msg.Info.What == "read" || msg.Info.What == "recv" {
 					// Filter out "read/recv" from users with no 'R' permission
 					if !(pud.modeGiven & pud.modeWant).IsReader() {
@@ -367,6 +476,7 @@ func (t *Topic) run(hub *Hub) {
 					}
 
 					var read, recv int
+					prevRead := pud.readID
 					if msg.Info.What == "read" {
 						if msg.Info.SeqId > pud.readID {
 							pud.readID = msg.Info.SeqId
@@ -402,6 +512,10 @@ func (t *Topic) run(hub *Hub) {
 					t.presPubMessageCount(uid, recv, read, msg.skipSid)
 
 					t.perUser[uid] = pud
+
+					if read > 0 {
+						t.expireViewOnce(uid, prevRead, read)
+					}
 				}
 			}
 
@@ -413,14 +527,22 @@ func (t *Topic) run(hub *Hub) {
 						continue
 					}
 
+					if msg.Data != nil && msg.sessFrom != nil && !shouldEcho(msg.pub, msg.sessFrom.sid, sess.sid) {
+						continue
+					}
+
+					if msg.Info != nil && msg.Info.ActiveOnly() && !sess.isActive(msg.timestamp) {
+						continue
+					}
+
 					if msg.Pres != nil {
 						// Skip notifying - already notified on topic.
-						if msg.Pres.skipTopic != "" && sess.subs[msg.Pres.skipTopic] != nil {
+						if msg.Pres.SkippedTopic() != "" && sess.subs[msg.Pres.SkippedTopic()] != nil {
 							continue
 						}
 
 						// Notification addressed to a single user only
-						if msg.Pres.singleUser != "" && sess.uid.UserId() != msg.Pres.singleUser {
+						if msg.Pres.SingleUser() != "" && sess.uid.UserId() != msg.Pres.SingleUser() {
 							continue
 						}
 
@@ -481,41 +603,48 @@ func (t *Topic) run(hub *Hub) {
 
 			// Request to get/set topic metadata
 			if meta.pkt.Get != nil {
-				// Get request
-				if meta.what&constMsgMetaDesc != 0 {
-					if err := t.replyGetDesc(meta.sess, meta.pkt.Get.Id, "", meta.pkt.Get.Desc); err != nil {
-						log.Printf("topic[%s] meta.Get.Desc failed: %v", t.name, err)
-					}
-				}
-				if meta.what&constMsgMetaSub != 0 {
-					if err := t.replyGetSub(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Sub); err != nil {
-						log.Printf("topic[%s] meta.Get.Sub failed: %v", t.name, err)
+				// Get request. Replies are sent in the canonical order.
+				for _, part := range meta.pkt.Get.OrderedParts() {
+					var err error
+					switch part {
+					case constMsgMetaDesc:
+						err = t.replyGetDesc(meta.sess, meta.pkt.Get.Id, "", meta.pkt.Get.Desc)
+					case constMsgMetaSub:
+						err = t.replyGetSub(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Sub)
+					case constMsgMetaTags:
+						err = t.replyGetTags(meta.sess, meta.pkt.Get.Id)
+					case constMsgMetaData:
+						err = t.replyGetData(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Data)
+					case constMsgMetaDel:
+						err = t.replyGetDel(meta.sess, meta.pkt.Get.Id, &meta.pkt.Get.MsgGetQuery)
 					}
-				}
-				if meta.what&constMsgMetaData != 0 {
-					if err := t.replyGetData(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Data); err != nil {
-						log.Printf("topic[%s] meta.Get.Data failed: %v", t.name, err)
-					}
-				}
-				if meta.what&constMsgMetaDel != 0 {
-					if err := t.replyGetDel(meta.sess, meta.pkt.Get.Id, meta.pkt.Get.Del); err != nil {
-						log.Printf("topic[%s] meta.Get.Del failed: %v", t.name, err)
+					if err != nil {
+						log.Printf("topic[%s] meta.Get.%s failed: %v", t.name, metaPartName(part), err)
 					}
 				}
 
 			} else if meta.pkt.Set != nil {
-				// Set request
-				if meta.what&constMsgMetaDesc != 0 {
-					if err := t.replySetDesc(meta.sess, meta.pkt.Set); err == nil {
-						// Notify plugins of the update
-						pluginTopic(t, plgActUpd)
-					} else {
-						log.Printf("topic[%s] meta.Set.Desc failed: %v", t.name, err)
+				// Set request. The precondition, if any, applies to all parts of the request.
+				if err := t.checkSetPrecondition(meta.sess, meta.pkt.Set); err != nil {
+					log.Printf("topic[%s] meta.Set failed: %v", t.name, err)
+				} else {
+					if meta.what&constMsgMetaDesc != 0 {
+						if err := t.replySetDesc(meta.sess, meta.pkt.Set); err == nil {
+							// Notify plugins of the update
+							pluginTopic(t, plgActUpd)
+						} else {
+							log.Printf("topic[%s] meta.Set.Desc failed: %v", t.name, err)
+						}
 					}
-				}
-				if meta.what&constMsgMetaSub != 0 {
-					if err := t.replySetSub(hub, meta.sess, meta.pkt.Set); err != nil {
-						log.Printf("topic[%s] meta.Set.Sub failed: %v", t.name, err)
+					if meta.what&constMsgMetaSub != 0 {
+						if err := t.replySetSub(hub, meta.sess, meta.pkt.Set); err != nil {
+							log.Printf("topic[%s] meta.Set.Sub failed: %v", t.name, err)
+						}
+					}
+					if meta.what&constMsgMetaTags != 0 {
+						if err := t.replySetTags(meta.sess, meta.pkt.Set.Id, meta.pkt.Set); err != nil {
+							log.Printf("topic[%s] meta.Set.Tags failed: %v", t.name, err)
+						}
 					}
 				}
 
@@ -540,6 +669,9 @@ func (t *Topic) run(hub *Hub) {
 			currentUA = ua
 			uaTimer.Reset(uaTimerDelay)
 
+		case <-presTimer.C:
+			t.presFlush()
+
 		case <-uaTimer.C:
 			// Publish user agent changes after a delay
 			if currentUA == "" || currentUA == t.userAgent {
@@ -549,6 +681,10 @@ func (t *Topic) run(hub *Hub) {
 			t.presUsersOfInterest("ua", t.userAgent)
 
 		case <-killTimer.C:
+			if len(t.scheduled) > 0 {
+				// Keep the topic alive until the scheduled messages are delivered.
+				continue
+			}
 			// Topic timeout
 			hub.unreg <- &topicUnreg{topic: t.name}
 			if t.cat == types.TopicCatMe {
@@ -584,6 +720,14 @@ func (t *Topic) run(hub *Hub) {
 
 			// In case of a system shutdown don't bother with notifications. They won't be delivered anyway.
 
+			// Pending scheduled messages are lost.
+			if len(t.scheduled) > 0 {
+				log.Printf("topic[%s]: dropping %d scheduled messages", t.name, len(t.scheduled))
+				for _, timer := range t.scheduled {
+					timer.Stop()
+				}
+			}
+
 			// Report completion back to sender, if 'done' is not nil.
 			if sd.done != nil {
 				sd.done <- true
@@ -631,10 +775,12 @@ func (t *Topic) handleSubscription(h *Hub, sreg *sessionJoin) error {
 					pud2 := t.perUser[user2]
 
 					// Inform the other user that the topic was just created
+					// User2's cached public is the public of the first user, the actor.
 					t.presSingleUserOffline(user2, "acs", &PresParams{
-						dWant:  types.ModeNone.Delta(pud2.modeWant),
-						dGiven: types.ModeNone.Delta(pud2.modeGiven),
-						actor:  sreg.sess.uid.UserId()}, "", false)
+						dWant:       types.ModeNone.Delta(pud2.modeWant),
+						dGiven:      types.ModeNone.Delta(pud2.modeGiven),
+						actor:       sreg.sess.uid.UserId(),
+						actorPublic: pud2.public}, "", false)
 
 					// Initiate exchange of 'online' status with the other user.
 					// We don't know if the current user is online in the 'me' topic,
@@ -686,7 +832,7 @@ func (t *Topic) handleSubscription(h *Hub, sreg *sessionJoin) error {
 
 	if getWhat&constMsgMetaDel != 0 {
 		// Send get.del response as a separate {meta} packet
-		if err := t.replyGetDel(sreg.sess, sreg.pkt.Id, sreg.pkt.Get.Del); err != nil {
+		if err := t.replyGetDel(sreg.sess, sreg.pkt.Id, sreg.pkt.Get); err != nil {
 			log.Printf("topic[%s] handleSubscription Get.Del failed: %v", t.name, err)
 		}
 	}
@@ -1014,7 +1160,9 @@ func (t *Topic) requestSub(h *Hub, sess *Session, pktID string, want string,
 // A. Sharer or Approver is inviting another user for the first time (no prior subscription)
 // B. Sharer or Approver is re-inviting another user (adjusting modeGiven, modeWant is still Unset)
 // C. Approver is changing modeGiven for another user, modeWant != Unset
-func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClientSet) error {
+// Returns the error reply to send to the requester, if any, and the error.
+func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid,
+	set *MsgClientSet) (*ServerComMessage, error) {
 	log.Printf("approveSub, session uid=%s, target uid=%s", sess.uid.String(), target.String())
 
 	now := types.TimeNow()
@@ -1029,8 +1177,8 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 	// Check if approver actually has permission to manage sharing
 	userData, ok := t.perUser[sess.uid]
 	if !ok || !(userData.modeGiven & userData.modeWant).IsSharer() {
-		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
-		return errors.New("topic access denied; approver has no permission")
+		return ErrPermissionDenied(set.Id, t.original(sess.uid), now),
+			errors.New("topic access denied; approver has no permission")
 	}
 
 	hostMode = userData.modeGiven & userData.modeWant
@@ -1039,8 +1187,7 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 	modeGiven := types.ModeUnset
 	if set.Sub.Mode != "" {
 		if err := modeGiven.UnmarshalText([]byte(set.Sub.Mode)); err != nil {
-			sess.queueOut(ErrMalformed(set.Id, t.original(sess.uid), now))
-			return err
+			return ErrMalformed(set.Id, t.original(sess.uid), now), err
 		}
 
 		// Make sure the new permissions are reasonable in P2P topics
@@ -1054,14 +1201,14 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 
 	// Make sure only the owner & approvers can set non-default access mode
 	if modeGiven != types.ModeUnset && !hostMode.IsAdmin() {
-		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
-		return errors.New("sharer cannot set explicit modeGiven")
+		return ErrPermissionDenied(set.Id, t.original(sess.uid), now),
+			errors.New("sharer cannot set explicit modeGiven")
 	}
 
 	// Make sure no one but the owner can do an ownership transfer
 	if modeGiven.IsOwner() && t.owner != sess.uid {
-		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
-		return errors.New("attempt to transfer ownership by non-owner")
+		return ErrPermissionDenied(set.Id, t.original(sess.uid), now),
+			errors.New("attempt to transfer ownership by non-owner")
 	}
 
 	// Check if it's a new invite. If so, save it to database as a subscription.
@@ -1071,8 +1218,8 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 
 		// Check if the max number of subscriptions is already reached.
 		if t.cat == types.TopicCatGrp && len(t.perUser) >= globals.maxSubscriberCount {
-			sess.queueOut(ErrPolicy(set.Id, t.original(sess.uid), now))
-			return errors.New("max subscription count exceeded")
+			return ErrPolicy(set.Id, t.original(sess.uid), now),
+				errors.New("max subscription count exceeded")
 		}
 
 		if modeGiven == types.ModeUnset {
@@ -1084,11 +1231,10 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 		// Get user's default access mode to be used as modeWant
 		var modeWant types.AccessMode
 		if user, err := store.Users.Get(target); err != nil {
-			sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
-			return err
+			return ErrUnknown(set.Id, t.original(sess.uid), now), err
 		} else if user == nil {
-			sess.queueOut(ErrUserNotFound(set.Id, t.original(sess.uid), now))
-			return errors.New("user not found")
+			return ErrUserNotFound(set.Id, t.original(sess.uid), now),
+				errors.New("user not found")
 		} else {
 			modeWant = user.Access.Auth
 		}
@@ -1102,8 +1248,7 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 		}
 
 		if err := store.Subs.Create(sub); err != nil {
-			sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
-			return err
+			return ErrUnknown(set.Id, t.original(sess.uid), now), err
 		}
 
 		userData = perUserData{
@@ -1129,7 +1274,7 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 			// Save changed value to database
 			if err := store.Subs.Update(t.name, target,
 				map[string]interface{}{"ModeGiven": modeGiven}); err != nil {
-				return err
+				return nil, err
 			}
 
 			t.perUser[target] = userData
@@ -1138,8 +1283,8 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 
 	// The user does not want to be bothered, no further action is needed
 	if !userData.modeWant.IsJoiner() {
-		sess.queueOut(ErrPermissionDenied(set.Id, t.original(sess.uid), now))
-		return errors.New("user banned the topic")
+		return ErrPermissionDenied(set.Id, t.original(sess.uid), now),
+			errors.New("user banned the topic")
 	}
 
 	// Access mode has changed.
@@ -1162,16 +1307,35 @@ func (t *Topic) approveSub(h *Hub, sess *Session, target types.Uid, set *MsgClie
 		t.presSingleUserOffline(target, "on", nilPresParams, "", false)
 	}
 
-	return nil
+	return nil, nil
 }
 
 // replyGetDesc is a response to a get.desc request on a topic, sent to just the session as a {meta} packet
 func (t *Topic) replyGetDesc(sess *Session, id, tempName string, opts *MsgGetOpts) error {
 	now := types.TimeNow()
 
+	desc := t.describe(sess, opts)
+
 	// Check if user requested modified data
-	ifUpdated := (opts == nil || opts.IfModifiedSince == nil || opts.IfModifiedSince.Before(t.updated))
+	if ims := opts.ModifiedSince(); ims != nil && !ims.Before(t.updated) {
+		desc.Public, desc.Private, desc.PrivateVer, desc.Pinned = nil, nil, 0, nil
+	}
+
+	// When the topic is first created it may have been assigned a temporary name.
+	// Report the temporary name here. It could be empty.
+	if _, full := t.perUser[sess.uid]; (full || t.cat == types.TopicCatMe) &&
+		tempName != "" && tempName != t.original(sess.uid) {
+		desc.TempName = tempName
+	}
 
+	sess.queueOut(descReply(id, t.original(sess.uid), desc, opts, now))
+
+	return nil
+}
+
+// describe builds the full description of the topic as seen by the session's user and its etag. The etag
+// is the same whether the client requests modified data only or not.
+func (t *Topic) describe(sess *Session, opts *MsgGetOpts) *MsgTopicDesc {
 	desc := &MsgTopicDesc{CreatedAt: &t.created}
 	if !t.updated.IsZero() {
 		desc.UpdatedAt = &t.updated
@@ -1182,13 +1346,11 @@ func (t *Topic) replyGetDesc(sess *Session, id, tempName string, opts *MsgGetOpt
 		full = true
 	}
 
-	if ifUpdated {
-		if t.public != nil {
-			desc.Public = t.public
-		} else if full {
-			// p2p topic
-			desc.Public = pud.public
-		}
+	if t.public != nil {
+		desc.Public = t.public
+	} else if full {
+		// p2p topic
+		desc.Public = pud.public
 	}
 
 	// Request may come from a subscriber (full == true) or a stranger.
@@ -1210,8 +1372,14 @@ func (t *Topic) replyGetDesc(sess *Session, id, tempName string, opts *MsgGetOpt
 				Mode:  (pud.modeGiven & pud.modeWant).String()}
 		}
 
-		if ifUpdated {
-			desc.Private = pud.private
+		desc.Private = pud.private
+		desc.PrivateVer = pud.privateVer
+
+		// Drafts don't update the topic, report the latest one unconditionally.
+		if pud.draft != nil {
+			draft := *pud.draft
+			draft.Topic = t.original(sess.uid)
+			desc.Draft = &draft
 		}
 
 		// Don't report message IDs to users without Read access.
@@ -1222,23 +1390,104 @@ func (t *Topic) replyGetDesc(sess *Session, id, tempName string, opts *MsgGetOpt
 			desc.DelId = max(pud.delID, t.delID)
 			desc.ReadSeqId = pud.readID
 			desc.RecvSeqId = max(pud.recvID, pud.readID)
+
+			// Pins are changed by {set desc} which updates the topic.
+			if t.cat == types.TopicCatGrp {
+				desc.Pinned = t.pinned
+			}
 		}
 
-		// When the topic is first created it may have been assigned a temporary name.
-		// Report the temporary name here. It could be empty.
-		if tempName != "" && tempName != t.original(sess.uid) {
-			desc.TempName = tempName
+		// Online count makes no sense for P2P and 'me' topics.
+		if t.cat == types.TopicCatGrp {
+			for _, pud := range t.perUser {
+				if pud.online > 0 {
+					desc.OnlineCount++
+				}
+			}
+		}
+
+		if t.cat == types.TopicCatP2P && opts != nil && opts.IncludeSeen {
+			if peer, ok := otherP2PUser(t.name, sess.uid.UserId()); ok {
+				if user, err := store.Users.Get(types.ParseUserId(peer)); err != nil {
+					log.Printf("topic[%s]: failed to load peer's last seen: %v", t.name, err)
+				} else {
+					desc.LastSeen = lastSeenInfo(user)
+				}
+			}
 		}
 	}
 
-	sess.queueOut(&ServerComMessage{
+	desc.Etag = descEtag(desc)
+
+	return desc
+}
+
+// descReply creates a {meta} with the topic description or a "not modified" {ctrl} if the client's
+// cached copy has the same etag.
+func descReply(id, topic string, desc *MsgTopicDesc, opts *MsgGetOpts, now time.Time) *ServerComMessage {
+	if !opts.NoneMatch(desc.Etag) {
+		return InfoNotModified(id, topic, now)
+	}
+
+	return &ServerComMessage{
 		Meta: &MsgServerMeta{
 			Id:        id,
-			Topic:     t.original(sess.uid),
+			Topic:     topic,
 			Desc:      desc,
-			Timestamp: &now}})
+			Etag:      desc.Etag,
+			Timestamp: &now}}
+}
 
-	return nil
+// descChangedFields lists the fields of the description, as named in {set desc}, which are changed by
+// the user or topic update.
+func descChangedFields(user, topic map[string]interface{}) []string {
+	var changed []string
+	for _, upd := range []map[string]interface{}{user, topic} {
+		if _, ok := upd["Public"]; ok {
+			changed = append(changed, "public")
+		}
+		if _, ok := upd["Access"]; ok {
+			changed = append(changed, "defacs")
+		}
+		if _, ok := upd["Pinned"]; ok {
+			changed = append(changed, "pinned")
+		}
+	}
+	return changed
+}
+
+// checkSetPrecondition implements optimistic concurrency for {set}: the request is rejected with 412 if
+// the description has changed since the client has seen it, i.e. the etag of the current description
+// differs from the IfMatch. The reply is sent to the session.
+func (t *Topic) checkSetPrecondition(sess *Session, set *MsgClientSet) error {
+	if set.IfMatch == "" || set.IfMatch == t.describe(sess, nil).Etag {
+		return nil
+	}
+
+	sess.queueOut(ErrPreconditionFailed(set.Id, set.Topic, types.TimeNow()))
+	return errors.New("{set} precondition failed")
+}
+
+// errNotOwner is returned when the change is permitted to the owner of the topic only.
+var errNotOwner = errors.New("not owner")
+
+// validateDefaultAcsChange checks the request to change the default access mode of the topic: in group
+// topics only the owner can change it, and the modes must be valid. A request without a change is valid.
+func validateDefaultAcsChange(q MsgSetQuery, cat types.TopicCat, isOwner bool) error {
+	if !q.ChangesDefaultAcs() {
+		return nil
+	}
+	switch cat {
+	case types.TopicCatGrp:
+		if !isOwner {
+			return errNotOwner
+		}
+	case types.TopicCatMe:
+	default:
+		// Rejected in P2P topics and ignored in 'fnd' by the caller.
+		return nil
+	}
+	return q.Desc.DefaultAcs.Validate()
 }
 
 // replySetDesc updates topic metadata, saves it to DB,
@@ -1247,6 +1496,9 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 	now := types.TimeNow()
 
 	assignAccess := func(upd map[string]interface{}, mode *MsgDefaultAcsMode) error {
+		if err := mode.Validate(); err != nil {
+			return err
+		}
 		if auth, anon, err := parseTopicAccess(mode, types.ModeUnset, types.ModeUnset); err != nil {
 			return err
 		} else if auth.IsOwner() || anon.IsOwner() {
@@ -1283,10 +1535,8 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 	assignGenericValues := func(upd map[string]interface{}, what string, p interface{}) (changed bool) {
 		if isNullValue(p) {
 			// Request to clear the value
-			if upd[what] != nil {
-				upd[what] = nil
-				changed = true
-			}
+			upd[what] = nil
+			changed = true
 		} else if p != nil {
 			// A new non-nil value
 			upd[what] = p
@@ -1304,6 +1554,9 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 		if public, ok := upd["Public"]; ok {
 			t.public = public
 		}
+		if pinned, ok := upd["Pinned"]; ok {
+			t.pinned = pinned.(types.IntSlice)
+		}
 	}
 
 	var err error
@@ -1313,35 +1566,62 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 	topic := make(map[string]interface{})
 	sub := make(map[string]interface{})
 	if set.Desc != nil {
+		// Check the change of default access before anything is changed.
+		if err = validateDefaultAcsChange(set.MsgSetQuery, t.cat, t.owner == sess.uid); err == errNotOwner {
+			sess.queueOut(ErrPermissionDeniedReason(set.Id, set.Topic, "not_owner", now))
+			return errors.New("attempt to change default access by non-owner")
+		} else if err != nil {
+			errMsg := ErrMalformed(set.Id, set.Topic, now)
+			if acsErr, ok := err.(*defaultAcsError); ok {
+				errMsg.Ctrl.Params = map[string]string{"what": "defacs." + acsErr.field}
+			}
+			sess.queueOut(errMsg)
+			return err
+		}
+
+		public, private := set.Desc.contentUpdate()
 		if t.cat == types.TopicCatMe {
 			// Update current user
-			if set.Desc.DefaultAcs != nil {
+			if set.ChangesDefaultAcs() {
 				err = assignAccess(user, set.Desc.DefaultAcs)
 			}
-			if set.Desc.Public != nil {
-				sendPres = assignGenericValues(user, "Public", set.Desc.Public)
+			if public != nil {
+				sendPres = assignGenericValues(user, "Public", public)
 			}
 		} else if t.cat == types.TopicCatP2P {
 			// Reject direct changes to P2P topics.
-			if set.Desc.Public != nil || set.Desc.DefaultAcs != nil {
+			if set.Desc.Public != nil || set.Desc.DefaultAcs != nil || set.Desc.Pinned != nil {
 				sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
 				return errors.New("incorrect attempt to change metadata of a p2p topic")
 			}
 		} else if t.cat == types.TopicCatGrp {
 			// Update group topic
-			if set.Desc.DefaultAcs != nil || set.Desc.Public != nil {
+			if set.ChangesDefaultAcs() || set.Desc.Public != nil {
 				if t.owner == sess.uid {
-					if set.Desc.DefaultAcs != nil {
+					if set.ChangesDefaultAcs() {
 						err = assignAccess(topic, set.Desc.DefaultAcs)
 					}
-					if set.Desc.Public != nil {
-						sendPres = assignGenericValues(topic, "Public", set.Desc.Public)
+					if public != nil {
+						sendPres = assignGenericValues(topic, "Public", public)
 					}
 				} else {
 					// This is a request from non-owner
-					sess.queueOut(ErrPermissionDenied(set.Id, set.Topic, now))
+					sess.queueOut(ErrPermissionDeniedReason(set.Id, set.Topic, "not_owner", now))
 					return errors.New("attempt to change public or permissions by non-owner")
 				}
+			} else if public != nil && t.owner == sess.uid {
+				// Public is cleared because it's replaced together with private.
+				sendPres = assignGenericValues(topic, "Public", public)
+			}
+			if set.Desc.Pinned != nil && err == nil {
+				if pud := t.perUser[sess.uid]; !(pud.modeGiven & pud.modeWant).IsAdmin() {
+					sess.queueOut(ErrPermissionDeniedReason(set.Id, set.Topic, "not_admin", now))
+					return errors.New("attempt to pin messages by non-admin")
+				}
+				var pinned []int
+				if pinned, err = normalizePinned(set.Desc.Pinned, t.lastID); err == nil {
+					topic["Pinned"] = types.IntSlice(pinned)
+				}
 			}
 		}
 		// else fnd: update ignored
@@ -1351,8 +1631,11 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 			return err
 		}
 
-		if set.Desc.Private != nil {
-			assignGenericValues(sub, "Private", set.Desc.Private)
+		if private != nil {
+			assignGenericValues(sub, "Private", private)
+		}
+		if set.Desc.PrivateVer != 0 {
+			sub["PrivateVer"] = set.Desc.PrivateVer
 		}
 	}
 
@@ -1384,21 +1667,41 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 		pud.private = private
 		t.perUser[sess.uid] = pud
 	}
+	if ver, ok := sub["PrivateVer"].(int); ok {
+		pud := t.perUser[sess.uid]
+		pud.privateVer = ver
+		t.perUser[sess.uid] = pud
+	}
 	if t.cat == types.TopicCatMe {
 		updateCached(user)
 	} else if t.cat == types.TopicCatGrp {
 		updateCached(topic)
 	}
+	// Use the timestamp written by the store: it's what the topic is loaded with next time.
+	if updated, ok := user["UpdatedAt"].(time.Time); ok {
+		t.updated = updated
+	}
+	if updated, ok := topic["UpdatedAt"].(time.Time); ok {
+		t.updated = updated
+	}
 
-	if sendPres {
-		// t.Public has changed, make an announcement
+	// Announce the change listing the fields of the description which have changed.
+	if changed := descChangedFields(user, topic); len(changed) > 0 {
+		params := &PresParams{changed: changed}
 		if t.cat == types.TopicCatMe {
-			t.presUsersOfInterest("upd", "")
-			t.presSingleUserOffline(sess.uid, "upd", nilPresParams, sess.sid, false)
+			if sendPres {
+				// Contacts can see only the public of the user.
+				t.presUsersOfInterestUpd([]string{"public"})
+			}
+			t.presSingleUserOffline(sess.uid, "upd", params, sess.sid, false)
 		} else {
-			t.presSubsOffline("upd", nilPresParams, 0, sess.sid, false)
+			t.presSubsOffline("upd", params, 0, sess.sid, false)
 		}
 	}
+	if len(sub) > 0 {
+		// Private is visible to the user only: tell the user's other sessions.
+		t.presSingleUserOffline(sess.uid, "upd", &PresParams{changed: []string{"private"}}, sess.sid, false)
+	}
 
 	sess.queueOut(NoErr(set.Id, set.Topic, now))
 
@@ -1411,37 +1714,55 @@ func (t *Topic) replySetDesc(sess *Session, set *MsgClientSet) error {
 func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 	now := types.TimeNow()
 
+	var ifModified time.Time
+	var limit int
+	var cursor string
+	if opts != nil {
+		if ims := opts.ModifiedSince(); ims != nil {
+			ifModified = *ims
+		}
+		limit = opts.Limit
+		cursor = opts.Cursor
+	}
+	limit = clampLimit(limit, subPageSize, subPageSize)
+	// Deleted subscriptions are only needed to manage the client's cache.
+	keepDeleted := !ifModified.IsZero()
+	page := &types.PageOpt{After: cursor, Limit: limit}
+
 	var subs []types.Subscription
+	var more bool
 	var err error
 	var isSharer bool
 
 	if t.cat == types.TopicCatMe {
-		// Fetch user's subscriptions, with Topic.Public denormalized into subscription.
-		// Include deleted subscriptions too.
-		subs, err = store.Users.GetTopicsAny(sess.uid)
+		// Fetch a page of user's subscriptions, with Topic.Public denormalized into subscription.
+		if keepDeleted {
+			subs, more, err = store.Users.GetTopicsAny(sess.uid, page)
+		} else {
+			subs, more, err = store.Users.GetTopics(sess.uid, page)
+		}
 		isSharer = true
 	} else if t.cat == types.TopicCatFnd {
-		// Given a query provided in .private, fetch user's contacts. Private contains a slice of interfaces.
-		if ifquery, ok := t.perUser[sess.uid].private.([]interface{}); ok && len(ifquery) > 0 {
-			// Convert slice of interfaces to a slice of strings.
-			var query []string
-			for _, ifq := range ifquery {
-				switch str := ifq.(type) {
-				case string:
-					query = append(query, str)
-				default:
-				}
+		// Given a query provided in .private, fetch user's contacts.
+		if find := parseFindQuery(t.perUser[sess.uid].private); find != nil && len(find.Tags) > 0 {
+			if err = find.Validate(); err != nil {
+				sess.queueOut(ErrMalformed(id, t.original(sess.uid), now))
+				return err
 			}
-			if len(query) > 0 {
-				query, subs, err = pluginFind(sess.uid, query)
-				if err == nil && subs == nil && query != nil {
-					subs, err = store.Users.FindSubs(sess.uid, query)
-				}
+			var query []string
+			query, subs, err = pluginFind(sess.uid, find.Tags)
+			if err == nil && subs == nil && query != nil {
+				// Exclusion is applied by the query itself, before the number of results is limited.
+				subs, err = store.Users.FindSubs(sess.uid, query, find.Exclude)
 			}
 		}
 	} else {
 		// TODO(gene): don't load subs from DB, use perUserData - it already contains subscriptions.
-		subs, err = store.Topics.GetUsersAny(t.name)
+		if keepDeleted {
+			subs, more, err = store.Topics.GetUsersAny(t.name, page)
+		} else {
+			subs, more, err = store.Topics.GetUsers(t.name, page)
+		}
 		userData := t.perUser[sess.uid]
 		isSharer = (userData.modeGiven & userData.modeWant).IsSharer()
 	}
@@ -1451,19 +1772,6 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 		return err
 	}
 
-	var ifModified time.Time
-	var limit int
-	if opts != nil {
-		if opts.IfModifiedSince != nil {
-			ifModified = *opts.IfModifiedSince
-		}
-		limit = opts.Limit
-	}
-
-	if limit <= 0 {
-		limit = 1024
-	}
-
 	meta := &MsgServerMeta{Id: id, Topic: t.original(sess.uid), Timestamp: &now}
 	if len(subs) > 0 {
 		meta.Sub = make([]MsgTopicSub, 0, len(subs))
@@ -1507,9 +1815,15 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 					deleted = true
 				}
 
+				touched := subTouchedAt(&sub)
+				mts.TouchedAt = &touched
+
 				// Reporting user's subscriptions to other topics. P2P topic name is the
 				// UID of the other user.
 				with := sub.GetWith()
+				if with == "" {
+					with, _ = otherP2PUser(sub.Topic, sess.uid.UserId())
+				}
 				if with != "" {
 					mts.Topic = with
 					mts.Online = t.perSubs[with].online && !deleted
@@ -1581,14 +1895,33 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 						mts.Private = sub.Private
 					}
 				}
+				// Muting is private to the user.
+				if uid == sess.uid || t.cat == types.TopicCatMe {
+					mts.Muted = sub.Muted
+				}
 			} else if mts.DeletedAt == nil {
 				mts.DeletedAt = &sub.UpdatedAt
 			}
+
+			// Delta sync of the chat list: skip subscriptions which have not changed since the cut off date.
+			if t.cat == types.TopicCatMe && !ifModified.IsZero() && !subTouchedAfter(mts, &ifModified) {
+				continue
+			}
+
 			meta.Sub = append(meta.Sub, mts)
 			idx++
 		}
 	}
 
+	if more {
+		// A long list is sent one page at a time, the client fetches the next one using the cursor:
+		// the key of the last subscription in this page.
+		if last := subs[len(subs)-1]; t.cat == types.TopicCatMe {
+			meta.Cursor = last.Topic
+		} else {
+			meta.Cursor = last.User
+		}
+	}
 	sess.queueOut(&ServerComMessage{Meta: meta})
 
 	return nil
@@ -1598,6 +1931,10 @@ func (t *Topic) replyGetSub(sess *Session, id string, opts *MsgGetOpts) error {
 // update topic metadata cache, save/update subs, reply to the caller as {ctrl} message,
 // generate a presence notification, if appropriate.
 func (t *Topic) replySetSub(h *Hub, sess *Session, set *MsgClientSet) error {
+	if len(set.Users) > 0 {
+		return t.replySetSubs(h, sess, set)
+	}
+
 	now := types.TimeNow()
 
 	var uid types.Uid
@@ -1618,12 +1955,26 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, set *MsgClientSet) error {
 		err = t.requestSub(h, sess, set.Id, set.Sub.Mode, nil)
 	} else {
 		// Request to approve/change someone's subscription
-		err = t.approveSub(h, sess, uid, set)
+		var reply *ServerComMessage
+		if reply, err = t.approveSub(h, sess, uid, set); reply != nil {
+			sess.queueOut(reply)
+		}
 	}
 	if err != nil {
 		return err
 	}
 
+	// Only the user can mute own subscription.
+	if set.Sub.Muted != nil && uid == sess.uid && t.perUser[uid].muted != *set.Sub.Muted {
+		if err = store.Subs.Update(t.name, uid, map[string]interface{}{"Muted": *set.Sub.Muted}); err != nil {
+			sess.queueOut(ErrUnknown(set.Id, t.original(sess.uid), now))
+			return err
+		}
+		pud := t.perUser[uid]
+		pud.muted = *set.Sub.Muted
+		t.perUser[uid] = pud
+	}
+
 	resp := NoErr(set.Id, t.original(sess.uid), now)
 	// Report resulting access mode.
 	pud := t.perUser[uid]
@@ -1640,6 +1991,53 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, set *MsgClientSet) error {
 	return nil
 }
 
+// replySetSubs is a response to a batch of changes to subscriptions of other users {set.subs}, i.e. invites
+// of several users at once. Each change is processed independently, the results are reported per user in
+// the params of the {ctrl}.
+func (t *Topic) replySetSubs(h *Hub, sess *Session, set *MsgClientSet) error {
+	results := make([]MsgSetSubResult, 0, len(set.Users))
+	for i := range set.Users {
+		uid := types.ParseUserId(set.Users[i].User)
+		result := MsgSetSubResult{User: set.Users[i].User}
+
+		var reply *ServerComMessage
+		var err error
+		if uid == sess.uid {
+			// Own subscription cannot be changed in a batch.
+			reply = ErrMalformed(set.Id, t.original(sess.uid), types.TimeNow())
+		} else {
+			reply, err = t.approveSub(h, sess, uid, &MsgClientSet{
+				Id:          set.Id,
+				Topic:       set.Topic,
+				MsgSetQuery: MsgSetQuery{Sub: &set.Users[i]}})
+			if err != nil {
+				log.Printf("topic[%s] set.subs for '%s' failed: %v", t.name, result.User, err)
+				if reply == nil {
+					reply = ErrUnknown(set.Id, t.original(sess.uid), types.TimeNow())
+				}
+			}
+		}
+
+		if reply != nil {
+			result.Code, result.Text = reply.Ctrl.Code, reply.Ctrl.Text
+		} else {
+			pud := t.perUser[uid]
+			result.Code, result.Text = http.StatusOK, "ok"
+			result.Acs = &MsgAccessMode{
+				Given: pud.modeGiven.String(),
+				Want:  pud.modeWant.String(),
+				Mode:  (pud.modeGiven & pud.modeWant).String()}
+		}
+		results = append(results, result)
+	}
+
+	resp := NoErr(set.Id, t.original(sess.uid), types.TimeNow())
+	resp.Ctrl.Params = map[string]interface{}{"subs": results}
+	sess.queueOut(resp)
+
+	return nil
+}
+
 // replyGetData is a response to a get.data request - load a list of stored messages, send them to session as {data}
 // response goes to a single session rather than all sessions in a topic
 func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error {
@@ -1658,6 +2056,10 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 		// Messages are sent in reverse order than fetched from DB to make it easier for
 		// clients to process.
 		if messages != nil {
+			var batch *MsgServerDataBatch
+			if sess.dataBatch {
+				batch = &MsgServerDataBatch{Topic: t.original(sess.uid)}
+			}
 			for i := len(messages) - 1; i >= 0; i-- {
 				mm := messages[i]
 
@@ -1670,7 +2072,28 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 					Timestamp: mm.CreatedAt,
 					Content:   mm.Content}}
 
-				sess.queueOut(msg)
+				msg.Data.markIfEdited(mm.UpdatedAt)
+				msg.Data.ExpireOnRead = msg.Data.IsViewOnce()
+				if msg.Data.ExpireOnRead {
+					t.trackViewOnce(mm.SeqId, from)
+				}
+
+				if batch != nil {
+					batch.Messages = append(batch.Messages, *msg.Data)
+				} else {
+					sess.queueOut(msg)
+				}
+			}
+			if batch != nil && len(batch.Messages) > 0 {
+				sess.queueOut(&ServerComMessage{DataBatch: batch})
+			}
+
+			if reactions := t.reactionsFor(messages); len(reactions) > 0 {
+				sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+					Id:        id,
+					Topic:     t.original(sess.uid),
+					Reactions: reactions,
+					Timestamp: &now}})
 			}
 		}
 	}
@@ -1683,8 +2106,92 @@ func (t *Topic) replyGetData(sess *Session, id string, req *MsgBrowseOpts) error
 	return nil
 }
 
+// addReaction remembers the user's reaction to the message seq replacing the user's earlier reaction.
+// If too many messages have reactions, reactions to the oldest message are forgotten.
+func (t *Topic) addReaction(seq int, uid types.Uid, value string) {
+	if t.reactions == nil {
+		t.reactions = make(map[int]map[types.Uid]string)
+	}
+	byUser, ok := t.reactions[seq]
+	if !ok {
+		if len(t.reactions) >= maxReactedMessages {
+			oldest := seq
+			for s := range t.reactions {
+				if s < oldest {
+					oldest = s
+				}
+			}
+			if oldest == seq {
+				// The message is older than all messages with reactions, don't track it.
+				return
+			}
+			delete(t.reactions, oldest)
+		}
+		byUser = make(map[types.Uid]string)
+		t.reactions[seq] = byUser
+	}
+	byUser[uid] = value
+}
+
+// reactionsFor aggregates reactions to the given messages.
+func (t *Topic) reactionsFor(messages []types.Message) []MsgReactionSummary {
+	if len(t.reactions) == 0 {
+		return nil
+	}
+
+	var notes []MsgServerInfo
+	for i := range messages {
+		seq := messages[i].SeqId
+		for uid, value := range t.reactions[seq] {
+			notes = append(notes, MsgServerInfo{What: noteReact, SeqId: seq, From: uid.UserId(), Value: value})
+		}
+	}
+	return aggregateReactions(notes)
+}
+
 // replyGetTags returns topic's tags - tokens used for discovery.
 func (t *Topic) replyGetTags(sess *Session, id string) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowed(id, t.original(sess.uid), now))
+		return errors.New("invalid topic category for fetching tags")
+	}
+
+	var tags []string
+	if t.cat == types.TopicCatMe {
+		user, err := store.Users.Get(sess.uid)
+		if err != nil {
+			sess.queueOut(ErrUnknown(id, t.original(sess.uid), now))
+			return err
+		}
+		if user != nil {
+			tags = user.Tags
+		}
+	} else {
+		topic, err := store.Topics.Get(t.name)
+		if err != nil {
+			sess.queueOut(ErrUnknown(id, t.original(sess.uid), now))
+			return err
+		}
+		if topic != nil {
+			tags = topic.Tags
+		}
+	}
+
+	if len(tags) > 0 {
+		sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+			Id:        id,
+			Topic:     t.original(sess.uid),
+			Timestamp: &now,
+			Tags:      tags}})
+		return nil
+	}
+
+	reply := NoErr(id, t.original(sess.uid), now)
+	reply.Ctrl.Params = map[string]string{"what": "tags"}
+	sess.queueOut(reply)
+
 	return nil
 }
 
@@ -1700,8 +2207,15 @@ func (t *Topic) replySetTags(sess *Session, id string, set *MsgClientSet) error
 		return errors.New("invalid topic category assign tags")
 	}
 
-	var tags []string
-	if tags = normalizeTags(tags, set.Tags); len(tags) > 0 {
+	for _, tag := range set.Tags {
+		if !validTagShape(tag) {
+			sess.queueOut(ErrMalformed(id, t.original(sess.uid), now))
+			return errors.New("invalid tag '" + truncateRunes(tag, maxLoggedTagLength) + "'")
+		}
+	}
+
+	tags := normalizeTags(set.Tags)
+	if len(tags) > 0 {
 		if len(tags) > globals.maxTagCount {
 			// If user sent too many tags, silently discard excessive tags.
 			tags = tags[:globals.maxTagCount]
@@ -1721,7 +2235,12 @@ func (t *Topic) replySetTags(sess *Session, id string, set *MsgClientSet) error
 		}
 	}
 
-	sess.queueOut(NoErr(id, t.original(sess.uid), now))
+	reply := NoErr(id, t.original(sess.uid), now)
+	if len(tags) > 0 {
+		// Report tags as they were stored.
+		reply.Ctrl.Params = map[string]interface{}{"tags": tags}
+	}
+	sess.queueOut(reply)
 
 	return nil
 }
@@ -1729,25 +2248,42 @@ func (t *Topic) replySetTags(sess *Session, id string, set *MsgClientSet) error
 // replyGetDel is a response to a get[what=del] request: load a list of deleted message ids, send them to
 // a session as {meta}
 // response goes to a single session rather than all sessions in a topic
-func (t *Topic) replyGetDel(sess *Session, id string, req *MsgBrowseOpts) error {
+func (t *Topic) replyGetDel(sess *Session, id string, query *MsgGetQuery) error {
 	now := types.TimeNow()
 
 	// Check if the user has permission to read the topic data and the request is valid
-	if userData := t.perUser[sess.uid]; (userData.modeGiven & userData.modeWant).IsReader() && req != nil {
-		ranges, delID, err := store.Messages.GetDeleted(t.name, sess.uid, msgOpts2storeOpts(req))
+	if userData := t.perUser[sess.uid]; (userData.modeGiven & userData.modeWant).IsReader() && query.Del != nil {
+		since, err := query.Del.CursorDelId()
+		if err != nil {
+			sess.queueOut(ErrMalformed(id, t.original(sess.uid), now))
+			return err
+		}
+
+		opts := msgOpts2storeOpts(query.Del)
+		// The cursor is the delete ID the previous page stopped at.
+		if since > opts.Since {
+			opts.Since = since
+		}
+		opts.Limit = query.DelLimit(defaultDelQueryLimit, maxQueryLimit)
+		ranges, delID, more, err := store.Messages.GetDeleted(t.name, sess.uid, opts)
 		if err != nil {
 			sess.queueOut(ErrUnknown(id, t.original(sess.uid), now))
 			return err
 		}
 
 		if len(ranges) > 0 {
-			sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+			meta := &MsgServerMeta{
 				Id:    id,
 				Topic: t.original(sess.uid),
 				Del: &MsgDelValues{
 					DelId:  delID,
 					DelSeq: delrangeDeserialize(ranges)},
-				Timestamp: &now}})
+				Timestamp: &now}
+			if more {
+				// The client fetches the next page of delete transactions using the cursor.
+				meta.Cursor = strconv.Itoa(delID + 1)
+			}
+			sess.queueOut(&ServerComMessage{Meta: meta})
 			return nil
 		}
 	}
@@ -1771,15 +2307,44 @@ func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 		}
 	}()
 
+	pud := t.perUser[sess.uid]
+	if !(pud.modeGiven & pud.modeWant).IsDeleter() {
+		// User must have an R permission: if the user cannot read messages, he has
+		// no business of deleting them.
+		if !(pud.modeGiven & pud.modeWant).IsReader() {
+			sess.queueOut(ErrPermissionDenied(del.Id, t.original(sess.uid), now))
+			return errors.New("del.msg: permission denied")
+		}
+
+		// User has just the R permission, cannot hard-delete messages, silently
+		// switching to soft-deleting
+		del.Hard = false
+	}
+
+	if del.Before != nil {
+		// Convert time to a range of IDs.
+		del.DelSeq, err = resolveDelBefore(*del.Before, func(before time.Time) (int, error) {
+			return store.Messages.LastSeqBefore(t.name, before)
+		})
+		if err != nil {
+			sess.queueOut(ErrUnknown(del.Id, t.original(sess.uid), now))
+			return err
+		}
+		if len(del.DelSeq) == 0 {
+			// No messages older than the given time.
+			sess.queueOut(NoErrDeleted(del.Id, t.original(sess.uid), 0, t.delID, now))
+			return nil
+		}
+	}
+
 	var ranges []types.Range
 	if len(del.DelSeq) == 0 {
 		err = errors.New("del.msg: no IDs to delete")
 	} else {
 		count := 0
 		for _, dq := range del.DelSeq {
-			if dq.LowId > t.lastID || dq.LowId < 0 || dq.HiId < 0 ||
-				(dq.HiId > 0 && dq.LowId > dq.HiId) ||
-				(dq.LowId == 0 && dq.HiId == 0) {
+			// The ranges are validated by the session, only the bounds of the topic are checked here.
+			if dq.LowId > t.lastID {
 				err = errors.New("del.msg: invalid entry in list")
 				break
 			}
@@ -1816,20 +2381,6 @@ func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 		return err
 	}
 
-	pud := t.perUser[sess.uid]
-	if !(pud.modeGiven & pud.modeWant).IsDeleter() {
-		// User must have an R permission: if the user cannot read messages, he has
-		// no business of deleting them.
-		if !(pud.modeGiven & pud.modeWant).IsReader() {
-			sess.queueOut(ErrPermissionDenied(del.Id, t.original(sess.uid), now))
-			return errors.New("del.msg: permission denied")
-		}
-
-		// User has just the R permission, cannot hard-delete messages, silently
-		// switching to soft-deleting
-		del.Hard = false
-	}
-
 	forUser := sess.uid
 	if del.Hard {
 		forUser = types.ZeroUid
@@ -1861,13 +2412,108 @@ func (t *Topic) replyDelMsg(sess *Session, del *MsgClientDel) error {
 		t.presPubMessageDelete(sess.uid, t.delID, dr, sess.sid)
 	}
 
-	reply := NoErr(del.Id, t.original(sess.uid), now)
-	reply.Ctrl.Params = map[string]int{"del": t.delID}
-	sess.queueOut(reply)
+	sess.queueOut(NoErrDeleted(del.Id, t.original(sess.uid), rangesCount(ranges), t.delID, now))
 
 	return nil
 }
 
+// resolveDelBefore converts {del before} to a range of message IDs: from 1 to the ID of the most
+// recent message created before the given time as reported by lastSeqBefore. Returns nil if no
+// message was created before the time.
+func resolveDelBefore(before time.Time, lastSeqBefore func(before time.Time) (int, error)) ([]MsgDelRange, error) {
+	seq, err := lastSeqBefore(before)
+	if err != nil || seq <= 0 {
+		return nil, err
+	}
+	if seq == 1 {
+		return []MsgDelRange{{LowId: 1}}, nil
+	}
+	return []MsgDelRange{{LowId: 1, HiId: seq}}, nil
+}
+
+// trackLiveLocation remembers the message seq if its content is a live location which has not expired yet.
+func (t *Topic) trackLiveLocation(seq int, from types.Uid, content interface{}, now time.Time) {
+	loc, ok := DecodeLocationContent(content)
+	if !ok || !loc.Live || loc.Until == nil || !loc.Until.After(now) {
+		return
+	}
+	if t.liveLocations == nil {
+		t.liveLocations = make(map[int]liveLocation)
+	}
+	t.liveLocations[seq] = liveLocation{from: from, until: *loc.Until}
+}
+
+// liveLocationActive checks if the user may send updates of the live location in the message seq.
+// Expired live locations are forgotten.
+func (t *Topic) liveLocationActive(seq int, uid types.Uid, now time.Time) bool {
+	live, ok := t.liveLocations[seq]
+	if !ok {
+		return false
+	}
+	if !live.until.After(now) {
+		delete(t.liveLocations, seq)
+		return false
+	}
+	return live.from == uid
+}
+
+// trackViewOnce remembers the view-once message seq so it can be expired when read.
+func (t *Topic) trackViewOnce(seq int, from types.Uid) {
+	if t.viewOnce == nil {
+		t.viewOnce = make(map[int]types.Uid)
+	}
+	t.viewOnce[seq] = from
+}
+
+// viewOnceRead returns the tracked view-once messages with IDs in (prevRead..read] which were not sent
+// by the user, sorted by ID. The messages which all subscribers other than the sender have read by now
+// are forgotten.
+func (t *Topic) viewOnceRead(uid types.Uid, prevRead, read int) []types.Range {
+	var ranges []types.Range
+	for seq, from := range t.viewOnce {
+		if seq <= prevRead || seq > read || from == uid {
+			continue
+		}
+		ranges = append(ranges, types.Range{Low: seq})
+
+		readByAll := true
+		for reader, pud := range t.perUser {
+			if reader != from && pud.readID < seq {
+				readByAll = false
+				break
+			}
+		}
+		if readByAll {
+			delete(t.viewOnce, seq)
+		}
+	}
+	sort.Sort(types.RangeSorter(ranges))
+	return ranges
+}
+
+// expireViewOnce soft-deletes view-once messages with IDs in (prevRead..read] for the user who has just
+// read them. Messages sent by the user are not deleted. Only the messages tracked in memory are
+// expired: those published or sent to subscribers since the topic was loaded.
+func (t *Topic) expireViewOnce(uid types.Uid, prevRead, read int) {
+	ranges := t.viewOnceRead(uid, prevRead, read)
+	if len(ranges) == 0 {
+		return
+	}
+
+	if err := store.Messages.DeleteList(t.name, t.delID+1, uid, ranges); err != nil {
+		log.Printf("topic[%s]: failed to expire view-once messages: %v", t.name, err)
+		return
+	}
+
+	t.delID++
+	pud := t.perUser[uid]
+	pud.delID = t.delID
+	t.perUser[uid] = pud
+
+	// Notify all sessions of the user, including the one which sent the read notification.
+	t.presPubMessageDelete(uid, t.delID, delrangeDeserialize(ranges), "")
+}
+
 // Shut down the topic in response to {del what="topic"} request
 // See detailed description at hub.topicUnreg()
 // 1. Checks if the requester is the owner. If so:
@@ -2043,6 +2689,55 @@ func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
 	}
 }
 
+// schedule defers the delivery of the {data} until the time requested in the {pub} and acks the
+// sender. When due, the message is sent to the topic's broadcast channel and is handled like a new one.
+// Pending messages are kept in memory only: they are lost if the server restarts.
+func (t *Topic) schedule(msg *ServerComMessage) {
+	if len(t.scheduled) >= maxScheduledPerTopic {
+		msg.sessFrom.queueOut(ErrPolicy(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
+		return
+	}
+
+	if t.scheduled == nil {
+		t.scheduled = make(map[*ServerComMessage]*time.Timer)
+	}
+	sendAt := *msg.pub.SendAt
+	t.scheduled[msg] = time.AfterFunc(sendAt.Sub(msg.timestamp), func() {
+		// Don't block the timer goroutine: the topic may have exited or be overloaded.
+		select {
+		case t.broadcast <- msg:
+		default:
+			log.Printf("topic[%s]: scheduled message dropped, queue full", t.name)
+		}
+	})
+
+	resp := NoErrAccepted(msg.id, t.original(msg.sessFrom.uid), msg.timestamp)
+	resp.Ctrl.Params = map[string]interface{}{"sendat": sendAt}
+	msg.sessFrom.queueOut(resp)
+}
+
+// saveDraft keeps the user's unsent draft and syncs it to the user's other sessions. Drafts are
+// not stored as messages, not counted and not pushed.
+func (t *Topic) saveDraft(from types.Uid, msg *ServerComMessage) {
+	pud := t.perUser[from]
+	pud.draft = msg.Data
+	t.perUser[from] = pud
+
+	if msg.id != "" {
+		msg.sessFrom.queueOut(NoErrAccepted(msg.id, t.original(msg.sessFrom.uid), msg.timestamp))
+	}
+
+	for sess := range t.sessions {
+		if !draftVisibleTo(msg.pub, msg.Data.From, sess.uid) ||
+			(msg.sessFrom != nil && !shouldEcho(msg.pub, msg.sessFrom.sid, sess.sid)) {
+			continue
+		}
+		draft := *msg.Data
+		draft.Topic = t.original(sess.uid)
+		sess.queueOut(&ServerComMessage{Data: &draft})
+	}
+}
+
 // Prepares a payload to be delivered to a mobile device as a push notification.
 func (t *Topic) makePushReceipt(data *MsgServerData) *pushReceipt {
 	idx := make(map[types.Uid]int, len(t.perUser))
@@ -2057,8 +2752,8 @@ func (t *Topic) makePushReceipt(data *MsgServerData) *pushReceipt {
 
 	i := 0
 	for uid, pud := range t.perUser {
-		if (pud.modeWant & pud.modeGiven).IsPresencer() {
-			// Only send to those users who have notifications enabled
+		if (pud.modeWant & pud.modeGiven).IsPresencer() && !pud.muted {
+			// Only send to those users who have notifications enabled and have not muted the topic
 			receipt.To[i].User = uid
 			idx[uid] = i
 			i++
@@ -2163,7 +2858,7 @@ func msgOpts2storeOpts(req *MsgBrowseOpts) *types.BrowseOpt {
 	var opts *types.BrowseOpt
 	if req != nil {
 		opts = &types.BrowseOpt{
-			Limit:  req.Limit,
+			Limit:  clampLimit(req.Limit, maxQueryLimit, maxQueryLimit),
 			Since:  req.SinceId,
 			Before: req.BeforeId,
 		}
@@ -2171,11 +2866,106 @@ func msgOpts2storeOpts(req *MsgBrowseOpts) *types.BrowseOpt {
 	return opts
 }
 
+// resolveReadAll converts a "read_all" notification into a regular "read" of the latest message.
+func resolveReadAll(info *MsgServerInfo, lastID int) {
+	info.What = "read"
+	info.SeqId = lastID
+}
+
+// lastSeenInfo reports when and with which user agent the user was last online or nil if unknown.
+func lastSeenInfo(user *types.User) *MsgLastSeenInfo {
+	if user == nil || user.LastSeen == nil || user.LastSeen.IsZero() {
+		return nil
+	}
+	return &MsgLastSeenInfo{When: user.LastSeen, UserAgent: user.UserAgent}
+}
+
+// otherP2PUser returns the ID of the user at the other end of a P2P topic, i.e. not self.
+// The second value is false if the topic is not a P2P topic or self is not one of its parties.
+func otherP2PUser(topic, self string) (string, bool) {
+	uid1, uid2, err := types.ParseP2P(topic)
+	if err != nil {
+		return "", false
+	}
+
+	selfUid := types.ParseUserId(self)
+	if selfUid.IsZero() {
+		return "", false
+	}
+
+	if selfUid == uid1 {
+		return uid2.UserId(), true
+	} else if selfUid == uid2 {
+		return uid1.UserId(), true
+	}
+	return "", false
+}
+
+// subTouchedAt returns the time the subscription was last touched: the latest of its UpdatedAt, which is
+// merged with the topic's or the other user's UpdatedAt, and the time of the latest message in the topic.
+func subTouchedAt(sub *types.Subscription) time.Time {
+	touched := sub.UpdatedAt
+	if tt := sub.GetTouchedAt(); tt.After(touched) {
+		touched = tt
+	}
+	return touched
+}
+
+// subTouchedAfter checks if the subscription was updated, deleted or touched after the given time.
+// All subscriptions pass if the time is not provided.
+func subTouchedAfter(sub MsgTopicSub, since *time.Time) bool {
+	if since == nil {
+		return true
+	}
+
+	for _, ts := range []*time.Time{sub.TouchedAt, sub.UpdatedAt, sub.DeletedAt} {
+		if ts != nil && ts.After(*since) {
+			return true
+		}
+	}
+	return false
+}
+
+// descEtag generates a validity tag for a topic description. It's made of the time when the topic
+// was last updated, the latest message ID and a hash of the rest of the description, so that changes
+// of per-subscriber values, like private, access mode, read/recv counters or online count, are covered.
+// The peer's last seen time is not covered.
+func descEtag(desc *MsgTopicDesc) string {
+	var nanos int64
+	if desc.UpdatedAt != nil && !desc.UpdatedAt.IsZero() {
+		nanos = desc.UpdatedAt.UnixNano()
+	}
+
+	// The timestamps are already accounted for, the rest is hashed.
+	rest := *desc
+	rest.CreatedAt, rest.UpdatedAt, rest.LastSeen, rest.Etag = nil, nil, nil, ""
+	hash := fnv.New32a()
+	if data, err := json.Marshal(&rest); err == nil {
+		hash.Write(data)
+	}
+
+	return strconv.FormatInt(nanos, 36) + "." + strconv.FormatInt(int64(desc.SeqId), 36) + "." +
+		strconv.FormatUint(uint64(hash.Sum32()), 36)
+}
+
+// clampLimit returns the requested number of results constrained to a sane range:
+// zero or negative value is replaced with the default, excessive value is capped at max.
+func clampLimit(requested, def, max int) int {
+	if requested <= 0 {
+		requested = def
+	}
+	if requested > max {
+		requested = max
+	}
+	return requested
+}
+
+// nullValue is a value of Public or Private which requests the value to be cleared: Del control character.
+const nullValue = "\u2421"
+
 func isNullValue(i interface{}) bool {
-	// Del control character
-	const clearValue = "\u2421"
 	if str, ok := i.(string); ok {
-		return str == clearValue
+		return str == nullValue
 	}
 	return false
 }
@@ -2184,11 +2974,67 @@ func topicCat(name string) types.TopicCat {
 	return types.GetTopicCat(name)
 }
 
+// ValidateTopicName checks if the topic name sent by the client is well-formed for its category:
+// 'me' and 'fnd' must be bare, 'usr' must be followed by a valid user ID, 'grp' by a base64 URL string,
+// 'p2p' by a canonical pair of user IDs. Names of new topics start with 'new'.
+func ValidateTopicName(topic string) error {
+	switch {
+	case topic == "me" || topic == "fnd":
+		return nil
+	case strings.HasPrefix(topic, "new"):
+		return nil
+	case strings.HasPrefix(topic, "usr"):
+		if types.ParseUserId(topic).IsZero() {
+			return errors.New("invalid user ID in topic name")
+		}
+		return nil
+	case strings.HasPrefix(topic, "grp"):
+		if !isBase64URL(topic[3:]) {
+			return errors.New("invalid group topic name")
+		}
+		return nil
+	case strings.HasPrefix(topic, "p2p"):
+		uid1, uid2, err := types.ParseP2P(topic)
+		if err != nil || uid1.P2PName(uid2) != topic {
+			return errors.New("invalid p2p topic name")
+		}
+		return nil
+	}
+	return errors.New("unknown topic category")
+}
+
+// isBase64URL checks if the string is non-empty and consists of unpadded base64 URL alphabet only.
+func isBase64URL(str string) bool {
+	if str == "" {
+		return false
+	}
+	for _, r := range str {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 // Generate random string as a name of the group topic
 func genTopicName() string {
 	return "grp" + store.GetUidString()
 }
 
+// rangesCount returns the number of message IDs in normalized ranges. The Hi is inclusive or zero
+// if the range is a single ID.
+func rangesCount(ranges []types.Range) int {
+	count := 0
+	for _, r := range ranges {
+		if r.Hi == 0 {
+			count++
+		} else {
+			count += r.Hi - r.Low + 1
+		}
+	}
+	return count
+}
+
 // Convert a list of IDs into ranges
 func delrangeDeserialize(in []types.Range) []MsgDelRange {
 	if len(in) == 0 {
@@ -2216,61 +3062,139 @@ func delrangeSerialize(in []MsgDelRange) []types.Range {
 	return out
 }
 
-// Trim whitespace, remove empty tags and duplicates, ensure proper format of prefixes.
-func normalizeTags(dst []string, src []string) []string {
-	if len(src) == 0 {
-		return dst
+// Check if the tag is either a plain token or a "ns:value" pair with both parts present.
+func validTagShape(tag string) bool {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return false
 	}
 
-	// Make sure the number of tags does not exceed the maximum.
-	// Technically it may result in fewer tags than the maximum due to empty tags and
-	// duplicates, but that's user's fault.
-	if len(src) > globals.maxTagCount {
-		src = src[:globals.maxTagCount]
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) < 2 {
+		return true
 	}
 
-	// Trim whitespace and force to lowercase.
-	for i := 0; i < len(src); i++ {
-		src[i] = strings.ToLower(strings.TrimSpace(src[i]))
+	return strings.TrimSpace(parts[0]) != "" && strings.TrimSpace(parts[1]) != ""
+}
+
+// parseFindQuery extracts a query from the private value of the 'fnd' topic. The private value is either
+// a list of tags or an object in the MsgFindQuery format. Returns nil if the value is neither.
+func parseFindQuery(private interface{}) *MsgFindQuery {
+	switch val := private.(type) {
+	case []interface{}:
+		// Convert slice of interfaces to a slice of strings.
+		var find MsgFindQuery
+		for _, ifq := range val {
+			if str, ok := ifq.(string); ok {
+				find.Tags = append(find.Tags, str)
+			}
+		}
+		return &find
+	case map[string]interface{}:
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil
+		}
+		var find MsgFindQuery
+		if err = json.Unmarshal(data, &find); err != nil {
+			return nil
+		}
+		return &find
 	}
+	return nil
+}
 
-	// Sort tags
-	sort.Strings(src)
+// Trim whitespace, remove empty and short tags and duplicates, ensure proper format of prefixes.
+// Prefixes and plain tags are forced to lowercase, the case of the value after the colon is preserved
+// unless the prefix is one of the unique_tags: such values are forced to lowercase too, otherwise
+// uniqueness could be bypassed by changing the case. The result is sorted.
+func normalizeTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// Make sure the number of tags does not exceed the maximum.
+	// Technically it may result in fewer tags than the maximum due to empty tags and
+	// duplicates, but that's user's fault.
+	if len(tags) > globals.maxTagCount {
+		tags = tags[:globals.maxTagCount]
+	}
+
+	var out []string
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if parts := strings.SplitN(tag, ":", 2); len(parts) == 2 {
+			// Skip invalid strings of the form "tag:" or ":value" or ":"
+			ns, val := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+			if ns == "" || val == "" {
+				continue
+			}
+			if isUniqueTagPrefix(ns) {
+				val = strings.ToLower(val)
+			}
+			tag = ns + ":" + val
+		} else {
+			tag = strings.ToLower(tag)
+		}
 
-	// Remove short tags and de-dupe keeping the order. It may result in fewer tags than could have
-	// been if length were enforced later, but that's client's fault.
-	var prev string
-	for i := 0; i < len(src); {
-		curr := src[i]
-		if len(curr) < minTagLength || curr == prev {
-			// Re-slicing is not efficient but the slice is short so we don't care.
-			src = append(src[:i], src[i+1:]...)
+		// Remove short tags and duplicates.
+		if len(tag) < minTagLength || seen[tag] {
 			continue
 		}
-		prev = curr
-		i++
+		seen[tag] = true
+		out = append(out, tag)
 	}
 
-	// If prefixes are used, check their format.
-	// Copy to destination slice.
-	for i := 0; i < len(src); i++ {
-		parts := strings.SplitN(src[i], ":", 2)
-		if len(parts) < 2 {
-			// Not in "tag:value" format
-			dst = append(dst, src[i])
-			continue
+	sort.Strings(out)
+	return out
+}
+
+// isUniqueTagPrefix checks if tags with the given lowercase prefix must be unique.
+func isUniqueTagPrefix(ns string) bool {
+	for _, prefix := range globals.uniqueTags {
+		if strings.ToLower(prefix) == ns {
+			return true
 		}
+	}
+	return false
+}
 
-		// Skip invalid strings of the form "tag:" or ":value" or ":"
-		if parts[0], parts[1] = strings.TrimSpace(parts[0]),
-			strings.TrimSpace(parts[1]); parts[0] == "" || parts[1] == "" {
+// normalizePinned validates IDs of pinned messages and removes duplicates keeping the order.
+// More than maxPinnedCount distinct IDs is an error.
+func normalizePinned(pinned []int, maxSeq int) ([]int, error) {
+	out := make([]int, 0, len(pinned))
+	seen := make(map[int]bool, len(pinned))
+	for _, seq := range pinned {
+		if seq <= 0 || seq > maxSeq {
+			return nil, errors.New("invalid pinned message ID")
+		}
+		if seen[seq] {
 			continue
 		}
+		seen[seq] = true
+		out = append(out, seq)
+	}
 
-		// Add tag to output.
-		dst = append(dst, parts[0]+":"+parts[1])
+	if len(out) > maxPinnedCount {
+		return nil, errors.New("too many pinned messages")
 	}
+	return out, nil
+}
 
-	// Because prefixes were forced to lowercase, the tags may be unsorted now.
-	return dst
+// truncateRunes shortens the string to at most max runes without splitting multibyte characters.
+// If the string was shortened, an ellipsis "…" is appended to the result.
+func truncateRunes(s string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+
+	count := 0
+	for i := range s {
+		if count == max {
+			return s[:i] + "…"
+		}
+		count++
+	}
+	return s
 }
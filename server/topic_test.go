@@ -0,0 +1,683 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestValidTagShape(t *testing.T) {
+	testTags := map[string]bool{
+		"alice":                   true,
+		"email:alice@example.com": true,
+		"tel:17025550001":         true,
+		"":                        false,
+		"   ":                     false,
+		"email:":                  false,
+		":alice":                  false,
+		":":                       false,
+		" email : ":               false,
+	}
+
+	for tag, expected := range testTags {
+		if valid := validTagShape(tag); valid != expected {
+			t.Errorf("Tag '%s', expecting %v, got %v", tag, expected, valid)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	globals.maxTagCount = defaultMaxTagCount
+	globals.uniqueTags = []string{"tel", "Email"}
+	defer func() { globals.uniqueTags = nil }()
+
+	if normalizeTags(nil) != nil || normalizeTags([]string{" ", "", ":"}) != nil {
+		t.Error("empty tags should normalize to nil")
+	}
+
+	testCases := []struct {
+		in       []string
+		expected []string
+	}{
+		// Duplicates are removed, the namespace is lowercased, the value keeps its case.
+		{[]string{"Nick:Alice", " nick:Alice ", "NICK : Alice"}, []string{"nick:Alice"}},
+		// Values differing in case are distinct tags.
+		{[]string{"tel:17025550001", "tel:17025550001", "nick:alice", "nick:Alice"},
+			[]string{"nick:Alice", "nick:alice", "tel:17025550001"}},
+		// Values of unique tags are lowercased, so the case cannot be used to bypass uniqueness.
+		{[]string{"Email:Alice@Example.com", "email:alice@example.com", "EMAIL : ALICE@example.com"},
+			[]string{"email:alice@example.com"}},
+		// Plain tags are lowercased.
+		{[]string{"Travel", "travel", " TRAVEL "}, []string{"travel"}},
+		// Empty, short and malformed tags are dropped.
+		{[]string{"", "  ", "abc", "email:", ":value", "tel:", "music"}, []string{"music"}},
+	}
+	for _, tc := range testCases {
+		tags := normalizeTags(tc.in)
+		if len(tags) != len(tc.expected) {
+			t.Errorf("%q: expecting %q, got %q", tc.in, tc.expected, tags)
+			continue
+		}
+		for i := range tc.expected {
+			if tags[i] != tc.expected[i] {
+				t.Errorf("%q: tag %d, expecting '%s', got '%s'", tc.in, i, tc.expected[i], tags[i])
+			}
+		}
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	testStrings := []struct {
+		in       string
+		max      int
+		expected string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 4, "hell…"},
+		{"hello", 0, ""},
+		{"", 3, ""},
+		{"привет", 6, "привет"},
+		{"привет", 3, "при…"},
+		{"日本語のテキスト", 2, "日本…"},
+		{"a😀b", 2, "a😀…"},
+		{"😀😀", 1, "😀…"},
+	}
+
+	for _, tc := range testStrings {
+		if out := truncateRunes(tc.in, tc.max); out != tc.expected {
+			t.Errorf("truncateRunes('%s', %d), expecting '%s', got '%s'", tc.in, tc.max, tc.expected, out)
+		}
+	}
+}
+
+func TestRangesCount(t *testing.T) {
+	ranges := []types.Range{{Low: 3}, {Low: 5, Hi: 9}, {Low: 12, Hi: 12}}
+	if count := rangesCount(ranges); count != 7 {
+		t.Error("expecting 7 IDs, got", count)
+	}
+	if rangesCount(nil) != 0 {
+		t.Error("expecting no IDs in empty ranges")
+	}
+}
+
+func TestClampLimit(t *testing.T) {
+	testLimits := []struct {
+		requested, def, max int
+		expected            int
+	}{
+		{0, 24, 1024, 24},
+		{-5, 24, 1024, 24},
+		{1, 24, 1024, 1},
+		{100, 24, 1024, 100},
+		{1024, 24, 1024, 1024},
+		{1000000, 24, 1024, 1024},
+		{0, 2048, 1024, 1024},
+	}
+
+	for _, tc := range testLimits {
+		if limit := clampLimit(tc.requested, tc.def, tc.max); limit != tc.expected {
+			t.Errorf("clampLimit(%d, %d, %d), expecting %d, got %d",
+				tc.requested, tc.def, tc.max, tc.expected, limit)
+		}
+	}
+}
+
+func TestSubTouchedAfter(t *testing.T) {
+	since := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	before := since.Add(-time.Hour)
+	after := since.Add(time.Hour)
+
+	testSubs := []struct {
+		sub      MsgTopicSub
+		since    *time.Time
+		expected bool
+	}{
+		{MsgTopicSub{UpdatedAt: &before}, nil, true},
+		{MsgTopicSub{}, nil, true},
+		{MsgTopicSub{}, &since, false},
+		{MsgTopicSub{UpdatedAt: &before, TouchedAt: &before}, &since, false},
+		{MsgTopicSub{UpdatedAt: &since, TouchedAt: &since}, &since, false},
+		{MsgTopicSub{UpdatedAt: &before, TouchedAt: &after}, &since, true},
+		{MsgTopicSub{UpdatedAt: &after}, &since, true},
+		{MsgTopicSub{DeletedAt: &after}, &since, true},
+		{MsgTopicSub{DeletedAt: &before}, &since, false},
+	}
+
+	for i, tc := range testSubs {
+		if touched := subTouchedAfter(tc.sub, tc.since); touched != tc.expected {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, touched)
+		}
+	}
+}
+
+func TestSubTouchedAt(t *testing.T) {
+	updated := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	msgAt := updated.Add(time.Hour)
+
+	sub := types.Subscription{}
+	sub.UpdatedAt = updated
+	if touched := subTouchedAt(&sub); !touched.Equal(updated) {
+		t.Errorf("Topic without messages must be touched at update, got %v", touched)
+	}
+
+	// A new message in the topic without a change to the subscription.
+	sub.SetTouchedAt(&msgAt)
+	touched := subTouchedAt(&sub)
+	if !touched.Equal(msgAt) {
+		t.Errorf("Topic must be touched by the message, got %v", touched)
+	}
+	since := updated.Add(time.Minute)
+	if !subTouchedAfter(MsgTopicSub{UpdatedAt: &updated, TouchedAt: &touched}, &since) {
+		t.Error("Topic with a new message must be included in the delta")
+	}
+}
+
+func TestNormalizePinned(t *testing.T) {
+	pinned, err := normalizePinned([]int{5, 3, 5, 1, 3}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{5, 3, 1}
+	if len(pinned) != len(expected) {
+		t.Fatalf("Expecting %v, got %v", expected, pinned)
+	}
+	for i := range expected {
+		if pinned[i] != expected[i] {
+			t.Errorf("Expecting %v, got %v", expected, pinned)
+			break
+		}
+	}
+
+	if pinned, err = normalizePinned([]int{}, 10); err != nil || len(pinned) != 0 {
+		t.Errorf("Empty list must clear pins, got %v, %v", pinned, err)
+	}
+
+	for _, bad := range [][]int{{0}, {-1}, {3, 11}} {
+		if _, err = normalizePinned(bad, 10); err == nil {
+			t.Errorf("Pins %v must be rejected", bad)
+		}
+	}
+
+	many := make([]int, maxPinnedCount+5)
+	for i := range many {
+		many[i] = i + 1
+	}
+	if _, err = normalizePinned(many, 100); err == nil {
+		t.Errorf("%d pins must be rejected", len(many))
+	}
+	if pinned, err = normalizePinned(many[:maxPinnedCount], 100); err != nil || len(pinned) != maxPinnedCount {
+		t.Errorf("Expecting %d pins, got %v, %v", maxPinnedCount, pinned, err)
+	}
+}
+
+func TestResolveReadAll(t *testing.T) {
+	info := &MsgServerInfo{Topic: "grpAbC", From: "usrXyZ", What: noteReadAll}
+	resolveReadAll(info, 42)
+	if info.What != "read" || info.SeqId != 42 {
+		t.Errorf("expecting read up to 42, got %s up to %d", info.What, info.SeqId)
+	}
+}
+
+func TestOtherP2PUser(t *testing.T) {
+	alice, bob, eve := types.Uid(1234567), types.Uid(7654321), types.Uid(1111)
+	p2p := alice.P2PName(bob)
+
+	if other, ok := otherP2PUser(p2p, alice.UserId()); !ok || other != bob.UserId() {
+		t.Errorf("Expecting '%s', got '%s', %v", bob.UserId(), other, ok)
+	}
+	if other, ok := otherP2PUser(p2p, bob.UserId()); !ok || other != alice.UserId() {
+		t.Errorf("Expecting '%s', got '%s', %v", alice.UserId(), other, ok)
+	}
+
+	testInvalid := []struct{ topic, self string }{
+		{p2p, eve.UserId()},
+		{p2p, ""},
+		{p2p, "usr-invalid"},
+		{"grp1XUtEhjv6HND", alice.UserId()},
+		{"me", alice.UserId()},
+		{"p2pinvalid", alice.UserId()},
+	}
+	for _, tc := range testInvalid {
+		if other, ok := otherP2PUser(tc.topic, tc.self); ok || other != "" {
+			t.Errorf("Topic '%s', self '%s': expecting no result, got '%s'", tc.topic, tc.self, other)
+		}
+	}
+}
+
+func TestParseFindQuery(t *testing.T) {
+	find := parseFindQuery([]interface{}{"email:alice@example.com", 5, "tel:17025550001"})
+	if find == nil || len(find.Tags) != 2 || len(find.Exclude) != 0 {
+		t.Fatal("expecting two tags and no exclusions, got", find)
+	}
+
+	var private interface{}
+	if err := json.Unmarshal([]byte(`{"tags":["travel","music"],"excl":["spam"]}`), &private); err != nil {
+		t.Fatal(err)
+	}
+	find = parseFindQuery(private)
+	if find == nil || len(find.Tags) != 2 || len(find.Exclude) != 1 || find.Exclude[0] != "spam" {
+		t.Fatal("expecting two tags and one exclusion, got", find)
+	}
+	if err := find.Validate(); err != nil {
+		t.Error("valid query rejected:", err)
+	}
+
+	find.Exclude = append(find.Exclude, "email:")
+	if err := find.Validate(); err == nil {
+		t.Error("malformed exclusion tag accepted")
+	}
+
+	if parseFindQuery("travel") != nil || parseFindQuery(nil) != nil {
+		t.Error("expecting nil query for unsupported private values")
+	}
+}
+
+func TestValidateTopicName(t *testing.T) {
+	alice, bob := types.Uid(1234567), types.Uid(7654321)
+
+	valid := []string{"me", "fnd", "new", "newAbC123", alice.UserId(), "grp" + bob.String(),
+		"grp1XUtEhjv6HND", alice.P2PName(bob)}
+	for _, topic := range valid {
+		if err := ValidateTopicName(topic); err != nil {
+			t.Errorf("'%s' must be valid: %v", topic, err)
+		}
+	}
+
+	// P2P name with users in non-canonical order.
+	b1, _ := bob.MarshalBinary()
+	b2, _ := alice.MarshalBinary()
+	reversed := "p2p" + base64.URLEncoding.EncodeToString(append(b1, b2...))[:22]
+
+	invalid := []string{"", "meme", "fndXYZ", "usr", "usrinvalid", "grp", "grp1XUt/hjv6HND", "grp1XUtEhjv6HND=",
+		"p2p", "p2pinvalid", reversed, "chan", "Me"}
+	for _, topic := range invalid {
+		if err := ValidateTopicName(topic); err == nil {
+			t.Errorf("'%s' must be invalid", topic)
+		}
+	}
+}
+
+func TestDescEtag(t *testing.T) {
+	updated := time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC)
+	newDesc := func(updated time.Time, seq int) *MsgTopicDesc {
+		return &MsgTopicDesc{UpdatedAt: &updated, SeqId: seq, ReadSeqId: 10, RecvSeqId: 12,
+			Private: map[string]interface{}{"comment": "work"}}
+	}
+
+	etag := descEtag(newDesc(updated, 15))
+	if etag == "" {
+		t.Fatal("etag must not be empty")
+	}
+	// The same state produces the same etag regardless of the time zone.
+	if again := descEtag(newDesc(updated.In(time.FixedZone("PST", -8*3600)), 15)); again != etag {
+		t.Errorf("etag is not stable: '%s' vs '%s'", etag, again)
+	}
+	// A new message or an update changes the etag, i.e. a cached copy is not valid anymore.
+	if descEtag(newDesc(updated, 16)) == etag {
+		t.Error("etag must change with seq")
+	}
+	if descEtag(newDesc(updated.Add(time.Millisecond), 15)) == etag {
+		t.Error("etag must change with the update time")
+	}
+	if descEtag(&MsgTopicDesc{}) == descEtag(&MsgTopicDesc{SeqId: 1}) {
+		t.Error("etag of a never updated topic must change with seq")
+	}
+
+	// Per-subscriber changes don't touch the topic's update time but change the etag too.
+	changes := []func(*MsgTopicDesc){
+		func(d *MsgTopicDesc) { d.Private = map[string]interface{}{"comment": "home"} },
+		func(d *MsgTopicDesc) { d.ReadSeqId = 11 },
+		func(d *MsgTopicDesc) { d.RecvSeqId = 13 },
+		func(d *MsgTopicDesc) { d.Acs = &MsgAccessMode{Want: "JRWPS", Given: "JRWPS", Mode: "JRWPS"} },
+		func(d *MsgTopicDesc) { d.OnlineCount = 2 },
+	}
+	for i, change := range changes {
+		desc := newDesc(updated, 15)
+		change(desc)
+		if descEtag(desc) == etag {
+			t.Errorf("%d: etag must change with per-subscriber values", i)
+		}
+	}
+
+	// Last seen is not covered.
+	desc := newDesc(updated, 15)
+	desc.LastSeen = &MsgLastSeenInfo{When: &updated}
+	if descEtag(desc) != etag {
+		t.Error("etag must not change with last seen")
+	}
+}
+
+func TestSaveDraft(t *testing.T) {
+	alice, bob := types.Uid(1), types.Uid(2)
+	newSess := func(sid string, uid types.Uid) *Session {
+		return &Session{sid: sid, uid: uid, send: make(chan interface{}, 2)}
+	}
+	origin, other, peer := newSess("s1", alice), newSess("s2", alice), newSess("s3", bob)
+	topic := &Topic{name: "grp1XUtEhjv6HND", xoriginal: "grp1XUtEhjv6HND", cat: types.TopicCatGrp,
+		perUser:  map[types.Uid]perUserData{alice: {}, bob: {}},
+		sessions: map[*Session]bool{origin: true, other: true, peer: true}}
+
+	pub := &MsgClientPub{Id: "1", Topic: "grp1XUtEhjv6HND", Content: "draft text", Draft: true}
+	if !pub.IsDraft() || (&MsgClientPub{}).IsDraft() || (*MsgClientPub)(nil).IsDraft() {
+		t.Fatal("unexpected IsDraft")
+	}
+	msg := &ServerComMessage{Data: &MsgServerData{Topic: pub.Topic, From: alice.UserId(), Content: pub.Content,
+		Draft: true}, sessFrom: origin, id: pub.Id, timestamp: time.Now(), pub: pub}
+	topic.saveDraft(alice, msg)
+
+	if topic.perUser[alice].draft != msg.Data || topic.perUser[bob].draft != nil {
+		t.Error("draft must be kept for the author only")
+	}
+	// The originating session gets the ack and the echo, the author's other session gets the draft.
+	if reply := string((<-origin.send).([]byte)); !strings.Contains(reply, `"code":202`) {
+		t.Errorf("expecting accepted, got '%s'", reply)
+	}
+	for _, sess := range []*Session{origin, other} {
+		if reply := string((<-sess.send).([]byte)); !strings.Contains(reply, `"draft":true`) {
+			t.Errorf("%s: expecting the draft, got '%s'", sess.sid, reply)
+		}
+	}
+	if len(peer.send) != 0 {
+		t.Error("draft must not be delivered to other users")
+	}
+
+	// No echo to the originating session.
+	pub.NoEcho = true
+	topic.saveDraft(alice, msg)
+	<-origin.send
+	if len(origin.send) != 0 || len(other.send) != 1 || len(peer.send) != 0 {
+		t.Error("draft with noecho must be delivered to the author's other sessions only")
+	}
+	<-other.send
+
+	// The draft is reported in the author's description only.
+	topic.replyGetDesc(other, "2", "", nil)
+	if reply := string((<-other.send).([]byte)); !strings.Contains(reply, `"draft":{`) ||
+		!strings.Contains(reply, `"draft text"`) {
+		t.Errorf("expecting the draft in the description, got '%s'", reply)
+	}
+	topic.replyGetDesc(peer, "3", "", nil)
+	if reply := string((<-peer.send).([]byte)); strings.Contains(reply, `"draft"`) {
+		t.Errorf("draft must not be reported to other users, got '%s'", reply)
+	}
+}
+
+func TestDraftVisibleTo(t *testing.T) {
+	alice, bob := types.Uid(1), types.Uid(2)
+	draft := &MsgClientPub{Draft: true}
+	if !draftVisibleTo(draft, alice.UserId(), alice) || draftVisibleTo(draft, alice.UserId(), bob) {
+		t.Error("draft must be visible to the author only")
+	}
+	if !draftVisibleTo(&MsgClientPub{}, alice.UserId(), bob) || !draftVisibleTo(nil, alice.UserId(), bob) {
+		t.Error("published message must be visible to everyone")
+	}
+}
+
+func TestValidateDefaultAcsChange(t *testing.T) {
+	change := func(auth, anon string) MsgSetQuery {
+		return MsgSetQuery{Desc: &MsgSetDesc{DefaultAcs: &MsgDefaultAcsMode{Auth: auth, Anon: anon}}}
+	}
+
+	if (MsgSetQuery{}).ChangesDefaultAcs() || (MsgSetQuery{Desc: &MsgSetDesc{Public: "x"}}).ChangesDefaultAcs() {
+		t.Error("request without defacs should not change it")
+	}
+	if !change("JRWP", "").ChangesDefaultAcs() {
+		t.Error("request with defacs should change it")
+	}
+
+	testCases := []struct {
+		query   MsgSetQuery
+		cat     types.TopicCat
+		isOwner bool
+		err     string
+	}{
+		{change("JRWP", "N"), types.TopicCatGrp, true, ""},
+		{change("JRWP", "N"), types.TopicCatGrp, false, "not owner"},
+		{change("JRWP", "bogus!"), types.TopicCatGrp, false, "not owner"},
+		{change("JRWP", "bogus!"), types.TopicCatGrp, true, "anon"},
+		{change("bogus!", ""), types.TopicCatMe, false, "auth"},
+		{change("JRWP", ""), types.TopicCatMe, false, ""},
+		{change("bogus!", ""), types.TopicCatP2P, false, ""},
+		{MsgSetQuery{Desc: &MsgSetDesc{Public: "x"}}, types.TopicCatGrp, false, ""},
+	}
+
+	for i, tc := range testCases {
+		err := validateDefaultAcsChange(tc.query, tc.cat, tc.isOwner)
+		switch tc.err {
+		case "":
+			if err != nil {
+				t.Errorf("%d: unexpected error %v", i, err)
+			}
+		case "not owner":
+			if err != errNotOwner {
+				t.Errorf("%d: expecting not owner, got %v", i, err)
+			}
+		default:
+			if acsErr, ok := err.(*defaultAcsError); !ok || acsErr.field != tc.err {
+				t.Errorf("%d: expecting invalid '%s', got %v", i, tc.err, err)
+			}
+		}
+	}
+}
+
+func TestLastSeenInfo(t *testing.T) {
+	if lastSeenInfo(nil) != nil || lastSeenInfo(&types.User{}) != nil {
+		t.Error("expecting nil for the user never seen online")
+	}
+	if lastSeenInfo(&types.User{LastSeen: &time.Time{}, UserAgent: "Tinode/1.0"}) != nil {
+		t.Error("expecting nil for zero last seen")
+	}
+
+	when := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	seen := lastSeenInfo(&types.User{LastSeen: &when, UserAgent: "Tinode/1.0"})
+	if seen == nil || seen.When == nil || !seen.When.Equal(when) || seen.UserAgent != "Tinode/1.0" {
+		t.Errorf("unexpected last seen %+v", seen)
+	}
+
+	out, _ := json.Marshal(&MsgTopicDesc{LastSeen: seen})
+	if string(out) != `{"seen":{"when":"2018-01-02T03:04:05Z","ua":"Tinode/1.0"}}` {
+		t.Errorf("unexpected desc '%s'", out)
+	}
+}
+
+func TestDescReply(t *testing.T) {
+	now := time.Now()
+	desc := &MsgTopicDesc{SeqId: 15, Etag: "stub-etag"}
+
+	reply := descReply("1", "grp1XUtEhjv6HND", desc, &MsgGetOpts{IfNoneMatch: "stub-etag"}, now)
+	if reply.Ctrl == nil || reply.Ctrl.Code != 304 || reply.Meta != nil {
+		t.Error("matching etag: expecting 304, got", reply)
+	}
+
+	for _, opts := range []*MsgGetOpts{nil, {}, {IfNoneMatch: "stale-etag"}} {
+		reply = descReply("2", "grp1XUtEhjv6HND", desc, opts, now)
+		if reply.Meta == nil || reply.Meta.Desc != desc || reply.Meta.Etag != "stub-etag" {
+			t.Errorf("opts %+v: expecting full meta, got %+v", opts, reply)
+		}
+	}
+
+	// The client has cached the description, then only the user's private value has changed.
+	updated := now.UTC()
+	cached := &MsgTopicDesc{UpdatedAt: &updated, SeqId: 15, Private: "work"}
+	cached.Etag = descEtag(cached)
+	current := &MsgTopicDesc{UpdatedAt: &updated, SeqId: 15, Private: "home"}
+	current.Etag = descEtag(current)
+	reply = descReply("3", "grp1XUtEhjv6HND", current, &MsgGetOpts{IfNoneMatch: cached.Etag}, now)
+	if reply.Meta == nil || reply.Meta.Desc != current {
+		t.Error("private-only change: expecting full meta, got", reply)
+	}
+	reply = descReply("4", "grp1XUtEhjv6HND", current, &MsgGetOpts{IfNoneMatch: current.Etag}, now)
+	if reply.Ctrl == nil || reply.Ctrl.Code != 304 {
+		t.Error("unchanged private: expecting 304, got", reply)
+	}
+}
+
+func TestResolveDelBefore(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	// Messages 1..5 sent one minute apart.
+	var stored []types.Message
+	for seq := 5; seq >= 1; seq-- {
+		msg := types.Message{SeqId: seq}
+		msg.CreatedAt = ts.Add(time.Duration(seq) * time.Minute)
+		stored = append(stored, msg)
+	}
+	// Stub of store.Messages.LastSeqBefore.
+	lastSeqBefore := func(before time.Time) (int, error) {
+		for _, msg := range stored {
+			if msg.CreatedAt.Before(before) {
+				return msg.SeqId, nil
+			}
+		}
+		return 0, nil
+	}
+
+	testCases := []struct {
+		before   time.Time
+		expected []MsgDelRange
+	}{
+		{ts, nil},
+		{ts.Add(time.Minute), nil},
+		{ts.Add(time.Minute + time.Second), []MsgDelRange{{LowId: 1}}},
+		{ts.Add(3*time.Minute + time.Second), []MsgDelRange{{LowId: 1, HiId: 3}}},
+		{ts.Add(time.Hour), []MsgDelRange{{LowId: 1, HiId: 5}}},
+	}
+
+	for i, tc := range testCases {
+		ranges, err := resolveDelBefore(tc.before, lastSeqBefore)
+		if err != nil {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		if len(ranges) != len(tc.expected) || (len(ranges) > 0 && ranges[0] != tc.expected[0]) {
+			t.Errorf("%d: expecting %v, got %v", i, tc.expected, ranges)
+		}
+	}
+
+	if _, err := resolveDelBefore(ts, func(time.Time) (int, error) {
+		return 0, errors.New("db down")
+	}); err == nil {
+		t.Error("expecting fetch error to be returned")
+	}
+}
+
+func TestViewOnceRead(t *testing.T) {
+	alice, bob, carol := types.Uid(1), types.Uid(2), types.Uid(3)
+	topic := &Topic{perUser: map[types.Uid]perUserData{alice: {}, bob: {readID: 5}, carol: {}}}
+	if ranges := topic.viewOnceRead(bob, 0, 5); ranges != nil {
+		t.Errorf("nothing to expire without view-once messages, got %v", ranges)
+	}
+
+	topic.trackViewOnce(2, alice)
+	topic.trackViewOnce(4, bob)
+	topic.trackViewOnce(7, alice)
+
+	// Bob's own message is not expired, the message beyond the read marker is not either.
+	ranges := topic.viewOnceRead(bob, 0, 5)
+	if len(ranges) != 1 || ranges[0].Low != 2 {
+		t.Errorf("expecting message 2 to expire, got %v", ranges)
+	}
+	if len(topic.viewOnce) != 3 {
+		t.Error("message must be remembered until all recipients read it")
+	}
+
+	topic.perUser[carol] = perUserData{readID: 5}
+	if ranges := topic.viewOnceRead(carol, 0, 5); len(ranges) != 2 {
+		t.Errorf("expecting messages 2 and 4 to expire, got %v", ranges)
+	}
+	if _, ok := topic.viewOnce[2]; ok {
+		t.Error("message read by all recipients must be forgotten")
+	}
+	if _, ok := topic.viewOnce[4]; !ok {
+		t.Error("message not read by alice must be remembered")
+	}
+}
+
+func TestReactions(t *testing.T) {
+	alice, bob := types.Uid(1), types.Uid(2)
+	topic := &Topic{}
+	topic.addReaction(3, alice, "+1")
+	topic.addReaction(3, bob, "+1")
+	topic.addReaction(3, alice, "heart")
+	topic.addReaction(5, bob, "+1")
+
+	summary := topic.reactionsFor([]types.Message{{SeqId: 3}, {SeqId: 4}})
+	if len(summary) != 1 || summary[0].SeqId != 3 || len(summary[0].Counts) != 2 ||
+		summary[0].Counts["+1"] != 1 || summary[0].Counts["heart"] != 1 {
+		t.Errorf("the user's new reaction must replace the earlier one, got %v", summary)
+	}
+
+	// Reactions to the oldest messages are forgotten.
+	for seq := 6; seq < 4+maxReactedMessages; seq++ {
+		topic.addReaction(seq, alice, "+1")
+	}
+	if len(topic.reactions) != maxReactedMessages {
+		t.Fatalf("expecting %d messages with reactions, got %d", maxReactedMessages, len(topic.reactions))
+	}
+	if topic.reactions[3] == nil {
+		t.Fatal("reactions must be kept up to the limit")
+	}
+	topic.addReaction(4+maxReactedMessages, alice, "+1")
+	if len(topic.reactions) != maxReactedMessages || topic.reactions[3] != nil {
+		t.Error("reactions to the oldest message must be forgotten")
+	}
+	topic.addReaction(1, alice, "+1")
+	if topic.reactions[1] != nil {
+		t.Error("reactions to messages older than the tracked ones must be ignored")
+	}
+}
+
+func TestLiveLocation(t *testing.T) {
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	alice, bob := types.Uid(1), types.Uid(2)
+	location := func(live bool, until time.Duration) interface{} {
+		return map[string]interface{}{"lat": 10.5, "lon": -20.0, "live": live,
+			"until": ts.Add(until).Format(time.RFC3339)}
+	}
+
+	topic := &Topic{}
+	topic.trackLiveLocation(1, alice, location(true, time.Hour), ts)
+	topic.trackLiveLocation(2, alice, location(false, time.Hour), ts)
+	topic.trackLiveLocation(3, alice, location(true, -time.Hour), ts)
+	topic.trackLiveLocation(4, alice, "hello", ts)
+	if len(topic.liveLocations) != 1 {
+		t.Fatalf("expecting one live location, got %v", topic.liveLocations)
+	}
+
+	if !topic.liveLocationActive(1, alice, ts.Add(time.Minute)) {
+		t.Error("author must be able to update the live location")
+	}
+	if topic.liveLocationActive(1, bob, ts.Add(time.Minute)) {
+		t.Error("only the author may update the live location")
+	}
+	if topic.liveLocationActive(2, alice, ts) {
+		t.Error("location which is not live must not be updated")
+	}
+	if topic.liveLocationActive(1, alice, ts.Add(time.Hour)) {
+		t.Error("expired live location must not be updated")
+	}
+	if len(topic.liveLocations) != 0 {
+		t.Error("expired live location must be forgotten")
+	}
+}
+
+func TestDescChangedFields(t *testing.T) {
+	if changed := descChangedFields(map[string]interface{}{}, map[string]interface{}{}); changed != nil {
+		t.Error("expecting no changes, got", changed)
+	}
+
+	changed := descChangedFields(map[string]interface{}{},
+		map[string]interface{}{"Public": nil, "Pinned": types.IntSlice{1}, "UpdatedAt": time.Now()})
+	if len(changed) != 2 || changed[0] != "public" || changed[1] != "pinned" {
+		t.Error("expecting public and pinned, got", changed)
+	}
+
+	changed = descChangedFields(map[string]interface{}{"Access": types.DefaultAccess{}}, map[string]interface{}{})
+	if len(changed) != 1 || changed[0] != "defacs" {
+		t.Error("expecting defacs, got", changed)
+	}
+}
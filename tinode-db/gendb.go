@@ -14,6 +14,17 @@ import (
 	"github.com/tinode/chat/server/store/types"
 )
 
+func upgradeDb(dbsource string) {
+	defer store.Close()
+
+	log.Println("Upgrading DB...")
+
+	if err := store.UpgradeDb(dbsource); err != nil {
+		log.Fatal("Failed to upgrade DB: ", err)
+	}
+	log.Println("DB successfully upgraded")
+}
+
 func genDb(reset bool, dbsource string, data *Data) {
 	var err error
 
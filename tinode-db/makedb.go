@@ -143,6 +143,7 @@ func getPassword(n int) string {
 
 func main() {
 	var reset = flag.Bool("reset", false, "first delete the database if one exists")
+	var upgrade = flag.Bool("upgrade", false, "upgrade the schema of an existing database and exit")
 	var datafile = flag.String("data", "", "name of file with sample data")
 	var conffile = flag.String("config", "./tinode.conf", "config of the database connection")
 	flag.Parse()
@@ -169,7 +170,11 @@ func main() {
 			log.Fatal(err)
 		}
 
-		genDb(*reset, string(config.StoreConfig), &data)
+		if *upgrade {
+			upgradeDb(string(config.StoreConfig))
+		} else {
+			genDb(*reset, string(config.StoreConfig), &data)
+		}
 	} else {
 		log.Println("No config provided. Exiting.")
 	}